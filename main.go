@@ -1,41 +1,74 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math"
+	"math/big"
 	"net/http"
+	"net/smtp"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	_ "time/tzdata" // schedules need the restaurant's zone even on images without tzdata
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
 )
 
 // Constants
 const (
-	SECRET_KEY                = "restaurant_secret_key_2024"
-	ACCESS_TOKEN_EXPIRE_HOURS = 24
-	TELEGRAM_BOT_TOKEN        = "7609705273:AAFoIawJBTGTFxECwhSjc7vpbgMBcveT_ko"
-	TELEGRAM_GROUP_ID         = "-1002783983140"
-	UPLOAD_DIR                = "uploads"
-	MAX_FILE_SIZE             = 10 << 20 // 10MB
+	PASSWORD_HASH_COST       = 12
+	OTP_LENGTH               = 6
+	OTP_TTL_MINUTES          = 5
+	OTP_MAX_ATTEMPTS         = 5
+	OTP_RESEND_SECONDS       = 60
+	OTP_MAX_PER_PHONE_HOUR   = 5
+	OTP_MAX_PER_IP_HOUR      = 20
+	VERIFICATION_TTL_MINUTES = 15
+	MAX_SAVED_ADDRESSES      = 20
+	MAX_FOOD_IMAGES          = 20
+	EVENTS_CHANNEL           = "restaurant_events"
+	MAX_NOTIFY_PAYLOAD       = 7900 // Postgres rejects NOTIFY payloads of 8000 bytes or more
 )
 
+// Loaded configuration, see loadConfig
+var config *Config
+
 // Database instance
 var db *sql.DB
+var dbConnStr string
 
 // WebSocket upgrader
 var upgrader = websocket.Upgrader{
@@ -48,8 +81,12 @@ var upgrader = websocket.Upgrader{
 
 // WebSocket clients
 var clients = make(map[*websocket.Conn]bool)
+var clientsMu sync.Mutex
 var broadcast = make(chan []byte)
 
+// Set while the LISTEN connection is up; otherwise events are broadcast locally only
+var eventListenerReady atomic.Bool
+
 // Enums
 type OrderStatus string
 
@@ -88,7 +125,7 @@ const (
 	PaymentRefunded PaymentStatus = "refunded"
 )
 
-// Multi-language support for foods only
+// Default category names, copied into the categories table on first start
 var FOOD_TRANSLATIONS = map[string]map[string]string{
 	"uz": {
 		"shashlik":       "Shashlik",
@@ -125,6 +162,8 @@ type User struct {
 	IsActive  bool      `json:"is_active" db:"is_active"`
 	TgID      *int64    `json:"tg_id,omitempty" db:"tg_id"`
 	Language  string    `json:"language" db:"language"`
+
+	TokenVersion int `json:"-" db:"token_version"`
 }
 
 type Food struct {
@@ -147,11 +186,158 @@ type Food struct {
 	IsPopular       bool                `json:"is_popular" db:"is_popular"`
 	Discount        int                 `json:"discount" db:"discount"`
 	OriginalPrice   int                 `json:"original_price"`
+	Promotion       *AppliedPromotion   `json:"promotion,omitempty"`
 	Comment         string              `json:"comment" db:"comment"`
+	Modifiers       []*ModifierGroup    `json:"modifiers,omitempty"`
+	Components      []*ComboSlot        `json:"components,omitempty"`
+	Images          []*FoodImage        `json:"images,omitempty"`
+	DeletedAt       *time.Time          `json:"deleted_at,omitempty" db:"deleted_at"`
 	CreatedAt       time.Time           `json:"created_at" db:"created_at"`
 	UpdatedAt       time.Time           `json:"updated_at" db:"updated_at"`
 }
 
+// ModifierGroup is a choice attached to a food ("Meat", "Extras") with
+// selection limits: min_select 1 makes the choice required, max_select 1
+// makes it single-choice
+type ModifierGroup struct {
+	ID        string            `json:"id" db:"id"`
+	FoodID    int64             `json:"food_id" db:"food_id"`
+	Names     map[string]string `json:"names,omitempty" db:"names"`
+	Name      string            `json:"name"`
+	MinSelect int               `json:"min_select" db:"min_select"`
+	MaxSelect int               `json:"max_select" db:"max_select"`
+	SortOrder int               `json:"sort_order" db:"sort_order"`
+	Options   []*ModifierOption `json:"options"`
+}
+
+type ModifierOption struct {
+	ID          string            `json:"id" db:"id"`
+	GroupID     string            `json:"group_id" db:"group_id"`
+	Names       map[string]string `json:"names,omitempty" db:"names"`
+	Name        string            `json:"name"`
+	PriceDelta  int               `json:"price_delta" db:"price_delta"`
+	IsAvailable bool              `json:"is_available" db:"is_available"`
+	SortOrder   int               `json:"sort_order" db:"sort_order"`
+}
+
+// ComboSlot is one part of a combo ("Soup", "Drink"); Quantity portions
+// of the chosen food are taken from stock per combo ordered
+type ComboSlot struct {
+	ID        string            `json:"id" db:"id"`
+	ComboID   int64             `json:"combo_id" db:"combo_id"`
+	Names     map[string]string `json:"names,omitempty" db:"names"`
+	Name      string            `json:"name"`
+	Quantity  int               `json:"quantity" db:"quantity"`
+	SortOrder int               `json:"sort_order" db:"sort_order"`
+	Choices   []*ComboChoice    `json:"choices"`
+}
+
+type ComboChoice struct {
+	FoodID      int64  `json:"food_id" db:"food_id"`
+	Name        string `json:"name"`
+	PriceDelta  int    `json:"price_delta" db:"price_delta"`
+	IsAvailable bool   `json:"is_available"`
+
+	names        map[string]string
+	fallbackName string
+	category     string
+	isThere      bool
+	stock        int
+	prepTime     int
+}
+
+const (
+	ScheduleTargetFood     = "food"
+	ScheduleTargetCategory = "category"
+)
+
+// AvailabilitySchedule is a window when a food or category is on the menu.
+// Empty days mean every day, empty times the whole day and empty dates no
+// limit. Days follow time.Weekday: 0 is Sunday.
+type AvailabilitySchedule struct {
+	ID         string    `json:"id" db:"id"`
+	TargetType string    `json:"target_type" db:"target_type"`
+	TargetID   string    `json:"target_id" db:"target_id"`
+	Days       []int     `json:"days" db:"days"`
+	StartTime  string    `json:"start_time,omitempty" db:"start_time"`
+	EndTime    string    `json:"end_time,omitempty" db:"end_time"`
+	StartDate  string    `json:"start_date,omitempty" db:"start_date"`
+	EndDate    string    `json:"end_date,omitempty" db:"end_date"`
+	IsActive   bool      `json:"is_active" db:"is_active"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+}
+
+const (
+	PromotionPercent  = "percent"
+	PromotionFixed    = "fixed"       // so'm off each portion
+	PromotionBuyXGetY = "buy_x_get_y" // every buy+get portions, get are free
+
+	PromotionScopeFood     = "food"
+	PromotionScopeCategory = "category" // with its subcategories
+	PromotionScopeMenu     = "menu"
+)
+
+// Promotion is a pricing rule. It runs from StartsAt to EndsAt and, when
+// days or times are set, only inside that weekly window (happy hour).
+type Promotion struct {
+	ID          string            `json:"id" db:"id"`
+	Names       map[string]string `json:"names" db:"names"`
+	Type        string            `json:"type" db:"type"`
+	Value       int               `json:"value" db:"value"`
+	BuyQuantity int               `json:"buy_quantity,omitempty" db:"buy_quantity"`
+	GetQuantity int               `json:"get_quantity,omitempty" db:"get_quantity"`
+	Scope       string            `json:"scope" db:"scope"`
+	ScopeID     string            `json:"scope_id,omitempty" db:"scope_id"`
+	StartsAt    *time.Time        `json:"starts_at,omitempty" db:"starts_at"`
+	EndsAt      *time.Time        `json:"ends_at,omitempty" db:"ends_at"`
+	Days        []int             `json:"days" db:"days"`
+	StartTime   string            `json:"start_time,omitempty" db:"start_time"`
+	EndTime     string            `json:"end_time,omitempty" db:"end_time"`
+	Priority    int               `json:"priority" db:"priority"`
+	IsActive    bool              `json:"is_active" db:"is_active"`
+	CreatedAt   time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at" db:"updated_at"`
+}
+
+// AppliedPromotion is the promotion behind a price, as customers see it
+type AppliedPromotion struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Type        string     `json:"type"`
+	Value       int        `json:"value,omitempty"`
+	BuyQuantity int        `json:"buy_quantity,omitempty"`
+	GetQuantity int        `json:"get_quantity,omitempty"`
+	EndsAt      *time.Time `json:"ends_at,omitempty"`
+}
+
+// FoodImage is a gallery entry pointing at an uploaded file. The primary
+// image is mirrored into Food.ImageURL.
+type FoodImage struct {
+	ID        string            `json:"id" db:"id"`
+	FoodID    int64             `json:"food_id" db:"food_id"`
+	FileID    string            `json:"file_id" db:"file_id"`
+	URL       string            `json:"url"`
+	Position  int               `json:"position" db:"position"`
+	IsPrimary bool              `json:"is_primary" db:"is_primary"`
+	AltTexts  map[string]string `json:"alt_texts,omitempty" db:"alt_texts"`
+	Alt       string            `json:"alt,omitempty"`
+	CreatedAt time.Time         `json:"created_at" db:"created_at"`
+}
+
+type Category struct {
+	Key       string            `json:"key" db:"key"`
+	Names     map[string]string `json:"names,omitempty" db:"names"`
+	Name      string            `json:"name"`
+	SortOrder int               `json:"sort_order" db:"sort_order"`
+	IconURL   string            `json:"icon_url,omitempty" db:"icon_url"`
+	IsActive  bool              `json:"is_active" db:"is_active"`
+	ParentKey *string           `json:"parent_key,omitempty" db:"parent_key"`
+	Children  []*Category       `json:"children,omitempty"`
+	CreatedAt time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at" db:"updated_at"`
+}
+
 type OrderFood struct {
 	ID          int64  `json:"id"`
 	Name        string `json:"name"`
@@ -161,6 +347,33 @@ type OrderFood struct {
 	ImageURL    string `json:"imageUrl"`
 	Count       int    `json:"count"`
 	TotalPrice  int    `json:"total_price"`
+
+	Options    []OrderFoodOption    `json:"options,omitempty"` // price already includes their deltas
+	Components []OrderFoodComponent `json:"components,omitempty"`
+
+	OriginalPrice int               `json:"original_price,omitempty"` // unit price before the promotion
+	FreeCount     int               `json:"free_count,omitempty"`     // portions given away by buy X get Y
+	Promotion     *AppliedPromotion `json:"promotion,omitempty"`
+}
+
+// OrderFoodComponent is a food served as part of an ordered combo
+type OrderFoodComponent struct {
+	FoodID     int64  `json:"food_id"`
+	SlotID     string `json:"slot_id"`
+	SlotName   string `json:"slot_name"`
+	Name       string `json:"name"`
+	Quantity   int    `json:"quantity"` // per combo
+	PriceDelta int    `json:"price_delta"`
+}
+
+// OrderFoodOption is a snapshot of a chosen modifier, kept with the order
+// so later menu edits don't change it
+type OrderFoodOption struct {
+	ID         string `json:"id"`
+	GroupID    string `json:"group_id"`
+	GroupName  string `json:"group_name"`
+	Name       string `json:"name"`
+	PriceDelta int    `json:"price_delta"`
 }
 
 type PaymentInfo struct {
@@ -172,14 +385,20 @@ type PaymentInfo struct {
 }
 
 type DeliveryInfo struct {
-	Type       string   `json:"type"`
-	Address    *string  `json:"address,omitempty"`
-	Latitude   *float64 `json:"latitude,omitempty"`
-	Longitude  *float64 `json:"longitude,omitempty"`
-	Phone      *string  `json:"phone,omitempty"`
-	TableID    *string  `json:"table_id,omitempty"`
-	TableName  *string  `json:"table_name,omitempty"`
-	PickupCode *string  `json:"pickup_code,omitempty"`
+	Type         string   `json:"type"`
+	Address      *string  `json:"address,omitempty"`
+	Latitude     *float64 `json:"latitude,omitempty"`
+	Longitude    *float64 `json:"longitude,omitempty"`
+	Entrance     *string  `json:"entrance,omitempty"`
+	Floor        *string  `json:"floor,omitempty"`
+	Apartment    *string  `json:"apartment,omitempty"`
+	CourierNotes *string  `json:"courier_notes,omitempty"`
+	AddressID    *string  `json:"address_id,omitempty"`
+	AddressLabel *string  `json:"address_label,omitempty"`
+	Phone        *string  `json:"phone,omitempty"`
+	TableID      *string  `json:"table_id,omitempty"`
+	TableName    *string  `json:"table_name,omitempty"`
+	PickupCode   *string  `json:"pickup_code,omitempty"`
 }
 
 type Order struct {
@@ -218,6 +437,21 @@ type Review struct {
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
 }
 
+type SavedAddress struct {
+	ID           string    `json:"id" db:"id"`
+	Label        string    `json:"label" db:"label"`
+	Address      string    `json:"address" db:"address"`
+	Latitude     *float64  `json:"latitude,omitempty" db:"latitude"`
+	Longitude    *float64  `json:"longitude,omitempty" db:"longitude"`
+	Entrance     *string   `json:"entrance,omitempty" db:"entrance"`
+	Floor        *string   `json:"floor,omitempty" db:"floor"`
+	Apartment    *string   `json:"apartment,omitempty" db:"apartment"`
+	CourierNotes *string   `json:"courier_notes,omitempty" db:"courier_notes"`
+	IsDefault    bool      `json:"is_default" db:"is_default"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+}
+
 type FileUpload struct {
 	ID           string    `json:"id" db:"id"`
 	OriginalName string    `json:"original_name" db:"original_name"`
@@ -237,19 +471,139 @@ type LoginRequest struct {
 }
 
 type RegisterRequest struct {
+	Number            string  `json:"number" binding:"required"`
+	Password          string  `json:"password" binding:"required"`
+	FullName          string  `json:"full_name" binding:"required"`
+	Email             *string `json:"email,omitempty"`
+	TgID              *int64  `json:"tg_id,omitempty"`
+	Language          string  `json:"language,omitempty"`
+	VerificationToken string  `json:"verification_token" binding:"required"`
+}
+
+type OTPRequest struct {
+	Number  string `json:"number" binding:"required"`
+	Purpose string `json:"purpose" binding:"required"`
+}
+
+type OTPVerifyRequest struct {
+	Number  string `json:"number" binding:"required"`
+	Code    string `json:"code" binding:"required"`
+	Purpose string `json:"purpose" binding:"required"`
+}
+
+type ForgotPasswordRequest struct {
+	Number  string `json:"number" binding:"required"`
+	Channel string `json:"channel,omitempty"`
+}
+
+type ResetPasswordRequest struct {
+	Number      string `json:"number" binding:"required"`
+	Code        string `json:"code" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
+type RoleRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+	Require2FA  bool     `json:"require_2fa"`
+}
+
+type RoleUpdate struct {
+	Description *string  `json:"description,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	Require2FA  *bool    `json:"require_2fa,omitempty"`
+}
+
+type StaffCreate struct {
 	Number   string  `json:"number" binding:"required"`
-	Password string  `json:"password" binding:"required"`
+	Password string  `json:"password" binding:"required,min=6"`
 	FullName string  `json:"full_name" binding:"required"`
 	Email    *string `json:"email,omitempty"`
-	TgID     *int64  `json:"tg_id,omitempty"`
+	Role     string  `json:"role" binding:"required"`
 	Language string  `json:"language,omitempty"`
 }
 
+type UserRoleUpdate struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type UserBlockRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+type ProfileUpdate struct {
+	FullName *string `json:"full_name,omitempty"`
+	Email    *string `json:"email,omitempty"`
+	Language *string `json:"language,omitempty"`
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
+type PhoneChangeRequest struct {
+	NewNumber string `json:"new_number" binding:"required"`
+}
+
+type PhoneChangeConfirm struct {
+	NewNumber string `json:"new_number" binding:"required"`
+	Code      string `json:"code" binding:"required"`
+}
+
+type AccountDeleteRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+type OTPLoginRequest struct {
+	Number string `json:"number" binding:"required"`
+	Code   string `json:"code" binding:"required"`
+}
+
+type APIKeyCreate struct {
+	Name          string   `json:"name" binding:"required,max=100"`
+	Permissions   []string `json:"permissions" binding:"required,min=1"`
+	ExpiresInDays *int     `json:"expires_in_days,omitempty"` // omitted: never expires
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code,omitempty"`
+	RecoveryCode   string `json:"recovery_code,omitempty"`
+}
+
+type TwoFactorChallengeRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type TwoFactorDisableRequest struct {
+	Password     string `json:"password" binding:"required"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
 type LoginResponse struct {
-	Token    string `json:"token"`
-	Role     string `json:"role"`
-	UserID   string `json:"user_id"`
-	Language string `json:"language"`
+	Token         string   `json:"token"`
+	RefreshToken  string   `json:"refresh_token"`
+	ExpiresIn     int      `json:"expires_in"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // only right after 2FA enrollment
+	Role          string   `json:"role"`
+	UserID        string   `json:"user_id"`
+	Language      string   `json:"language"`
+	SessionID     string   `json:"session_id"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
 type FoodCreate struct {
@@ -278,15 +632,124 @@ type FoodCreate struct {
 	StarRating      float64  `json:"star_rating,omitempty"`
 }
 
+type CategoryRequest struct {
+	Key       string            `json:"key" binding:"required"`
+	Names     map[string]string `json:"names" binding:"required"`
+	SortOrder int               `json:"sort_order"`
+	IconURL   string            `json:"icon_url,omitempty"`
+	IsActive  *bool             `json:"is_active,omitempty"`
+	ParentKey *string           `json:"parent_key,omitempty"`
+}
+
+type CategoryUpdate struct {
+	Names     map[string]string `json:"names,omitempty"`
+	SortOrder *int              `json:"sort_order,omitempty"`
+	IconURL   *string           `json:"icon_url,omitempty"`
+	IsActive  *bool             `json:"is_active,omitempty"`
+	ParentKey *string           `json:"parent_key,omitempty"` // "" moves the category to the top level
+}
+
 type CartItem struct {
-	FoodID   int64 `json:"food_id" binding:"required"`
-	Quantity int   `json:"quantity" binding:"required,min=1"`
+	FoodID    int64    `json:"food_id" binding:"required"`
+	Quantity  int      `json:"quantity" binding:"required,min=1"`
+	OptionIDs []string `json:"option_ids,omitempty"`
+
+	ComboChoices map[string]int64 `json:"combo_choices,omitempty"` // slot id -> chosen food id
+}
+
+type ScheduleRequest struct {
+	TargetType string `json:"target_type" binding:"required,oneof=food category"`
+	TargetID   string `json:"target_id" binding:"required"`
+	Days       []int  `json:"days,omitempty"`
+	StartTime  string `json:"start_time,omitempty"` // HH:MM, restaurant time
+	EndTime    string `json:"end_time,omitempty"`
+	StartDate  string `json:"start_date,omitempty"` // YYYY-MM-DD, inclusive
+	EndDate    string `json:"end_date,omitempty"`
+	IsActive   *bool  `json:"is_active,omitempty"`
+}
+
+type PromotionRequest struct {
+	Names       map[string]string `json:"names" binding:"required"`
+	Type        string            `json:"type" binding:"required,oneof=percent fixed buy_x_get_y"`
+	Value       int               `json:"value,omitempty"`
+	BuyQuantity int               `json:"buy_quantity,omitempty"`
+	GetQuantity int               `json:"get_quantity,omitempty"`
+	Scope       string            `json:"scope" binding:"required,oneof=food category menu"`
+	ScopeID     string            `json:"scope_id,omitempty"`
+	StartsAt    *time.Time        `json:"starts_at,omitempty"` // RFC 3339
+	EndsAt      *time.Time        `json:"ends_at,omitempty"`   // exclusive
+	Days        []int             `json:"days,omitempty"`
+	StartTime   string            `json:"start_time,omitempty"` // HH:MM, restaurant time
+	EndTime     string            `json:"end_time,omitempty"`
+	Priority    int               `json:"priority"`
+	IsActive    *bool             `json:"is_active,omitempty"`
+}
+
+type FoodImageRequest struct {
+	FileID    string            `json:"file_id" binding:"required"`
+	AltTexts  map[string]string `json:"alt_texts,omitempty"`
+	IsPrimary bool              `json:"is_primary"`
+}
+
+type FoodImageUpdate struct {
+	AltTexts  map[string]string `json:"alt_texts,omitempty"`
+	IsPrimary *bool             `json:"is_primary,omitempty"`
+}
+
+type FoodImageOrderRequest struct {
+	ImageIDs []string `json:"image_ids" binding:"required,min=1"`
+}
+
+type ComboRequest struct {
+	Slots []ComboSlotRequest `json:"slots" binding:"required,min=1,dive"`
+}
+
+type ComboSlotRequest struct {
+	ID       string               `json:"id,omitempty"` // keep an existing slot
+	Names    map[string]string    `json:"names" binding:"required"`
+	Quantity int                  `json:"quantity" binding:"required,min=1"`
+	Choices  []ComboChoiceRequest `json:"choices" binding:"required,min=1,dive"`
+}
+
+type ComboChoiceRequest struct {
+	FoodID     int64 `json:"food_id" binding:"required"`
+	PriceDelta int   `json:"price_delta"`
+}
+
+type ModifierGroupRequest struct {
+	Names     map[string]string       `json:"names" binding:"required"`
+	MinSelect int                     `json:"min_select" binding:"min=0"`
+	MaxSelect int                     `json:"max_select" binding:"required,min=1"`
+	SortOrder int                     `json:"sort_order"`
+	Options   []ModifierOptionRequest `json:"options,omitempty" binding:"dive"`
+}
+
+type ModifierGroupUpdate struct {
+	Names     map[string]string `json:"names,omitempty"`
+	MinSelect *int              `json:"min_select,omitempty" binding:"omitempty,min=0"`
+	MaxSelect *int              `json:"max_select,omitempty" binding:"omitempty,min=1"`
+	SortOrder *int              `json:"sort_order,omitempty"`
+}
+
+type ModifierOptionRequest struct {
+	Names       map[string]string `json:"names" binding:"required"`
+	PriceDelta  int               `json:"price_delta"`
+	IsAvailable *bool             `json:"is_available,omitempty"`
+	SortOrder   int               `json:"sort_order"`
+}
+
+type ModifierOptionUpdate struct {
+	Names       map[string]string `json:"names,omitempty"`
+	PriceDelta  *int              `json:"price_delta,omitempty"`
+	IsAvailable *bool             `json:"is_available,omitempty"`
+	SortOrder   *int              `json:"sort_order,omitempty"`
 }
 
 type OrderRequest struct {
 	Items               []CartItem             `json:"items" binding:"required"`
 	DeliveryType        DeliveryType           `json:"delivery_type" binding:"required"`
 	DeliveryInfo        map[string]interface{} `json:"delivery_info"`
+	AddressID           *string                `json:"address_id,omitempty"` // saved address, replaces delivery_info address fields
 	PaymentMethod       PaymentMethod          `json:"payment_method" binding:"required"`
 	SpecialInstructions *string                `json:"special_instructions,omitempty"`
 	CustomerInfo        *CustomerInfo          `json:"customer_info,omitempty"`
@@ -298,6 +761,18 @@ type CustomerInfo struct {
 	Email string `json:"email,omitempty"`
 }
 
+type AddressRequest struct {
+	Label        string   `json:"label" binding:"required,max=50"`
+	Address      string   `json:"address" binding:"required,max=500"`
+	Latitude     *float64 `json:"latitude,omitempty"`
+	Longitude    *float64 `json:"longitude,omitempty"`
+	Entrance     *string  `json:"entrance,omitempty" binding:"omitempty,max=20"`
+	Floor        *string  `json:"floor,omitempty" binding:"omitempty,max=20"`
+	Apartment    *string  `json:"apartment,omitempty" binding:"omitempty,max=20"`
+	CourierNotes *string  `json:"courier_notes,omitempty" binding:"omitempty,max=500"`
+	IsDefault    bool     `json:"is_default"`
+}
+
 type ReviewCreate struct {
 	FoodID  int64  `json:"food_id" binding:"required"`
 	Rating  int    `json:"rating" binding:"required,min=1,max=5"`
@@ -317,10 +792,16 @@ type TelegramMessage struct {
 
 // JWT Claims
 type Claims struct {
-	Number string `json:"sub"`
-	Role   string `json:"role"`
-	UserID string `json:"user_id"`
+	Number       string `json:"sub"`
+	Role         string `json:"role"`
+	UserID       string `json:"user_id"`
+	TokenVersion int    `json:"ver"`
+	SessionID    string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
+
+	// Set instead of a role when the request is authenticated with an API key
+	APIKeyID string   `json:"-"`
+	Scopes   []string `json:"-"`
 }
 
 // Restaurant tables
@@ -397,36 +878,392 @@ type WSMessage struct {
 	OrderID string      `json:"order_id,omitempty"`
 }
 
-// ========== DATABASE FUNCTIONS ==========
+// ========== CONFIGURATION ==========
+
+// Config is read from an optional YAML file (CONFIG_FILE) and then
+// overridden by environment variables. Secrets should come from the
+// environment.
+type Config struct {
+	Port           string           `yaml:"port"`
+	TrustedProxies []string         `yaml:"trusted_proxies"`
+	Database       DatabaseConfig   `yaml:"database"`
+	JWT            JWTConfig        `yaml:"jwt"`
+	Telegram       TelegramConfig   `yaml:"telegram"`
+	Upload         UploadConfig     `yaml:"upload"`
+	CORS           CORSConfig       `yaml:"cors"`
+	SMS            SMSConfig        `yaml:"sms"`
+	SMTP           SMTPConfig       `yaml:"smtp"`
+	RateLimit      RateLimitConfig  `yaml:"rate_limit"`
+	Restaurant     RestaurantConfig `yaml:"restaurant"`
+}
 
-func initDatabase() error {
-	var err error
+type DatabaseConfig struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+}
 
-	// Database connection string
-	dbHost := os.Getenv("DB_HOST")
-	if dbHost == "" {
-		dbHost = "localhost"
+// JWTKey is an HS256 signing key. Tokens carry the kid in their header, so
+// a new key can be made active while tokens signed with older keys in the
+// list stay valid until they expire.
+type JWTKey struct {
+	ID     string `yaml:"kid"`
+	Secret string `yaml:"secret"`
+}
+
+type JWTConfig struct {
+	Keys       []JWTKey      `yaml:"keys"`
+	ActiveKID  string        `yaml:"active_kid"`
+	AccessTTL  time.Duration `yaml:"access_ttl"`
+	RefreshTTL time.Duration `yaml:"refresh_ttl"`
+}
+
+type TelegramConfig struct {
+	BotToken string `yaml:"bot_token"`
+	GroupID  string `yaml:"group_id"`
+}
+
+type UploadConfig struct {
+	Dir         string `yaml:"dir"`
+	MaxFileSize int64  `yaml:"max_file_size"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+type SMSConfig struct {
+	Provider             string `yaml:"provider"`
+	EskizEmail           string `yaml:"eskiz_email"`
+	EskizPassword        string `yaml:"eskiz_password"`
+	EskizFrom            string `yaml:"eskiz_from"`
+	PlayMobileLogin      string `yaml:"playmobile_login"`
+	PlayMobilePassword   string `yaml:"playmobile_password"`
+	PlayMobileOriginator string `yaml:"playmobile_originator"`
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+// Rate limits are written as "<requests>/<duration>", e.g. "10/1m"
+type RateLimitConfig struct {
+	Store      string `yaml:"store"`
+	API        string `yaml:"api"`
+	LoginIP    string `yaml:"login_ip"`
+	LoginPhone string `yaml:"login_phone"`
+	RegisterIP string `yaml:"register_ip"`
+	UploadIP   string `yaml:"upload_ip"`
+}
+
+// RestaurantConfig holds settings about the restaurant itself; menu
+// schedules are evaluated in its time zone
+type RestaurantConfig struct {
+	TimeZone string `yaml:"timezone"`
+
+	location *time.Location
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port: "8000",
+		Database: DatabaseConfig{
+			Host:     "localhost",
+			Port:     "5432",
+			User:     "postgres",
+			Password: "password",
+			Name:     "restaurant_db",
+			SSLMode:  "disable",
+		},
+		JWT: JWTConfig{
+			AccessTTL:  15 * time.Minute,
+			RefreshTTL: 30 * 24 * time.Hour,
+		},
+		Upload: UploadConfig{
+			Dir:         "uploads",
+			MaxFileSize: 10 << 20, // 10MB
+		},
+		CORS: CORSConfig{AllowedOrigins: []string{"*"}},
+		SMTP: SMTPConfig{Port: "587"},
+		RateLimit: RateLimitConfig{
+			Store:      "memory",
+			API:        "300/1m",
+			LoginIP:    "10/1m",
+			LoginPhone: "5/1m",
+			RegisterIP: "5/1m",
+			UploadIP:   "20/1m",
+		},
+		Restaurant: RestaurantConfig{TimeZone: "Asia/Tashkent"},
+	}
+}
+
+func envString(target *string, name string) {
+	if value, ok := os.LookupEnv(name); ok {
+		*target = value
+	}
+}
+
+func envList(target *[]string, name string) {
+	if value, ok := os.LookupEnv(name); ok {
+		*target = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*target = append(*target, item)
+			}
+		}
+	}
+}
+
+func envInt64(target *int64, name string) error {
+	if value, ok := os.LookupEnv(name); ok {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		*target = parsed
+	}
+	return nil
+}
+
+func envDuration(target *time.Duration, name string) error {
+	if value, ok := os.LookupEnv(name); ok {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		*target = parsed
+	}
+	return nil
+}
+
+// envJWTKeys reads JWT_KEYS ("kid1:secret1,kid2:secret2") or, for a single
+// key, JWT_SECRET which gets the kid "default".
+func envJWTKeys(cfg *JWTConfig) error {
+	if value, ok := os.LookupEnv("JWT_KEYS"); ok {
+		cfg.Keys = nil
+		for _, item := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+			if len(parts) != 2 {
+				return errors.New("JWT_KEYS: expected kid:secret pairs")
+			}
+			cfg.Keys = append(cfg.Keys, JWTKey{ID: parts[0], Secret: parts[1]})
+		}
+	} else if secret, ok := os.LookupEnv("JWT_SECRET"); ok {
+		cfg.Keys = []JWTKey{{ID: "default", Secret: secret}}
+	}
+	envString(&cfg.ActiveKID, "JWT_ACTIVE_KID")
+	return nil
+}
+
+func applyEnv(cfg *Config) error {
+	envString(&cfg.Port, "PORT")
+	envList(&cfg.TrustedProxies, "TRUSTED_PROXIES")
+
+	envString(&cfg.Database.Host, "DB_HOST")
+	envString(&cfg.Database.Port, "DB_PORT")
+	envString(&cfg.Database.User, "DB_USER")
+	envString(&cfg.Database.Password, "DB_PASSWORD")
+	envString(&cfg.Database.Name, "DB_NAME")
+	envString(&cfg.Database.SSLMode, "DB_SSLMODE")
+
+	if err := envJWTKeys(&cfg.JWT); err != nil {
+		return err
+	}
+	if err := envDuration(&cfg.JWT.AccessTTL, "JWT_ACCESS_TTL"); err != nil {
+		return err
+	}
+	if err := envDuration(&cfg.JWT.RefreshTTL, "JWT_REFRESH_TTL"); err != nil {
+		return err
+	}
+
+	envString(&cfg.Telegram.BotToken, "TELEGRAM_BOT_TOKEN")
+	envString(&cfg.Telegram.GroupID, "TELEGRAM_GROUP_ID")
+
+	envString(&cfg.Upload.Dir, "UPLOAD_DIR")
+	if err := envInt64(&cfg.Upload.MaxFileSize, "UPLOAD_MAX_FILE_SIZE"); err != nil {
+		return err
+	}
+
+	envList(&cfg.CORS.AllowedOrigins, "CORS_ALLOWED_ORIGINS")
+
+	envString(&cfg.SMS.Provider, "SMS_PROVIDER")
+	envString(&cfg.SMS.EskizEmail, "ESKIZ_EMAIL")
+	envString(&cfg.SMS.EskizPassword, "ESKIZ_PASSWORD")
+	envString(&cfg.SMS.EskizFrom, "ESKIZ_FROM")
+	envString(&cfg.SMS.PlayMobileLogin, "PLAYMOBILE_LOGIN")
+	envString(&cfg.SMS.PlayMobilePassword, "PLAYMOBILE_PASSWORD")
+	envString(&cfg.SMS.PlayMobileOriginator, "PLAYMOBILE_ORIGINATOR")
+
+	envString(&cfg.SMTP.Host, "SMTP_HOST")
+	envString(&cfg.SMTP.Port, "SMTP_PORT")
+	envString(&cfg.SMTP.User, "SMTP_USER")
+	envString(&cfg.SMTP.Password, "SMTP_PASSWORD")
+	envString(&cfg.SMTP.From, "SMTP_FROM")
+
+	envString(&cfg.RateLimit.Store, "RATE_LIMIT_STORE")
+	envString(&cfg.RateLimit.API, "RATE_LIMIT_API")
+	envString(&cfg.RateLimit.LoginIP, "RATE_LIMIT_LOGIN_IP")
+	envString(&cfg.RateLimit.LoginPhone, "RATE_LIMIT_LOGIN_PHONE")
+	envString(&cfg.RateLimit.RegisterIP, "RATE_LIMIT_REGISTER_IP")
+	envString(&cfg.RateLimit.UploadIP, "RATE_LIMIT_UPLOAD_IP")
+
+	envString(&cfg.Restaurant.TimeZone, "RESTAURANT_TIMEZONE")
+	return nil
+}
+
+// validate reports every problem at once so a misconfigured deployment
+// can be fixed in one go
+func (cfg *Config) validate() error {
+	var problems []string
+
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port <= 0 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("port: invalid value %q", cfg.Port))
+	}
+	if cfg.Database.Host == "" || cfg.Database.Name == "" || cfg.Database.User == "" {
+		problems = append(problems, "database: host, name and user are required")
+	}
+
+	if len(cfg.JWT.Keys) == 0 {
+		problems = append(problems, "jwt: at least one signing key is required (JWT_SECRET or JWT_KEYS)")
+	}
+	seenKIDs := make(map[string]bool)
+	for _, key := range cfg.JWT.Keys {
+		if key.ID == "" {
+			problems = append(problems, "jwt: every key needs a kid")
+		}
+		if seenKIDs[key.ID] {
+			problems = append(problems, fmt.Sprintf("jwt: duplicate kid %q", key.ID))
+		}
+		seenKIDs[key.ID] = true
+		if len(key.Secret) < 32 {
+			problems = append(problems, fmt.Sprintf("jwt: key %q must be at least 32 characters", key.ID))
+		}
+	}
+	if cfg.JWT.ActiveKID == "" && len(cfg.JWT.Keys) > 0 {
+		cfg.JWT.ActiveKID = cfg.JWT.Keys[len(cfg.JWT.Keys)-1].ID
+	}
+	if len(cfg.JWT.Keys) > 0 && !seenKIDs[cfg.JWT.ActiveKID] {
+		problems = append(problems, fmt.Sprintf("jwt: active kid %q is not in the key list", cfg.JWT.ActiveKID))
+	}
+	if cfg.JWT.AccessTTL <= 0 || cfg.JWT.RefreshTTL <= cfg.JWT.AccessTTL {
+		problems = append(problems, "jwt: access_ttl must be positive and shorter than refresh_ttl")
+	}
+
+	if (cfg.Telegram.BotToken == "") != (cfg.Telegram.GroupID == "") {
+		problems = append(problems, "telegram: bot_token and group_id must be set together")
+	}
+
+	if cfg.Upload.Dir == "" {
+		problems = append(problems, "upload: dir is required")
+	}
+	if cfg.Upload.MaxFileSize <= 0 {
+		problems = append(problems, "upload: max_file_size must be positive")
+	}
+
+	if len(cfg.CORS.AllowedOrigins) == 0 {
+		problems = append(problems, "cors: at least one allowed origin is required")
+	}
+
+	// No default: logging codes instead of sending them must be chosen on purpose
+	switch cfg.SMS.Provider {
+	case "":
+		problems = append(problems, "sms: provider is required (eskiz, playmobile or fake)")
+	case "fake":
+	case "eskiz":
+		if cfg.SMS.EskizEmail == "" || cfg.SMS.EskizPassword == "" {
+			problems = append(problems, "sms: eskiz_email and eskiz_password are required")
+		}
+	case "playmobile":
+		if cfg.SMS.PlayMobileLogin == "" || cfg.SMS.PlayMobilePassword == "" {
+			problems = append(problems, "sms: playmobile_login and playmobile_password are required")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("sms: unknown provider %q", cfg.SMS.Provider))
+	}
+
+	switch cfg.RateLimit.Store {
+	case "memory", "postgres":
+	default:
+		problems = append(problems, fmt.Sprintf("rate_limit: unknown store %q", cfg.RateLimit.Store))
+	}
+	for name, value := range map[string]string{
+		"api":         cfg.RateLimit.API,
+		"login_ip":    cfg.RateLimit.LoginIP,
+		"login_phone": cfg.RateLimit.LoginPhone,
+		"register_ip": cfg.RateLimit.RegisterIP,
+		"upload_ip":   cfg.RateLimit.UploadIP,
+	} {
+		if _, err := parseRateLimit(value); err != nil {
+			problems = append(problems, fmt.Sprintf("rate_limit.%s: %v", name, err))
+		}
+	}
+
+	if location, err := time.LoadLocation(cfg.Restaurant.TimeZone); err != nil || cfg.Restaurant.TimeZone == "" {
+		problems = append(problems, fmt.Sprintf("restaurant: unknown timezone %q", cfg.Restaurant.TimeZone))
+	} else {
+		cfg.Restaurant.location = location
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
 	}
-	dbPort := os.Getenv("DB_PORT")
-	if dbPort == "" {
-		dbPort = "5432"
+	return nil
+}
+
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config file error: %v", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("config file %s: %v", path, err)
+		}
 	}
-	dbUser := os.Getenv("DB_USER")
-	if dbUser == "" {
-		dbUser = "postgres"
+
+	if err := applyEnv(cfg); err != nil {
+		return nil, err
 	}
-	dbPassword := os.Getenv("DB_PASSWORD")
-	if dbPassword == "" {
-		dbPassword = "password"
+	if err := cfg.validate(); err != nil {
+		return nil, err
 	}
-	dbName := os.Getenv("DB_NAME")
-	if dbName == "" {
-		dbName = "restaurant_db"
+	return cfg, nil
+}
+
+func (cfg *Config) jwtKey(kid string) ([]byte, bool) {
+	for _, key := range cfg.JWT.Keys {
+		if key.ID == kid {
+			return []byte(key.Secret), true
+		}
 	}
+	return nil, false
+}
+
+func (cfg *Config) telegramEnabled() bool {
+	return cfg.Telegram.BotToken != ""
+}
+
+// ========== DATABASE FUNCTIONS ==========
+
+func initDatabase() error {
+	var err error
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		dbHost, dbPort, dbUser, dbPassword, dbName)
+	// Database connection string
+	dbConfig := config.Database
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		dbConfig.Host, dbConfig.Port, dbConfig.User, dbConfig.Password, dbConfig.Name, dbConfig.SSLMode)
 
+	dbConnStr = connStr
 	db, err = sql.Open("postgres", connStr)
 	if err != nil {
 		return fmt.Errorf("database connection error: %v", err)
@@ -440,13 +1277,73 @@ func initDatabase() error {
 		return fmt.Errorf("create tables error: %v", err)
 	}
 
-	log.Println("✅ PostgreSQL database connected successfully")
-	return nil
-}
+	if err = seedRoles(); err != nil {
+		return fmt.Errorf("seed roles error: %v", err)
+	}
 
-func createTables() error {
-	queries := []string{
-		// Users table
+	if err = runMigrationOnce("first_owner", promoteFirstOwner); err != nil {
+		return fmt.Errorf("owner migration error: %v", err)
+	}
+
+	if err = runMigrationOnce("phone_numbers_e164", migratePhoneNumbers); err != nil {
+		return fmt.Errorf("phone migration error: %v", err)
+	}
+
+	if err = runMigrationOnce("session_two_factor", migrateSessionTwoFactor); err != nil {
+		return fmt.Errorf("session 2FA migration error: %v", err)
+	}
+
+	if err = runMigrationOnce("food_image_paths", migrateFoodImageURLs); err != nil {
+		return fmt.Errorf("food image migration error: %v", err)
+	}
+
+	if err = seedCategories(); err != nil {
+		return fmt.Errorf("seed categories error: %v", err)
+	}
+
+	if err = runMigrationOnce("food_change_baselines", seedFoodChangeBaselines); err != nil {
+		return fmt.Errorf("food change baseline error: %v", err)
+	}
+
+	log.Println("✅ PostgreSQL database connected successfully")
+	return nil
+}
+
+// runMigrationOnce runs a data migration the first time any instance starts
+// with it. The advisory lock makes replicas starting together wait for the
+// one running it and then find it recorded. The migration runs on the
+// transaction holding the lock, so it is recorded only if all of it applies.
+func runMigrationOnce(name string, migrate func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, "migration:"+name); err != nil {
+		return err
+	}
+	var done bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE name = $1)`, name).Scan(&done); err != nil {
+		return err
+	}
+	if done {
+		return nil
+	}
+
+	if err := migrate(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (name) VALUES ($1)`, name); err != nil {
+		return err
+	}
+	log.Printf("✅ Migration %s applied", name)
+	return tx.Commit()
+}
+
+func createTables() error {
+	queries := []string{
+		// Users table
 		`CREATE TABLE IF NOT EXISTS users (
 			id VARCHAR(255) PRIMARY KEY,
 			number VARCHAR(20) UNIQUE NOT NULL,
@@ -555,6 +1452,350 @@ func createTables() error {
 		`CREATE INDEX IF NOT EXISTS idx_orders_order_time ON orders(order_time)`,
 		`CREATE INDEX IF NOT EXISTS idx_reviews_food_id ON reviews(food_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_reviews_user_id ON reviews(user_id)`,
+
+		// Token revocation. Logout-all bumps token_version, which every access
+		// token carries as "ver".
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS token_version INTEGER DEFAULT 0`,
+
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id VARCHAR(255) PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			revoked_at TIMESTAMP
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS revoked_tokens (
+			jti VARCHAR(255) PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id)`,
+
+		// Phone verification
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS phone_verified_at TIMESTAMP`,
+
+		`CREATE TABLE IF NOT EXISTS phone_verifications (
+			id VARCHAR(255) PRIMARY KEY,
+			phone VARCHAR(20) NOT NULL,
+			purpose VARCHAR(30) NOT NULL,
+			code_hash VARCHAR(64) NOT NULL,
+			ip VARCHAR(64),
+			attempts INTEGER DEFAULT 0,
+			expires_at TIMESTAMP NOT NULL,
+			verified_at TIMESTAMP,
+			verification_token_hash VARCHAR(64) UNIQUE,
+			consumed_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_phone_verifications_phone ON phone_verifications(phone, purpose)`,
+
+		// Roles and permissions
+		`CREATE TABLE IF NOT EXISTS roles (
+			name VARCHAR(50) PRIMARY KEY,
+			description TEXT,
+			is_system BOOLEAN DEFAULT false,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS role_permissions (
+			role VARCHAR(50) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+			permission VARCHAR(100) NOT NULL,
+			PRIMARY KEY (role, permission)
+		)`,
+
+		// Known permissions, used to grant newly added ones to the default roles
+		`CREATE TABLE IF NOT EXISTS permissions (
+			name VARCHAR(100) PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Admin audit trail
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id VARCHAR(255) PRIMARY KEY,
+			actor_id VARCHAR(255),
+			actor_number VARCHAR(20),
+			action VARCHAR(100) NOT NULL,
+			target_type VARCHAR(50),
+			target_id VARCHAR(255),
+			details JSONB,
+			ip VARCHAR(64),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target_type, target_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at)`,
+
+		// Rate limiting
+		`CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+			key VARCHAR(255) PRIMARY KEY,
+			tokens DOUBLE PRECISION NOT NULL,
+			allowed BOOLEAN NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+
+		// Failed logins per number and client IP; ip '*' counts all clients
+		`DROP TABLE IF EXISTS login_failures`,
+		`CREATE TABLE IF NOT EXISTS login_lockouts (
+			number VARCHAR(20) NOT NULL,
+			ip VARCHAR(64) NOT NULL,
+			failures INTEGER NOT NULL DEFAULT 0,
+			last_failure_at TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP,
+			PRIMARY KEY (number, ip)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_phone_verifications_ip ON phone_verifications(ip, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires_at ON revoked_tokens(expires_at)`,
+
+		// Soft delete for foods
+		`ALTER TABLE foods ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`,
+		`CREATE INDEX IF NOT EXISTS idx_foods_deleted_at ON foods(deleted_at) WHERE deleted_at IS NOT NULL`,
+
+		// Menu categories
+		`CREATE TABLE IF NOT EXISTS categories (
+			key VARCHAR(100) PRIMARY KEY,
+			names JSONB NOT NULL,
+			sort_order INTEGER DEFAULT 0,
+			icon_url TEXT,
+			is_active BOOLEAN DEFAULT true,
+			parent_key VARCHAR(100) REFERENCES categories(key),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Food modifiers
+		`CREATE TABLE IF NOT EXISTS modifier_groups (
+			id VARCHAR(50) PRIMARY KEY,
+			food_id BIGINT NOT NULL REFERENCES foods(id) ON DELETE CASCADE,
+			names JSONB NOT NULL,
+			min_select INTEGER DEFAULT 0,
+			max_select INTEGER DEFAULT 1,
+			sort_order INTEGER DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_modifier_groups_food ON modifier_groups(food_id)`,
+		`CREATE TABLE IF NOT EXISTS modifier_options (
+			id VARCHAR(50) PRIMARY KEY,
+			group_id VARCHAR(50) NOT NULL REFERENCES modifier_groups(id) ON DELETE CASCADE,
+			names JSONB NOT NULL,
+			price_delta INTEGER DEFAULT 0,
+			is_available BOOLEAN DEFAULT true,
+			sort_order INTEGER DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_modifier_options_group ON modifier_options(group_id)`,
+
+		// Combo meals
+		`CREATE TABLE IF NOT EXISTS combo_slots (
+			id VARCHAR(50) PRIMARY KEY,
+			combo_id BIGINT NOT NULL REFERENCES foods(id) ON DELETE CASCADE,
+			names JSONB NOT NULL,
+			quantity INTEGER DEFAULT 1,
+			sort_order INTEGER DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_combo_slots_combo ON combo_slots(combo_id)`,
+		`CREATE TABLE IF NOT EXISTS combo_slot_choices (
+			slot_id VARCHAR(50) NOT NULL REFERENCES combo_slots(id) ON DELETE CASCADE,
+			food_id BIGINT NOT NULL REFERENCES foods(id) ON DELETE CASCADE,
+			price_delta INTEGER DEFAULT 0,
+			sort_order INTEGER DEFAULT 0,
+			PRIMARY KEY (slot_id, food_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_combo_slot_choices_food ON combo_slot_choices(food_id)`,
+
+		// Menu availability schedules
+		`CREATE TABLE IF NOT EXISTS availability_schedules (
+			id VARCHAR(50) PRIMARY KEY,
+			target_type VARCHAR(20) NOT NULL,
+			target_id VARCHAR(100) NOT NULL,
+			days INTEGER[] DEFAULT '{}',
+			start_time VARCHAR(5),
+			end_time VARCHAR(5),
+			start_date DATE,
+			end_date DATE,
+			is_active BOOLEAN DEFAULT true,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_availability_schedules_target ON availability_schedules(target_type, target_id)`,
+
+		// Food image galleries
+		`CREATE TABLE IF NOT EXISTS food_images (
+			id VARCHAR(50) PRIMARY KEY,
+			food_id BIGINT NOT NULL REFERENCES foods(id) ON DELETE CASCADE,
+			file_id VARCHAR(255) NOT NULL REFERENCES file_uploads(id),
+			position INTEGER DEFAULT 0,
+			is_primary BOOLEAN DEFAULT false,
+			alt_texts JSONB,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (food_id, file_id)
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_food_images_primary ON food_images(food_id) WHERE is_primary`,
+		`CREATE INDEX IF NOT EXISTS idx_food_images_file ON food_images(file_id)`,
+
+		// Promotion rules; bounds and windows are restaurant time
+		`CREATE TABLE IF NOT EXISTS promotions (
+			id VARCHAR(255) PRIMARY KEY,
+			names JSONB NOT NULL,
+			type VARCHAR(20) NOT NULL,
+			value INTEGER NOT NULL DEFAULT 0,
+			buy_quantity INTEGER NOT NULL DEFAULT 0,
+			get_quantity INTEGER NOT NULL DEFAULT 0,
+			scope VARCHAR(20) NOT NULL,
+			scope_id VARCHAR(255),
+			starts_at TIMESTAMP,
+			ends_at TIMESTAMP,
+			days INTEGER[] NOT NULL DEFAULT '{}',
+			start_time VARCHAR(5),
+			end_time VARCHAR(5),
+			priority INTEGER NOT NULL DEFAULT 0,
+			is_active BOOLEAN DEFAULT true,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_promotions_scope ON promotions(scope, scope_id)`,
+
+		// Append-only change log of foods, kept after a food is purged
+		`CREATE TABLE IF NOT EXISTS food_changes (
+			id BIGSERIAL PRIMARY KEY,
+			food_id BIGINT NOT NULL,
+			action VARCHAR(30) NOT NULL,
+			actor_id VARCHAR(255),
+			actor_number VARCHAR(20),
+			actor_role VARCHAR(50),
+			api_key_id VARCHAR(255),
+			changes JSONB NOT NULL,
+			price INTEGER,
+			discount INTEGER,
+			names JSONB,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_food_changes_food ON food_changes(food_id, created_at)`,
+
+		`CREATE OR REPLACE FUNCTION reject_food_change_edits()
+		RETURNS TRIGGER AS $$
+		BEGIN
+			RAISE EXCEPTION 'food_changes is append-only';
+		END;
+		$$ language 'plpgsql'`,
+
+		`DROP TRIGGER IF EXISTS food_changes_append_only ON food_changes`,
+
+		`CREATE TRIGGER food_changes_append_only
+			BEFORE UPDATE OR DELETE ON food_changes
+			FOR EACH ROW
+			EXECUTE FUNCTION reject_food_change_edits()`,
+
+		`DROP TRIGGER IF EXISTS food_changes_no_truncate ON food_changes`,
+
+		`CREATE TRIGGER food_changes_no_truncate
+			BEFORE TRUNCATE ON food_changes
+			FOR EACH STATEMENT
+			EXECUTE FUNCTION reject_food_change_edits()`,
+
+		// One-off data migrations already applied, see runMigrationOnce
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			name VARCHAR(100) PRIMARY KEY,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Saved delivery addresses
+		`CREATE TABLE IF NOT EXISTS user_addresses (
+			id VARCHAR(255) PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			label VARCHAR(50) NOT NULL,
+			address TEXT NOT NULL,
+			latitude DOUBLE PRECISION,
+			longitude DOUBLE PRECISION,
+			entrance VARCHAR(20),
+			floor VARCHAR(20),
+			apartment VARCHAR(20),
+			courier_notes TEXT,
+			is_default BOOLEAN DEFAULT false,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_user_addresses_user_id ON user_addresses(user_id)`,
+
+		// Login sessions, one per device; refresh tokens rotate within a session
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id VARCHAR(255) PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			device VARCHAR(100),
+			ip VARCHAR(64),
+			user_agent TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)`,
+		`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS session_id VARCHAR(255)`,
+		// Set when the session was opened with a second factor
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS two_factor_at TIMESTAMP`,
+
+		// Two-factor authentication
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_pending_secret VARCHAR(64)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMP`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT DEFAULT 0`,
+		`ALTER TABLE roles ADD COLUMN IF NOT EXISTS require_2fa BOOLEAN DEFAULT false`,
+
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			id VARCHAR(255) PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash VARCHAR(64) NOT NULL,
+			used_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id)`,
+
+		`CREATE TABLE IF NOT EXISTS two_factor_challenges (
+			id VARCHAR(255) PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			attempts INTEGER DEFAULT 0,
+			expires_at TIMESTAMP NOT NULL,
+			consumed_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// API keys for POS and integrations, only the hash is stored
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id VARCHAR(255) PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			key_prefix VARCHAR(20) NOT NULL,
+			key_hash VARCHAR(64) UNIQUE NOT NULL,
+			permissions JSONB NOT NULL,
+			created_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP,
+			last_used_at TIMESTAMP,
+			last_used_ip VARCHAR(64),
+			revoked_at TIMESTAMP,
+			revoked_by VARCHAR(255)
+		)`,
+
+		// Phone number normalization results, unresolved rows need an admin
+		`CREATE TABLE IF NOT EXISTS phone_reviews (
+			id VARCHAR(255) PRIMARY KEY,
+			user_id VARCHAR(255) NOT NULL,
+			original_number VARCHAR(20) NOT NULL,
+			canonical_number VARCHAR(20),
+			action VARCHAR(30) NOT NULL,
+			merged_into VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			resolved_at TIMESTAMP,
+			resolved_by VARCHAR(255)
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_phone_reviews_open ON phone_reviews(user_id) WHERE resolved_at IS NULL`,
 	}
 
 	for _, query := range queries {
@@ -568,24 +1809,6 @@ func createTables() error {
 
 // ========== UTILITY FUNCTIONS ==========
 
-func getFoodTranslation(key, lang string) string {
-	if lang == "" {
-		lang = "uz"
-	}
-	if translations, exists := FOOD_TRANSLATIONS[lang]; exists {
-		if translation, exists := translations[key]; exists {
-			return translation
-		}
-	}
-	// Default uzbek language
-	if translations, exists := FOOD_TRANSLATIONS["uz"]; exists {
-		if translation, exists := translations[key]; exists {
-			return translation
-		}
-	}
-	return key
-}
-
 func getUserLanguage(headers map[string][]string) string {
 	acceptLang := headers["Accept-Language"]
 	if len(acceptLang) > 0 {
@@ -621,24 +1844,61 @@ func generateOrderID() string {
 	return fmt.Sprintf("%s-%d", today, count)
 }
 
-func hashPassword(password string) string {
+// hashPassword returns a salted bcrypt hash. The "$2a$<cost>$" prefix
+// records the algorithm, so legacy hashes can be told apart on login.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PASSWORD_HASH_COST)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// legacyMD5Hash reproduces the unsalted MD5 hashes stored by older versions
+func legacyMD5Hash(password string) string {
 	hash := md5.Sum([]byte(password))
 	return fmt.Sprintf("%x", hash)
 }
 
-func createToken(user *User) (string, error) {
-	expirationTime := time.Now().Add(ACCESS_TOKEN_EXPIRE_HOURS * time.Hour)
+func isLegacyPasswordHash(hash string) bool {
+	return !strings.HasPrefix(hash, "$2")
+}
+
+// verifyPassword checks a password against a stored hash of any supported
+// algorithm and reports whether the hash should be upgraded.
+func verifyPassword(hash, password string) (ok bool, needsRehash bool) {
+	if isLegacyPasswordHash(hash) {
+		ok = subtle.ConstantTimeCompare([]byte(hash), []byte(legacyMD5Hash(password))) == 1
+		return ok, ok
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, err != nil || cost < PASSWORD_HASH_COST
+}
+
+func createToken(user *User, sessionID string) (string, error) {
+	now := time.Now()
+	expirationTime := now.Add(config.JWT.AccessTTL)
 	claims := &Claims{
-		Number: user.Number,
-		Role:   user.Role,
-		UserID: user.ID,
+		Number:       user.Number,
+		Role:         user.Role,
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
+		SessionID:    sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
+	key, _ := config.jwtKey(config.JWT.ActiveKID)
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(SECRET_KEY))
+	token.Header["kid"] = config.JWT.ActiveKID
+	return token.SignedString(key)
 }
 
 func getTableNameByID(tableID string) string {
@@ -690,7 +1950,7 @@ func uploadFile(c *gin.Context) {
 	}
 	defer file.Close()
 
-	if fileHeader.Size > MAX_FILE_SIZE {
+	if fileHeader.Size > config.Upload.MaxFileSize {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "File too large"})
 		return
 	}
@@ -709,8 +1969,8 @@ func uploadFile(c *gin.Context) {
 		return
 	}
 
-	if _, err := os.Stat(UPLOAD_DIR); os.IsNotExist(err) {
-		os.MkdirAll(UPLOAD_DIR, 0755)
+	if _, err := os.Stat(config.Upload.Dir); os.IsNotExist(err) {
+		os.MkdirAll(config.Upload.Dir, 0755)
 	}
 
 	originalName := strings.TrimSuffix(fileHeader.Filename, filepath.Ext(fileHeader.Filename))
@@ -718,7 +1978,7 @@ func uploadFile(c *gin.Context) {
 	ext := filepath.Ext(fileHeader.Filename)
 
 	fileName := fmt.Sprintf("%s_%d%s", cleanedName, time.Now().Unix(), ext)
-	filePath := filepath.Join(UPLOAD_DIR, fileName)
+	filePath := filepath.Join(config.Upload.Dir, fileName)
 
 	dst, err := os.Create(filePath)
 	if err != nil {
@@ -770,11 +2030,16 @@ func uploadFile(c *gin.Context) {
 
 // ========== TELEGRAM BOT FUNCTIONS ==========
 
+var errTelegramDisabled = errors.New("telegram is not configured")
+
 func sendTelegramMessage(message string) error {
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", TELEGRAM_BOT_TOKEN)
+	if !config.telegramEnabled() {
+		return errTelegramDisabled
+	}
+	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", config.Telegram.BotToken)
 
 	payload := TelegramMessage{
-		ChatID: TELEGRAM_GROUP_ID,
+		ChatID: config.Telegram.GroupID,
 		Text:   message,
 	}
 
@@ -798,7 +2063,10 @@ func sendTelegramMessage(message string) error {
 }
 
 func sendTelegramMessageToUser(userTgID int64, message string) error {
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", TELEGRAM_BOT_TOKEN)
+	if !config.telegramEnabled() {
+		return errTelegramDisabled
+	}
+	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", config.Telegram.BotToken)
 
 	payload := TelegramMessage{
 		ChatID: fmt.Sprintf("%d", userTgID),
@@ -834,6 +2102,23 @@ func formatOrderForTelegram(order *Order) string {
 	message += fmt.Sprintf("🍕 Order Items:\n")
 	for _, food := range order.Foods {
 		message += fmt.Sprintf("• %s x%d = %d UZS\n", food.Name, food.Count, food.TotalPrice)
+		if food.Promotion != nil {
+			if food.FreeCount > 0 {
+				message += fmt.Sprintf("   🏷 %s (%d free)\n", food.Promotion.Name, food.FreeCount)
+			} else {
+				message += fmt.Sprintf("   🏷 %s\n", food.Promotion.Name)
+			}
+		}
+		for _, option := range food.Options {
+			if option.PriceDelta != 0 {
+				message += fmt.Sprintf("   ↳ %s: %s (%+d)\n", option.GroupName, option.Name, option.PriceDelta)
+			} else {
+				message += fmt.Sprintf("   ↳ %s: %s\n", option.GroupName, option.Name)
+			}
+		}
+		for _, component := range food.Components {
+			message += fmt.Sprintf("   ◦ %s x%d\n", component.Name, component.Quantity*food.Count)
+		}
 	}
 
 	message += fmt.Sprintf("\n💰 Total Amount: %d UZS\n", order.TotalPrice)
@@ -844,11 +2129,28 @@ func formatOrderForTelegram(order *Order) string {
 		if address, ok := order.DeliveryInfo["address"].(string); ok {
 			message += fmt.Sprintf("🚚 Delivery Address: %s\n", address)
 		}
+		var details []string
+		for _, field := range []struct{ key, label string }{
+			{"entrance", "Entrance"}, {"floor", "Floor"}, {"apartment", "Apt"},
+		} {
+			if value, ok := order.DeliveryInfo[field.key].(string); ok && value != "" {
+				details = append(details, fmt.Sprintf("%s %s", field.label, value))
+			}
+		}
+		if len(details) > 0 {
+			message += fmt.Sprintf("🏢 %s\n", strings.Join(details, ", "))
+		}
 		if lat, ok := order.DeliveryInfo["latitude"].(float64); ok {
 			if lng, ok := order.DeliveryInfo["longitude"].(float64); ok {
 				message += fmt.Sprintf("📍 Coordinates: %.6f, %.6f\n", lat, lng)
 			}
 		}
+		if phone, ok := order.DeliveryInfo["phone"].(string); ok && phone != "" {
+			message += fmt.Sprintf("📱 Contact Phone: %s\n", phone)
+		}
+		if notes, ok := order.DeliveryInfo["courier_notes"].(string); ok && notes != "" {
+			message += fmt.Sprintf("📝 Courier Notes: %s\n", notes)
+		}
 	case "own_withdrawal":
 		message += fmt.Sprintf("🏪 Pickup\n")
 	case "atTheRestaurant":
@@ -870,1063 +2172,9201 @@ func formatOrderForTelegram(order *Order) string {
 	return message
 }
 
-// ========== WEBSOCKET FUNCTIONS ==========
-
-func handleWebSocket(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
-	}
-	defer conn.Close()
+// ========== PHONE NUMBER FUNCTIONS ==========
 
-	clients[conn] = true
-	log.Printf("WebSocket client connected. Total clients: %d", len(clients))
+const (
+	UZ_COUNTRY_CODE     = "998"
+	UZ_NATIONAL_DIGITS  = 9
+	PhoneReviewNormal   = "normalized"
+	PhoneReviewMerged   = "merged"
+	PhoneReviewInvalid  = "invalid"
+	PhoneReviewConflict = "duplicate"
+)
 
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("WebSocket read error: %v", err)
-			delete(clients, conn)
-			log.Printf("WebSocket client disconnected. Remaining clients: %d", len(clients))
-			break
+var errInvalidPhone = errors.New("invalid phone number")
+
+// normalizePhone turns the forms customers type (770451118, 998770451118,
+// +998 77 045-11-18, 00998...) into E.164: +998770451118
+func normalizePhone(raw string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9':
+			return r
+		case r == ' ' || r == '-' || r == '(' || r == ')' || r == '.' || r == '+':
+			return -1
 		}
+		return 'x'
+	}, strings.TrimSpace(raw))
+	if strings.ContainsRune(digits, 'x') {
+		return "", errInvalidPhone
 	}
-}
 
-func broadcastToClients(message WSMessage) {
-	jsonData, _ := json.Marshal(message)
-	for client := range clients {
-		err := client.WriteJSON(message)
-		if err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			client.Close()
-			delete(clients, client)
-		}
+	digits = strings.TrimPrefix(digits, "00")
+	switch {
+	case len(digits) == UZ_NATIONAL_DIGITS:
+	case len(digits) == len(UZ_COUNTRY_CODE)+UZ_NATIONAL_DIGITS && strings.HasPrefix(digits, UZ_COUNTRY_CODE):
+		digits = digits[len(UZ_COUNTRY_CODE):]
+	default:
+		return "", errInvalidPhone
 	}
-	log.Printf("WebSocket message sent: %s", string(jsonData))
+	if digits[0] == '0' {
+		return "", errInvalidPhone
+	}
+
+	return "+" + UZ_COUNTRY_CODE + digits, nil
 }
 
-func sendOrderUpdate(orderID string, status OrderStatus, message string) {
-	wsMessage := WSMessage{
-		Type:    "order_update",
-		OrderID: orderID,
-		Data: gin.H{
-			"order_id": orderID,
-			"status":   status,
-			"message":  message,
-			"time":     time.Now(),
-		},
+// bindPhone normalizes a phone field of a request in place and answers 400
+// when it isn't a valid Uzbek number
+func bindPhone(c *gin.Context, number *string) bool {
+	normalized, err := normalizePhone(*number)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone number"})
+		return false
 	}
-	broadcastToClients(wsMessage)
+	*number = normalized
+	return true
 }
 
-func sendNewOrderNotification(order *Order) {
-	wsMessage := WSMessage{
-		Type:    "new_order",
-		OrderID: order.OrderID,
-		Data:    order,
+type phoneAccount struct {
+	ID        string
+	Number    string
+	Role      string
+	CreatedAt time.Time
+}
+
+// migratePhoneNumbers rewrites stored numbers to E.164. Accounts that
+// collapse onto the same number are merged into the oldest one when the
+// duplicate is a plain customer account, anything else is recorded in
+// phone_reviews for an administrator.
+func migratePhoneNumbers(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, number, role, created_at FROM users
+						   WHERE number NOT LIKE 'deleted\_%' AND number NOT LIKE 'merged\_%'
+						   ORDER BY created_at, id`)
+	if err != nil {
+		return err
 	}
-	broadcastToClients(wsMessage)
 
-	// Send Telegram message to admin group
-	go func() {
-		telegramMessage := formatOrderForTelegram(order)
-		if err := sendTelegramMessage(telegramMessage); err != nil {
-			log.Printf("Telegram message error: %v", err)
-		} else {
-			log.Printf("Telegram message sent: %s", order.OrderID)
+	groups := make(map[string][]phoneAccount)
+	var order []string
+	var invalid []phoneAccount
+	for rows.Next() {
+		var account phoneAccount
+		if err := rows.Scan(&account.ID, &account.Number, &account.Role, &account.CreatedAt); err != nil {
+			rows.Close()
+			return err
 		}
-	}()
-}
+		canonical, err := normalizePhone(account.Number)
+		if err != nil {
+			invalid = append(invalid, account)
+			continue
+		}
+		if _, exists := groups[canonical]; !exists {
+			order = append(order, canonical)
+		}
+		groups[canonical] = append(groups[canonical], account)
+	}
+	rows.Close()
 
-// ========== MIDDLEWARE ==========
+	for _, account := range invalid {
+		if err := flagPhoneReview(tx, account, "", PhoneReviewInvalid); err != nil {
+			return err
+		}
+	}
 
-func corsMiddleware() gin.HandlerFunc {
-	return gin.HandlerFunc(func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Credentials", "true")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+	changed := 0
+	for _, canonical := range order {
+		accounts := groups[canonical]
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
+		// The account already holding the canonical number wins, otherwise the oldest
+		primary := accounts[0]
+		for _, account := range accounts {
+			if account.Number == canonical {
+				primary = account
+				break
+			}
 		}
 
-		c.Next()
-	})
-}
+		if primary.Number != canonical {
+			if err := renumberAccount(tx, primary, canonical); err != nil {
+				return err
+			}
+			changed++
+		}
 
-func optionalAuthMiddleware() gin.HandlerFunc {
-	return gin.HandlerFunc(func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader != "" {
-			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-			if tokenString != authHeader {
-				claims := &Claims{}
-				token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-					return []byte(SECRET_KEY), nil
-				})
-
-				if err == nil && token.Valid {
-					c.Set("user", claims)
+		for _, account := range accounts {
+			if account.ID == primary.ID {
+				continue
+			}
+			merged, err := mergeAccount(tx, account, primary.ID, canonical)
+			if err != nil {
+				return err
+			}
+			if !merged {
+				if err := flagPhoneReview(tx, account, canonical, PhoneReviewConflict); err != nil {
+					return err
 				}
 			}
+			changed++
 		}
-		c.Next()
-	})
-}
+	}
 
-func authMiddleware() gin.HandlerFunc {
-	return gin.HandlerFunc(func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
-			return
-		}
+	if changed > 0 || len(invalid) > 0 {
+		log.Printf("✅ Phone numbers normalized: %d changed, %d invalid", changed, len(invalid))
+	}
+	return nil
+}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		if tokenString == authHeader {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Bearer token required"})
-			c.Abort()
-			return
-		}
+func renumberAccount(tx *sql.Tx, account phoneAccount, canonical string) error {
+	if _, err := tx.Exec(`UPDATE users SET number = $2 WHERE id = $1`, account.ID, canonical); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE orders SET user_number = $2 WHERE user_number = $1`, account.Number, canonical); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO phone_reviews (id, user_id, original_number, canonical_number, action, resolved_at)
+					   VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)`,
+		generateID("phone"), account.ID, account.Number, canonical, PhoneReviewNormal)
+	return err
+}
 
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(SECRET_KEY), nil
-		})
+// mergeAccount moves the orders and reviews of a duplicate customer account
+// to the primary account and deactivates it. Staff accounts and reviews of
+// the same food on both accounts are left for manual review.
+func mergeAccount(tx *sql.Tx, account phoneAccount, primaryID, canonical string) (bool, error) {
+	if isStaffRole(account.Role) {
+		return false, nil
+	}
 
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
-			return
+	var conflicts int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM reviews r JOIN reviews p ON p.food_id = r.food_id AND p.user_id = $2
+						WHERE r.user_id = $1`, account.ID, primaryID).Scan(&conflicts)
+	if err != nil {
+		return false, err
+	}
+	if conflicts > 0 {
+		return false, nil
+	}
+
+	queries := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`UPDATE orders SET user_number = $2 WHERE user_number = $1`, []interface{}{account.Number, canonical}},
+		{`UPDATE reviews SET user_id = $2 WHERE user_id = $1`, []interface{}{account.ID, primaryID}},
+		{`UPDATE users SET number = $2, is_active = false, token_version = COALESCE(token_version, 0) + 1 WHERE id = $1`,
+			[]interface{}{account.ID, "merged_" + uuid.New().String()[:8]}},
+		{`UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL`,
+			[]interface{}{account.ID}},
+		{`UPDATE phone_reviews SET resolved_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND resolved_at IS NULL`,
+			[]interface{}{account.ID}},
+		{`INSERT INTO phone_reviews (id, user_id, original_number, canonical_number, action, merged_into, resolved_at)
+		  VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP)`,
+			[]interface{}{generateID("phone"), account.ID, account.Number, canonical, PhoneReviewMerged, primaryID}},
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(q.query, q.args...); err != nil {
+			return false, err
 		}
+	}
+	log.Printf("✅ Account %s (%s) merged into %s", account.ID, account.Number, primaryID)
+	return true, nil
+}
 
-		c.Set("user", claims)
-		c.Next()
-	})
+func flagPhoneReview(tx *sql.Tx, account phoneAccount, canonical, action string) error {
+	var canonicalNumber interface{}
+	if canonical != "" {
+		canonicalNumber = canonical
+	}
+	_, err := tx.Exec(`INSERT INTO phone_reviews (id, user_id, original_number, canonical_number, action)
+					   VALUES ($1, $2, $3, $4, $5)
+					   ON CONFLICT (user_id) WHERE resolved_at IS NULL DO NOTHING`,
+		generateID("phone"), account.ID, account.Number, canonicalNumber, action)
+	return err
 }
 
-func adminMiddleware() gin.HandlerFunc {
-	return gin.HandlerFunc(func(c *gin.Context) {
-		user, exists := c.Get("user")
-		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
-			c.Abort()
-			return
-		}
+// ========== SMS / OTP FUNCTIONS ==========
 
-		claims := user.(*Claims)
-		if claims.Role != "admin" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
-			c.Abort()
-			return
-		}
+// OTP purposes
+const (
+	OTPPurposeRegister      = "register"
+	OTPPurposeLogin         = "login"
+	OTPPurposeResetPassword = "reset_password"
+	OTPPurposeChangePhone   = "change_phone"
+)
 
-		c.Next()
-	})
+var otpPurposes = map[string]bool{
+	OTPPurposeRegister: true,
+	OTPPurposeLogin:    true,
 }
 
-// ========== DATABASE HELPER FUNCTIONS ==========
+// SMSProvider sends text messages to a phone number in 998XXXXXXXXX form
+type SMSProvider interface {
+	Name() string
+	SendSMS(phone, message string) error
+}
 
-func getUserByNumber(number string) (*User, error) {
-	query := `SELECT id, number, password, role, full_name, email, created_at, is_active, tg_id, language 
-			  FROM users WHERE number = $1`
+var smsProvider SMSProvider
 
-	var user User
-	err := db.QueryRow(query, number).Scan(
-		&user.ID, &user.Number, &user.Password, &user.Role,
-		&user.FullName, &user.Email, &user.CreatedAt,
-		&user.IsActive, &user.TgID, &user.Language,
-	)
+// FakeSMSProvider logs messages instead of sending them. Used for local
+// development and tests; the last message per phone can be read back.
+type FakeSMSProvider struct {
+	mu       sync.Mutex
+	Messages map[string]string
+}
 
-	if err != nil {
-		return nil, err
-	}
+func (p *FakeSMSProvider) Name() string { return "fake" }
 
-	return &user, nil
+func (p *FakeSMSProvider) SendSMS(phone, message string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Messages == nil {
+		p.Messages = make(map[string]string)
+	}
+	p.Messages[phone] = message
+	log.Printf("📨 [fake sms] %s: %s", phone, message)
+	return nil
 }
 
-func createUser(user *User) error {
-	query := `INSERT INTO users (id, number, password, role, full_name, email, created_at, is_active, tg_id, language) 
-			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
-
-	_, err := db.Exec(query, user.ID, user.Number, user.Password, user.Role,
-		user.FullName, user.Email, user.CreatedAt, user.IsActive, user.TgID, user.Language)
+// EskizProvider sends messages through notify.eskiz.uz
+type EskizProvider struct {
+	Email    string
+	Password string
+	From     string
 
-	return err
+	mu    sync.Mutex
+	token string
 }
 
-func getFoodByID(foodID int64) (*Food, error) {
-	query := `SELECT id, names, name, descriptions, description, category, price, is_there, 
-			  image_url, ingredients, allergens, rating, review_count, preparation_time, 
-			  stock, is_popular, discount, comment, created_at, updated_at
-			  FROM foods WHERE id = $1`
+func (p *EskizProvider) Name() string { return "eskiz" }
 
-	var food Food
-	var namesJSON, descriptionsJSON, ingredientsJSON, allergensJSON []byte
+func (p *EskizProvider) authenticate() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" {
+		return p.token, nil
+	}
 
-	err := db.QueryRow(query, foodID).Scan(
-		&food.ID, &namesJSON, &food.Name, &descriptionsJSON, &food.Description,
-		&food.Category, &food.Price, &food.IsThere, &food.ImageURL,
-		&ingredientsJSON, &allergensJSON, &food.Rating, &food.ReviewCount,
-		&food.PreparationTime, &food.Stock, &food.IsPopular, &food.Discount,
-		&food.Comment, &food.CreatedAt, &food.UpdatedAt,
-	)
+	resp, err := http.PostForm("https://notify.eskiz.uz/api/auth/login", url.Values{
+		"email":    {p.Email},
+		"password": {p.Password},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.Data.Token == "" {
+		return "", fmt.Errorf("eskiz auth error: status %d", resp.StatusCode)
+	}
+	p.token = result.Data.Token
+	return p.token, nil
+}
 
+func (p *EskizProvider) SendSMS(phone, message string) error {
+	token, err := p.authenticate()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// JSON unmarshal
-	if namesJSON != nil {
-		json.Unmarshal(namesJSON, &food.Names)
+	form := url.Values{
+		"mobile_phone": {phone},
+		"message":      {message},
+		"from":         {p.From},
 	}
-	if descriptionsJSON != nil {
-		json.Unmarshal(descriptionsJSON, &food.Descriptions)
+	req, err := http.NewRequest(http.MethodPost, "https://notify.eskiz.uz/api/message/sms/send",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
 	}
-	if ingredientsJSON != nil {
-		json.Unmarshal(ingredientsJSON, &food.Ingredients)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
 	}
-	if allergensJSON != nil {
-		json.Unmarshal(allergensJSON, &food.Allergens)
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Token expired, authenticate again on the next message
+		p.mu.Lock()
+		p.token = ""
+		p.mu.Unlock()
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("eskiz API error: %s", string(body))
 	}
+	return nil
+}
 
-	return &food, nil
+// PlayMobileProvider sends messages through the Play Mobile broker API
+type PlayMobileProvider struct {
+	Login      string
+	Password   string
+	Originator string
 }
 
-func getAllFoods() ([]*Food, error) {
-	// Only available foods (isThere = true and stock > 0) ordered by ID
-	query := `SELECT id, names, name, descriptions, description, category, price, is_there, 
-			  image_url, ingredients, allergens, rating, review_count, preparation_time, 
-			  stock, is_popular, discount, comment, created_at, updated_at
-			  FROM foods WHERE is_there = true AND stock > 0 ORDER BY id ASC`
+func (p *PlayMobileProvider) Name() string { return "playmobile" }
 
-	rows, err := db.Query(query)
+func (p *PlayMobileProvider) SendSMS(phone, message string) error {
+	payload := gin.H{
+		"messages": []gin.H{{
+			"recipient":  phone,
+			"message-id": generateID("sms"),
+			"sms": gin.H{
+				"originator": p.Originator,
+				"content":    gin.H{"text": message},
+			},
+		}},
+	}
+	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
 
-	var foods []*Food
-	for rows.Next() {
-		var food Food
-		var namesJSON, descriptionsJSON, ingredientsJSON, allergensJSON []byte
+	req, err := http.NewRequest(http.MethodPost, "https://send.smsxabar.uz/broker-api/send", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(p.Login, p.Password)
 
-		err := rows.Scan(
-			&food.ID, &namesJSON, &food.Name, &descriptionsJSON, &food.Description,
-			&food.Category, &food.Price, &food.IsThere, &food.ImageURL,
-			&ingredientsJSON, &allergensJSON, &food.Rating, &food.ReviewCount,
-			&food.PreparationTime, &food.Stock, &food.IsPopular, &food.Discount,
-			&food.Comment, &food.CreatedAt, &food.UpdatedAt,
-		)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-		if err != nil {
-			continue
-		}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("play mobile API error: %s", string(body))
+	}
+	return nil
+}
 
-		// JSON unmarshal
-		if namesJSON != nil {
-			json.Unmarshal(namesJSON, &food.Names)
-		}
-		if descriptionsJSON != nil {
-			json.Unmarshal(descriptionsJSON, &food.Descriptions)
-		}
-		if ingredientsJSON != nil {
-			json.Unmarshal(ingredientsJSON, &food.Ingredients)
+func initSMSProvider() {
+	switch config.SMS.Provider {
+	case "eskiz":
+		smsProvider = &EskizProvider{
+			Email:    config.SMS.EskizEmail,
+			Password: config.SMS.EskizPassword,
+			From:     config.SMS.EskizFrom,
 		}
-		if allergensJSON != nil {
-			json.Unmarshal(allergensJSON, &food.Allergens)
+	case "playmobile":
+		smsProvider = &PlayMobileProvider{
+			Login:      config.SMS.PlayMobileLogin,
+			Password:   config.SMS.PlayMobilePassword,
+			Originator: config.SMS.PlayMobileOriginator,
 		}
-
-		foods = append(foods, &food)
+	case "fake":
+		smsProvider = &FakeSMSProvider{}
+		log.Printf("⚠️ SMS provider is fake: one-time codes are logged, not sent")
+		return
 	}
-
-	return foods, nil
+	log.Printf("✅ SMS provider: %s", smsProvider.Name())
 }
 
-func getAllFoodsForAdmin() ([]*Food, error) {
-	// All foods for admin ordered by ID
-	query := `SELECT id, names, name, descriptions, description, category, price, is_there, 
-			  image_url, ingredients, allergens, rating, review_count, preparation_time, 
-			  stock, is_popular, discount, comment, created_at, updated_at
-			  FROM foods ORDER BY id ASC`
+// smsPhone converts a stored E.164 number into the digits-only form SMS gateways expect
+func smsPhone(number string) string {
+	return strings.TrimPrefix(number, "+")
+}
 
-	rows, err := db.Query(query)
+func generateOTPCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < OTP_LENGTH; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	defer rows.Close()
+	return fmt.Sprintf("%0*d", OTP_LENGTH, n), nil
+}
 
-	var foods []*Food
-	for rows.Next() {
-		var food Food
-		var namesJSON, descriptionsJSON, ingredientsJSON, allergensJSON []byte
+func hashOTPCode(verificationID, code string) string {
+	return hashToken(verificationID + ":" + code)
+}
 
-		err := rows.Scan(
-			&food.ID, &namesJSON, &food.Name, &descriptionsJSON, &food.Description,
-			&food.Category, &food.Price, &food.IsThere, &food.ImageURL,
-			&ingredientsJSON, &allergensJSON, &food.Rating, &food.ReviewCount,
-			&food.PreparationTime, &food.Stock, &food.IsPopular, &food.Discount,
-			&food.Comment, &food.CreatedAt, &food.UpdatedAt,
-		)
+// checkOTPRateLimit returns how long the caller must wait before another
+// code can be sent, or zero if sending is allowed.
+func checkOTPRateLimit(phone, ip string) (time.Duration, error) {
+	var lastSent sql.NullTime
+	var phoneCount, ipCount int
 
-		if err != nil {
-			continue
-		}
+	err := db.QueryRow(`SELECT MAX(created_at), COUNT(*) FROM phone_verifications 
+						WHERE phone = $1 AND created_at > $2`,
+		phone, time.Now().Add(-time.Hour)).Scan(&lastSent, &phoneCount)
+	if err != nil {
+		return 0, err
+	}
+	err = db.QueryRow(`SELECT COUNT(*) FROM phone_verifications WHERE ip = $1 AND created_at > $2`,
+		ip, time.Now().Add(-time.Hour)).Scan(&ipCount)
+	if err != nil {
+		return 0, err
+	}
 
-		// JSON unmarshal
-		if namesJSON != nil {
-			json.Unmarshal(namesJSON, &food.Names)
-		}
-		if descriptionsJSON != nil {
-			json.Unmarshal(descriptionsJSON, &food.Descriptions)
-		}
-		if ingredientsJSON != nil {
-			json.Unmarshal(ingredientsJSON, &food.Ingredients)
-		}
-		if allergensJSON != nil {
-			json.Unmarshal(allergensJSON, &food.Allergens)
+	if lastSent.Valid {
+		if wait := time.Until(lastSent.Time.Add(OTP_RESEND_SECONDS * time.Second)); wait > 0 {
+			return wait, nil
 		}
-
-		foods = append(foods, &food)
 	}
-
-	return foods, nil
+	if phoneCount >= OTP_MAX_PER_PHONE_HOUR || ipCount >= OTP_MAX_PER_IP_HOUR {
+		return time.Hour, nil
+	}
+	return 0, nil
 }
 
-func createFoodWithCustomID(food *Food, customID *int64) error {
-	var query string
-	var err error
+// createOTP stores a new code for the phone and returns it for delivery
+func createOTP(phone, purpose, ip string) (string, error) {
+	code, err := generateOTPCode()
+	if err != nil {
+		return "", err
+	}
 
-	namesJSON, err := json.Marshal(food.Names)
+	id := generateID("otp")
+	query := `INSERT INTO phone_verifications (id, phone, purpose, code_hash, ip, expires_at, created_at) 
+			  VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = db.Exec(query, id, phone, purpose, hashOTPCode(id, code), ip,
+		time.Now().Add(OTP_TTL_MINUTES*time.Minute), time.Now())
 	if err != nil {
-		return fmt.Errorf("names JSON marshal error: %w", err)
+		return "", err
 	}
+	return code, nil
+}
 
-	descriptionsJSON, err := json.Marshal(food.Descriptions)
+func sendOTP(phone, purpose, ip string) error {
+	code, err := createOTP(phone, purpose, ip)
 	if err != nil {
-		return fmt.Errorf("descriptions JSON marshal error: %w", err)
+		return err
 	}
 
-	ingredientsJSON, err := json.Marshal(food.Ingredients)
+	message := fmt.Sprintf("Tasdiqlash kodi: %s. Kod %d daqiqa amal qiladi.", code, OTP_TTL_MINUTES)
+	return smsProvider.SendSMS(smsPhone(phone), message)
+}
+
+var errOTPInvalid = errors.New("invalid or expired code")
+var errOTPTooManyAttempts = errors.New("too many attempts")
+
+// verifyOTP checks a code against the latest pending verification for the
+// phone and marks it verified. Every guess uses up an attempt before the
+// code is compared, so parallel guesses can't get past the limit.
+func verifyOTP(phone, purpose, code string) (string, error) {
+	var id, codeHash string
+	query := `UPDATE phone_verifications SET attempts = attempts + 1
+			  WHERE id = (SELECT id FROM phone_verifications
+						  WHERE phone = $1 AND purpose = $2 AND verified_at IS NULL AND expires_at > $3
+						  ORDER BY created_at DESC LIMIT 1)
+			  AND attempts < $4 RETURNING id, code_hash`
+	err := db.QueryRow(query, phone, purpose, time.Now(), OTP_MAX_ATTEMPTS).Scan(&id, &codeHash)
+	if err == sql.ErrNoRows {
+		// Either nothing is pending or the pending code is used up
+		var pending bool
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM phone_verifications
+							   WHERE phone = $1 AND purpose = $2 AND verified_at IS NULL AND expires_at > $3)`,
+			phone, purpose, time.Now()).Scan(&pending); err != nil {
+			return "", err
+		}
+		if pending {
+			return "", errOTPTooManyAttempts
+		}
+		return "", errOTPInvalid
+	}
 	if err != nil {
-		return fmt.Errorf("ingredients JSON marshal error: %w", err)
+		return "", err
 	}
 
-	allergensJSON, err := json.Marshal(food.Allergens)
+	if subtle.ConstantTimeCompare([]byte(codeHash), []byte(hashOTPCode(id, code))) != 1 {
+		return "", errOTPInvalid
+	}
+
+	result, err := db.Exec(`UPDATE phone_verifications SET verified_at = CURRENT_TIMESTAMP 
+							WHERE id = $1 AND verified_at IS NULL`, id)
 	if err != nil {
-		return fmt.Errorf("allergens JSON marshal error: %w", err)
+		return "", err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return "", errOTPInvalid
 	}
+	return id, nil
+}
 
-	if customID != nil {
-		// Manual ID insertion
-		query = `INSERT INTO foods (id, names, name, descriptions, description, category, price, 
-				 is_there, image_url, ingredients, allergens, rating, review_count, 
-				 preparation_time, stock, is_popular, discount, comment, created_at, updated_at) 
-				 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)`
-
-		_, err = db.Exec(query, *customID, namesJSON, food.Name, descriptionsJSON, food.Description,
-			food.Category, food.Price, food.IsThere, food.ImageURL, ingredientsJSON,
-			allergensJSON, food.Rating, food.ReviewCount, food.PreparationTime,
-			food.Stock, food.IsPopular, food.Discount, food.Comment,
-			food.CreatedAt, food.UpdatedAt)
-
-		if err != nil {
-			return fmt.Errorf("manual ID insertion error: %w", err)
-		}
-
-		food.ID = *customID
-	} else {
-		// Automatic ID (BIGSERIAL)
-		query = `INSERT INTO foods (names, name, descriptions, description, category, price, 
-				 is_there, image_url, ingredients, allergens, rating, review_count, 
-				 preparation_time, stock, is_popular, discount, comment, created_at, updated_at) 
-				 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
-				 RETURNING id`
-
-		err = db.QueryRow(query, namesJSON, food.Name, descriptionsJSON, food.Description,
-			food.Category, food.Price, food.IsThere, food.ImageURL, ingredientsJSON,
-			allergensJSON, food.Rating, food.ReviewCount, food.PreparationTime,
-			food.Stock, food.IsPopular, food.Discount, food.Comment,
-			food.CreatedAt, food.UpdatedAt).Scan(&food.ID)
-
-		if err != nil {
-			return fmt.Errorf("automatic ID insertion error: %w", err)
-		}
+// consumeVerificationToken redeems the token returned by /api/otp/verify.
+// Tokens are single-use and bound to a phone and purpose. Run it in the
+// transaction that uses the proof, so a failure leaves the token unspent.
+func consumeVerificationToken(execer sqlExecer, token, phone, purpose string) error {
+	// verified_at is set by the database clock, so the age is measured by it too
+	result, err := execer.Exec(`UPDATE phone_verifications SET consumed_at = CURRENT_TIMESTAMP 
+							WHERE verification_token_hash = $1 AND phone = $2 AND purpose = $3 
+							AND consumed_at IS NULL AND verified_at > CURRENT_TIMESTAMP - make_interval(mins => $4)`,
+		hashToken(token), phone, purpose, VERIFICATION_TTL_MINUTES)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errOTPInvalid
 	}
-
-	log.Printf("✅ Food created successfully with ID: %d", food.ID)
 	return nil
 }
 
-func updateFood(food *Food) error {
-	namesJSON, _ := json.Marshal(food.Names)
-	descriptionsJSON, _ := json.Marshal(food.Descriptions)
-	ingredientsJSON, _ := json.Marshal(food.Ingredients)
-	allergensJSON, _ := json.Marshal(food.Allergens)
-
-	query := `UPDATE foods SET names = $2, name = $3, descriptions = $4, description = $5, 
-			  category = $6, price = $7, is_there = $8, image_url = $9, ingredients = $10, 
-			  allergens = $11, rating = $12, review_count = $13, preparation_time = $14, 
-			  stock = $15, is_popular = $16, discount = $17, comment = $18, updated_at = CURRENT_TIMESTAMP
-			  WHERE id = $1`
-
-	_, err := db.Exec(query, food.ID, namesJSON, food.Name, descriptionsJSON, food.Description,
-		food.Category, food.Price, food.IsThere, food.ImageURL, ingredientsJSON,
-		allergensJSON, food.Rating, food.ReviewCount, food.PreparationTime,
-		food.Stock, food.IsPopular, food.Discount, food.Comment)
-
-	return err
+func respondOTPError(c *gin.Context, err error) {
+	switch err {
+	case errOTPInvalid:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired code"})
+	case errOTPTooManyAttempts:
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, request a new code"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Verification error"})
+	}
 }
 
-func createOrder(order *Order) error {
-	foodsJSON, _ := json.Marshal(order.Foods)
-	deliveryInfoJSON, _ := json.Marshal(order.DeliveryInfo)
-	paymentInfoJSON, _ := json.Marshal(order.PaymentInfo)
-	statusHistoryJSON, _ := json.Marshal(order.StatusHistory)
-
-	query := `INSERT INTO orders (order_id, user_number, user_name, foods, total_price, 
-			  order_time, delivery_type, delivery_info, status, payment_info, 
-			  special_instructions, estimated_time, delivered_at, status_history, 
-			  created_at, updated_at) 
-			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`
+func requestOTPHandler(c *gin.Context) {
+	var req OTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !otpPurposes[req.Purpose] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid purpose"})
+		return
+	}
+	if !bindPhone(c, &req.Number) {
+		return
+	}
 
-	_, err := db.Exec(query, order.OrderID, order.UserNumber, order.UserName, foodsJSON,
-		order.TotalPrice, order.OrderTime, order.DeliveryType, deliveryInfoJSON,
-		order.Status, paymentInfoJSON, order.SpecialInstructions, order.EstimatedTime,
-		order.DeliveredAt, statusHistoryJSON, order.CreatedAt, order.UpdatedAt)
+	_, err := getUserByNumber(req.Number)
+	userExists := err == nil
+	if req.Purpose == OTPPurposeRegister && userExists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Phone number already registered"})
+		return
+	}
 
-	return err
-}
+	wait, err := checkOTPRateLimit(req.Number, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Verification error"})
+		return
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many code requests, try again later"})
+		return
+	}
 
-func getOrderByID(orderID string) (*Order, error) {
-	query := `SELECT order_id, user_number, user_name, foods, total_price, order_time, 
-			  delivery_type, delivery_info, status, payment_info, special_instructions, 
-			  estimated_time, delivered_at, status_history, created_at, updated_at
-			  FROM orders WHERE order_id = $1`
+	// Don't reveal whether a login number exists: unknown numbers get a code
+	// nobody receives, so the resend limit applies to them the same way
+	if req.Purpose == OTPPurposeLogin && !userExists {
+		if _, err := createOTP(req.Number, req.Purpose, c.ClientIP()); err != nil {
+			log.Printf("OTP creation error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "SMS send error"})
+			return
+		}
+	} else if err := sendOTP(req.Number, req.Purpose, c.ClientIP()); err != nil {
+		log.Printf("OTP send error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "SMS send error"})
+		return
+	}
 
-	var order Order
-	var foodsJSON, deliveryInfoJSON, paymentInfoJSON, statusHistoryJSON []byte
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Verification code sent",
+		"expires_in": OTP_TTL_MINUTES * 60,
+		"resend_in":  OTP_RESEND_SECONDS,
+	})
+}
 
-	err := db.QueryRow(query, orderID).Scan(
-		&order.OrderID, &order.UserNumber, &order.UserName, &foodsJSON,
-		&order.TotalPrice, &order.OrderTime, &order.DeliveryType, &deliveryInfoJSON,
-		&order.Status, &paymentInfoJSON, &order.SpecialInstructions,
-		&order.EstimatedTime, &order.DeliveredAt, &statusHistoryJSON,
-		&order.CreatedAt, &order.UpdatedAt,
-	)
+func verifyOTPHandler(c *gin.Context) {
+	var req OTPVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !otpPurposes[req.Purpose] || req.Purpose == OTPPurposeLogin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid purpose"})
+		return
+	}
+	if !bindPhone(c, &req.Number) {
+		return
+	}
 
+	id, err := verifyOTP(req.Number, req.Purpose, req.Code)
 	if err != nil {
-		return nil, err
+		respondOTPError(c, err)
+		return
 	}
 
-	// JSON unmarshal
-	json.Unmarshal(foodsJSON, &order.Foods)
-	json.Unmarshal(deliveryInfoJSON, &order.DeliveryInfo)
-	json.Unmarshal(paymentInfoJSON, &order.PaymentInfo)
-	json.Unmarshal(statusHistoryJSON, &order.StatusHistory)
+	token, err := generateSecureToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Verification error"})
+		return
+	}
+	if _, err := db.Exec(`UPDATE phone_verifications SET verification_token_hash = $2 WHERE id = $1`,
+		id, hashToken(token)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Verification error"})
+		return
+	}
 
-	return &order, nil
+	c.JSON(http.StatusOK, gin.H{
+		"message":            "Phone number verified",
+		"verification_token": token,
+		"expires_in":         VERIFICATION_TTL_MINUTES * 60,
+	})
 }
 
-func updateOrder(order *Order) error {
-	foodsJSON, _ := json.Marshal(order.Foods)
-	deliveryInfoJSON, _ := json.Marshal(order.DeliveryInfo)
-	paymentInfoJSON, _ := json.Marshal(order.PaymentInfo)
-	statusHistoryJSON, _ := json.Marshal(order.StatusHistory)
-
-	query := `UPDATE orders SET user_number = $2, user_name = $3, foods = $4, total_price = $5, 
-			  order_time = $6, delivery_type = $7, delivery_info = $8, status = $9, 
-			  payment_info = $10, special_instructions = $11, estimated_time = $12, 
-			  delivered_at = $13, status_history = $14, updated_at = CURRENT_TIMESTAMP
-			  WHERE order_id = $1`
-
-	_, err := db.Exec(query, order.OrderID, order.UserNumber, order.UserName, foodsJSON,
-		order.TotalPrice, order.OrderTime, order.DeliveryType, deliveryInfoJSON,
-		order.Status, paymentInfoJSON, order.SpecialInstructions, order.EstimatedTime,
-		order.DeliveredAt, statusHistoryJSON)
+// loginWithOTP lets customers sign in with an SMS code instead of a password
+func loginWithOTP(c *gin.Context) {
+	var req OTPLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !bindPhone(c, &req.Number) {
+		return
+	}
 
-	return err
-}
+	if _, err := verifyOTP(req.Number, OTPPurposeLogin, req.Code); err != nil {
+		respondOTPError(c, err)
+		return
+	}
 
-func updateSequenceAfterManualInsert() error {
-	query := `SELECT setval('foods_id_seq', (SELECT MAX(id) FROM foods))`
-	_, err := db.Exec(query)
-	if err != nil {
-		return fmt.Errorf("sequence update error: %w", err)
+	user, err := getUserByNumber(req.Number)
+	if err != nil || !user.IsActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
 	}
-	log.Println("✅ Sequence updated")
-	return nil
-}
 
-// Helper functions
-func stringPtr(s string) *string {
-	return &s
-}
+	db.Exec(`UPDATE users SET phone_verified_at = COALESCE(phone_verified_at, CURRENT_TIMESTAMP) WHERE id = $1`, user.ID)
 
-func int64Ptr(i int64) *int64 {
-	return &i
+	completeLogin(c, user)
 }
 
-func getLocalizedFood(food *Food, lang string) *Food {
-	localizedFood := *food
+// ========== EMAIL FUNCTIONS ==========
 
-	// Get multilingual name
-	if food.Names != nil {
-		if name, exists := food.Names[lang]; exists {
-			localizedFood.Name = name
-		} else if name, exists := food.Names["uz"]; exists {
-			localizedFood.Name = name
-		}
-	}
+func emailConfigured() bool {
+	return config.SMTP.Host != ""
+}
 
-	// Get multilingual description
-	if food.Descriptions != nil {
-		if desc, exists := food.Descriptions[lang]; exists {
-			localizedFood.Description = desc
-		} else if desc, exists := food.Descriptions["uz"]; exists {
-			localizedFood.Description = desc
-		}
+func sendEmail(to, subject, body string) error {
+	if !emailConfigured() {
+		return errors.New("SMTP is not configured")
 	}
 
-	// Translate category name
-	categoryKey := strings.ToLower(strings.ReplaceAll(food.Category, " ", "_"))
-	localizedFood.CategoryName = getFoodTranslation(categoryKey, lang)
-
-	// Calculate discount
-	if food.Discount > 0 {
-		localizedFood.OriginalPrice = food.Price
-		localizedFood.Price = food.Price - (food.Price * food.Discount / 100)
+	smtpConfig := config.SMTP
+	from := smtpConfig.From
+	if from == "" {
+		from = smtpConfig.User
 	}
 
-	return &localizedFood
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		from, to, subject, body)
+	auth := smtp.PlainAuth("", smtpConfig.User, smtpConfig.Password, smtpConfig.Host)
+	return smtp.SendMail(smtpConfig.Host+":"+smtpConfig.Port, auth, from, []string{to}, []byte(message))
 }
 
-func getAllLocalizedFoods(lang string, isAdmin bool) ([]*Food, error) {
-	var foods []*Food
-	var err error
+// ========== PASSWORD RESET HANDLERS ==========
 
-	if isAdmin {
-		foods, err = getAllFoodsForAdmin()
-	} else {
-		foods, err = getAllFoods()
-	}
+// Password reset delivery channels
+const (
+	ResetChannelTelegram = "telegram"
+	ResetChannelSMS      = "sms"
+	ResetChannelEmail    = "email"
+)
 
-	if err != nil {
-		return nil, err
-	}
+func deliverResetCode(user *User, channel, code string) error {
+	message := fmt.Sprintf("Parolni tiklash kodi: %s. Kod %d daqiqa amal qiladi. Agar siz so'ramagan bo'lsangiz, bu xabarni e'tiborsiz qoldiring.",
+		code, OTP_TTL_MINUTES)
 
-	var localizedFoods []*Food
-	for _, food := range foods {
-		localizedFood := getLocalizedFood(food, lang)
-		localizedFoods = append(localizedFoods, localizedFood)
+	switch channel {
+	case ResetChannelTelegram:
+		if user.TgID == nil {
+			return errors.New("no telegram chat linked")
+		}
+		return sendTelegramMessageToUser(*user.TgID, message)
+	case ResetChannelEmail:
+		if user.Email == nil || *user.Email == "" {
+			return errors.New("no email on file")
+		}
+		return sendEmail(*user.Email, "Password reset", message)
+	default:
+		return smsProvider.SendSMS(smsPhone(user.Number), message)
 	}
-
-	return localizedFoods, nil
 }
 
-// ========== AUTHENTICATION HANDLERS ==========
-
-func register(c *gin.Context) {
-	var req RegisterRequest
+// forgotPasswordHandler always answers the same way so it can't be used
+// to probe which numbers are registered.
+func forgotPasswordHandler(c *gin.Context) {
+	var req ForgotPasswordRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	lang := req.Language
-	if lang == "" {
-		lang = "uz"
+	switch req.Channel {
+	case "", ResetChannelTelegram, ResetChannelSMS, ResetChannelEmail:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel"})
+		return
+	}
+	if !bindPhone(c, &req.Number) {
+		return
 	}
 
-	// Check if user exists
-	_, err := getUserByNumber(req.Number)
-	if err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Phone number already registered"})
+	wait, err := checkOTPRateLimit(req.Number, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password reset error"})
+		return
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many reset requests, try again later"})
 		return
 	}
 
-	user := &User{
-		ID:        generateID("user"),
-		Number:    req.Number,
-		Password:  hashPassword(req.Password),
-		Role:      "user",
-		FullName:  req.FullName,
-		Email:     req.Email,
-		CreatedAt: time.Now(),
-		IsActive:  true,
-		TgID:      req.TgID,
-		Language:  lang,
+	response := gin.H{
+		"message":    "If the account exists, a reset code has been sent",
+		"expires_in": OTP_TTL_MINUTES * 60,
 	}
 
-	if err := createUser(user); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "User creation error"})
+	// A code is stored for every number, delivered only to real accounts, so
+	// the resend limit above treats unknown numbers exactly like known ones
+	code, err := createOTP(req.Number, OTPPurposeResetPassword, c.ClientIP())
+	if err != nil {
+		log.Printf("Reset code creation error: %v", err)
+		c.JSON(http.StatusOK, response)
 		return
 	}
 
-	token, err := createToken(user)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation error"})
+	user, err := getUserByNumber(req.Number)
+	if err != nil || !user.IsActive {
+		c.JSON(http.StatusOK, response)
 		return
 	}
 
-	response := LoginResponse{
-		Token:    token,
-		Role:     user.Role,
-		UserID:   user.ID,
-		Language: lang,
+	channel := req.Channel
+	if channel == "" {
+		channel = ResetChannelSMS
+		if user.TgID != nil {
+			channel = ResetChannelTelegram
+		}
+	}
+	if err := deliverResetCode(user, channel, code); err != nil {
+		log.Printf("Reset code delivery error (%s): %v", channel, err)
 	}
 
 	c.JSON(http.StatusOK, response)
 }
 
-func login(c *gin.Context) {
-	var req LoginRequest
+func resetPasswordHandler(c *gin.Context) {
+	var req ResetPasswordRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !bindPhone(c, &req.Number) {
+		return
+	}
 
-	user, err := getUserByNumber(req.Number)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	if _, err := verifyOTP(req.Number, OTPPurposeResetPassword, req.Code); err != nil {
+		respondOTPError(c, err)
 		return
 	}
 
-	if user.Password != hashPassword(req.Password) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	user, err := getUserByNumber(req.Number)
+	if err != nil {
+		respondOTPError(c, errOTPInvalid)
 		return
 	}
 
-	token, err := createToken(user)
+	passwordHash, err := hashPassword(req.NewPassword)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation error"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid password"})
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password update error"})
 		return
 	}
+	defer tx.Rollback()
 
-	response := LoginResponse{
-		Token:    token,
-		Role:     user.Role,
-		UserID:   user.ID,
-		Language: user.Language,
+	if err := updateUserPassword(tx, user.ID, passwordHash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password update error"})
+		return
+	}
+	// Sign out everywhere, the old password may have been compromised; the
+	// new password doesn't take effect unless that succeeds
+	if err := revokeAllUserTokens(tx, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password update error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password update error"})
+		return
 	}
 
-	c.JSON(http.StatusOK, response)
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully, please log in again"})
 }
 
-func getProfile(c *gin.Context) {
-	user := c.MustGet("user").(*Claims)
+// ========== WEBSOCKET FUNCTIONS ==========
 
-	userDB, err := getUserByNumber(user.Number)
+func handleWebSocket(c *gin.Context) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
+	defer conn.Close()
 
-	// Remove password
-	userResponse := *userDB
-	userResponse.Password = ""
+	clientsMu.Lock()
+	clients[conn] = true
+	log.Printf("WebSocket client connected. Total clients: %d", len(clients))
+	clientsMu.Unlock()
 
-	c.JSON(http.StatusOK, userResponse)
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("WebSocket read error: %v", err)
+			clientsMu.Lock()
+			delete(clients, conn)
+			log.Printf("WebSocket client disconnected. Remaining clients: %d", len(clients))
+			clientsMu.Unlock()
+			break
+		}
+	}
 }
 
-// ========== CATEGORY HANDLERS ==========
+func broadcastToClients(message WSMessage) {
+	jsonData, _ := json.Marshal(message)
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for client := range clients {
+		err := client.WriteJSON(message)
+		if err != nil {
+			log.Printf("WebSocket write error: %v", err)
+			client.Close()
+			delete(clients, client)
+		}
+	}
+	log.Printf("WebSocket message sent: %s", string(jsonData))
+}
 
-func getCategories(c *gin.Context) {
-	lang := getUserLanguage(c.Request.Header)
+func sendOrderUpdate(orderID string, status OrderStatus, message string) {
+	wsMessage := WSMessage{
+		Type:    "order_update",
+		OrderID: orderID,
+		Data: gin.H{
+			"order_id": orderID,
+			"status":   status,
+			"message":  message,
+			"time":     time.Now(),
+		},
+	}
+	publishEvent(wsMessage)
+}
 
-	categories := []gin.H{
-		{"key": "shashlik", "name": getFoodTranslation("shashlik", lang)},
-		{"key": "milliy_taomlar", "name": getFoodTranslation("milliy_taomlar", lang)},
-		{"key": "ichimliklar", "name": getFoodTranslation("ichimliklar", lang)},
-		{"key": "salatlar", "name": getFoodTranslation("salatlar", lang)},
-		{"key": "shirinliklar", "name": getFoodTranslation("shirinliklar", lang)},
+func sendNewOrderNotification(order *Order) {
+	wsMessage := WSMessage{
+		Type:    "new_order",
+		OrderID: order.OrderID,
+		Data:    order,
 	}
+	publishEvent(wsMessage)
 
-	c.JSON(http.StatusOK, categories)
+	// Send Telegram message to admin group
+	go func() {
+		telegramMessage := formatOrderForTelegram(order)
+		if err := sendTelegramMessage(telegramMessage); err != nil {
+			log.Printf("Telegram message error: %v", err)
+		} else {
+			log.Printf("Telegram message sent: %s", order.OrderID)
+		}
+	}()
 }
 
-// ========== FOOD HANDLERS ==========
+// ========== EVENT FAN-OUT (LISTEN/NOTIFY) ==========
 
-func getAllFoodsHandler(c *gin.Context) {
-	lang := getUserLanguage(c.Request.Header)
-	category := c.Query("category")
-	search := c.Query("search")
-	popular := c.Query("popular")
-	sortBy := c.Query("sort")
-	page, _ := strconv.Atoi(c.Query("page"))
-	limit, _ := strconv.Atoi(c.Query("limit"))
+// EventEnvelope is the NOTIFY payload shared by all API instances.
+// Messages too large for NOTIFY are sent as a reference and reloaded
+// from the database by each receiver.
+type EventEnvelope struct {
+	Message *WSMessage `json:"message,omitempty"`
+	Type    string     `json:"type,omitempty"`
+	OrderID string     `json:"order_id,omitempty"`
+	Cache   string     `json:"cache,omitempty"` // a cache every instance should drop
+}
 
-	if page <= 0 {
-		page = 1
+// sharedCaches are the in-memory caches whose invalidation is sent to
+// every instance, so edits show up everywhere without waiting for the TTL
+var sharedCaches = map[string]func(){
+	"categories": clearCategoryCache,
+	"schedules":  clearScheduleCache,
+	"promotions": clearPromotionCache,
+}
+
+// publishCacheInvalidation drops a shared cache here and on the other
+// instances. Without the listener they catch up when their TTL runs out.
+func publishCacheInvalidation(name string) {
+	sharedCaches[name]()
+	if !eventListenerReady.Load() {
+		return
 	}
-	if limit <= 0 {
-		limit = 20
+
+	payload, err := json.Marshal(EventEnvelope{Cache: name})
+	if err == nil {
+		_, err = db.Exec(`SELECT pg_notify($1, $2)`, EVENTS_CHANNEL, string(payload))
+	}
+	if err != nil {
+		log.Printf("Cache invalidation publish error (%s): %v", name, err)
 	}
+}
 
-	// Check if admin or regular user
-	isAdmin := false
-	if userInterface, exists := c.Get("user"); exists {
-		user := userInterface.(*Claims)
-		isAdmin = (user.Role == "admin")
+func encodeEventPayload(message WSMessage) (string, error) {
+	payload, err := json.Marshal(EventEnvelope{Message: &message})
+	if err != nil {
+		return "", err
+	}
+	if len(payload) <= MAX_NOTIFY_PAYLOAD {
+		return string(payload), nil
 	}
 
-	foods, err := getAllLocalizedFoods(lang, isAdmin)
+	payload, err = json.Marshal(EventEnvelope{Type: message.Type, OrderID: message.OrderID})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// publishEvent sends a WebSocket event to the clients of every instance.
+// The publishing instance receives its own notification back, so it does
+// not broadcast locally unless the listener is down.
+func publishEvent(message WSMessage) {
+	if !eventListenerReady.Load() {
+		broadcastToClients(message)
 		return
 	}
 
-	// Filtering
-	if category != "" {
-		filtered := []*Food{}
-		for _, food := range foods {
-			if strings.ToLower(food.Category) == strings.ToLower(category) {
-				filtered = append(filtered, food)
-			}
-		}
-		foods = filtered
+	payload, err := encodeEventPayload(message)
+	if err == nil {
+		_, err = db.Exec(`SELECT pg_notify($1, $2)`, EVENTS_CHANNEL, payload)
+	}
+	if err != nil {
+		log.Printf("Event publish error, broadcasting locally: %v", err)
+		broadcastToClients(message)
 	}
+}
 
-	if search != "" {
-		searchLower := strings.ToLower(search)
-		filtered := []*Food{}
-		for _, food := range foods {
-			if strings.Contains(strings.ToLower(food.Name), searchLower) ||
-				strings.Contains(strings.ToLower(food.Description), searchLower) {
-				filtered = append(filtered, food)
-			}
-		}
-		foods = filtered
+func handleEventNotification(payload string) {
+	var envelope EventEnvelope
+	if err := json.Unmarshal([]byte(payload), &envelope); err != nil {
+		log.Printf("Event payload error: %v", err)
+		return
 	}
 
-	if popular == "true" {
-		filtered := []*Food{}
-		for _, food := range foods {
-			if food.IsPopular {
-				filtered = append(filtered, food)
-			}
+	if envelope.Message != nil {
+		broadcastToClients(*envelope.Message)
+		return
+	}
+	if envelope.Cache != "" {
+		if clear, exists := sharedCaches[envelope.Cache]; exists {
+			clear()
 		}
-		foods = filtered
+		return
 	}
 
-	// Sorting
-	switch sortBy {
-	case "price_asc":
-		sort.Slice(foods, func(i, j int) bool {
-			return foods[i].Price < foods[j].Price
-		})
-	case "price_desc":
-		sort.Slice(foods, func(i, j int) bool {
-			return foods[i].Price > foods[j].Price
-		})
-	case "rating":
-		sort.Slice(foods, func(i, j int) bool {
-			return foods[i].Rating > foods[j].Rating
-		})
-	case "popular":
-		sort.Slice(foods, func(i, j int) bool {
-			if foods[i].IsPopular != foods[j].IsPopular {
-				return foods[i].IsPopular
-			}
-			return foods[i].Rating > foods[j].Rating
-		})
-	case "name":
-		sort.Slice(foods, func(i, j int) bool {
-			return foods[i].Name < foods[j].Name
-		})
-	default:
-		// Default: ID ascending (1, 2, 3, 4...)
-		sort.Slice(foods, func(i, j int) bool {
-			return foods[i].ID < foods[j].ID
-		})
+	// Reference-only event: reload the order
+	order, err := getOrderByID(envelope.OrderID)
+	if err != nil {
+		log.Printf("Event order fetch error (%s): %v", envelope.OrderID, err)
+		return
 	}
+	broadcastToClients(WSMessage{
+		Type:    envelope.Type,
+		OrderID: envelope.OrderID,
+		Data:    order,
+	})
+}
 
-	// Pagination
-	total := len(foods)
-	start := (page - 1) * limit
-	end := start + limit
-	if start >= total {
-		foods = []*Food{}
-	} else {
-		if end > total {
-			end = total
+func startEventListener(connStr string) {
+	reportProblem := func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+			eventListenerReady.Store(true)
+			// Invalidations sent while disconnected were missed
+			for _, clear := range sharedCaches {
+				clear()
+			}
+			log.Println("✅ Event listener connected")
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			eventListenerReady.Store(false)
+			log.Printf("⚠️ Event listener disconnected: %v", err)
 		}
-		foods = foods[start:end]
 	}
 
-	// Make ImageURL full URL
-	hostURL := getHostURL(c)
-	for _, food := range foods {
-		if food.ImageURL != "" && !strings.HasPrefix(food.ImageURL, "http") {
-			food.ImageURL = hostURL + food.ImageURL
-		}
+	listener := pq.NewListener(connStr, 10*time.Second, time.Minute, reportProblem)
+	if err := listener.Listen(EVENTS_CHANNEL); err != nil {
+		log.Printf("⚠️ Event listener error, using local broadcast only: %v", err)
+		listener.Close()
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"foods": foods,
-		"pagination": gin.H{
-			"page":        page,
-			"limit":       limit,
-			"total":       total,
-			"total_pages": (total + limit - 1) / limit,
-		},
-	})
+	go func() {
+		for {
+			select {
+			case notification := <-listener.Notify:
+				// nil is sent after a reconnect
+				if notification == nil {
+					continue
+				}
+				handleEventNotification(notification.Extra)
+			case <-time.After(90 * time.Second):
+				go listener.Ping()
+			}
+		}
+	}()
 }
 
-func getFoodHandler(c *gin.Context) {
-	foodIDStr := c.Param("food_id")
-	lang := getUserLanguage(c.Request.Header)
+// ========== TOKEN MANAGEMENT ==========
 
-	// Convert string ID to integer
-	foodID, err := strconv.ParseInt(foodIDStr, 10, 64)
+var errTokenRevoked = errors.New("token revoked")
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateSecureToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// createRefreshToken stores a new refresh token and returns its plaintext.
+// Only the SHA-256 hash is kept in the database.
+func createRefreshToken(userID, sessionID string) (string, string, error) {
+	token, err := generateSecureToken()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
-		return
+		return "", "", err
 	}
 
-	food, err := getFoodByID(foodID)
+	id := generateID("rt")
+	query := `INSERT INTO refresh_tokens (id, user_id, session_id, token_hash, expires_at, created_at) 
+			  VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = db.Exec(query, id, userID, sessionID, hashToken(token),
+		time.Now().Add(config.JWT.RefreshTTL), time.Now())
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
-		return
+		return "", "", err
 	}
 
-	localizedFood := getLocalizedFood(food, lang)
+	return id, token, nil
+}
 
-	// Make ImageURL full URL
-	if localizedFood.ImageURL != "" && !strings.HasPrefix(localizedFood.ImageURL, "http") {
-		localizedFood.ImageURL = getHostURL(c) + localizedFood.ImageURL
+// issueTokens signs the user in on a new session for the requesting device
+func issueTokens(c *gin.Context, user *User) (*LoginResponse, error) {
+	sessionID, err := startSession(c, user.ID)
+	if err != nil {
+		return nil, err
 	}
-
-	c.JSON(http.StatusOK, localizedFood)
+	return issueSessionTokens(user, sessionID)
 }
 
-func createFoodHandler(c *gin.Context) {
-	var req FoodCreate
-	if err := c.ShouldBindJSON(&req); err != nil {
-		log.Printf("JSON binding error: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":   "Invalid JSON format",
-			"details": err.Error(),
-		})
-		return
+func issueSessionTokens(user *User, sessionID string) (*LoginResponse, error) {
+	accessToken, err := createToken(user, sessionID)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Printf("Received food creation request: %+v", req)
+	_, refreshToken, err := createRefreshToken(user.ID, sessionID)
+	if err != nil {
+		return nil, err
+	}
 
-	// Check if custom ID already exists
-	if req.CustomID != nil {
-		var exists bool
-		checkQuery := `SELECT EXISTS(SELECT 1 FROM foods WHERE id = $1)`
-		err := db.QueryRow(checkQuery, *req.CustomID).Scan(&exists)
+	return &LoginResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(config.JWT.AccessTTL.Seconds()),
+		Role:         user.Role,
+		UserID:       user.ID,
+		Language:     user.Language,
+		SessionID:    sessionID,
+	}, nil
+}
+
+// parseAccessToken validates the JWT and checks it against the revocation
+// list and the current user record, so blocking a user or changing their
+// role takes effect on the next request.
+func parseAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			kid = config.JWT.ActiveKID
+		}
+		key, ok := config.jwtKey(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		return key, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	var role, number string
+	var isActive, revoked, sessionActive bool
+	var tokenVersion int
+	query := `SELECT role, number, is_active, COALESCE(token_version, 0),
+			  EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = $2),
+			  $3 = '' OR EXISTS(SELECT 1 FROM sessions WHERE id = $3 AND user_id = $1 AND revoked_at IS NULL)
+			  FROM users WHERE id = $1`
+	err = db.QueryRow(query, claims.UserID, claims.ID, claims.SessionID).Scan(&role, &number, &isActive,
+		&tokenVersion, &revoked, &sessionActive)
+	if err != nil {
+		return nil, err
+	}
+
+	if revoked || !isActive || !sessionActive {
+		return nil, errTokenRevoked
+	}
+	if claims.TokenVersion != tokenVersion {
+		return nil, errTokenRevoked
+	}
+
+	claims.Role = role
+	claims.Number = number
+	return claims, nil
+}
+
+func revokeAccessToken(claims *Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	query := `INSERT INTO revoked_tokens (jti, user_id, expires_at) VALUES ($1, $2, $3)
+			  ON CONFLICT (jti) DO NOTHING`
+	_, err := db.Exec(query, claims.ID, claims.UserID, claims.ExpiresAt.Time)
+	return err
+}
+
+// revokeAllUserTokens logs a user out of every device: refresh tokens and
+// sessions are revoked and the token version moves on, so access tokens
+// issued before it stop working at once
+func revokeAllUserTokens(execer sqlExecer, userID string) error {
+	if _, err := execer.Exec(`UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP 
+						  WHERE user_id = $1 AND revoked_at IS NULL`, userID); err != nil {
+		return err
+	}
+	if _, err := execer.Exec(`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP 
+						  WHERE user_id = $1 AND revoked_at IS NULL`, userID); err != nil {
+		return err
+	}
+	_, err := execer.Exec(`UPDATE users SET token_version = COALESCE(token_version, 0) + 1 WHERE id = $1`, userID)
+	return err
+}
+
+func cleanupExpiredTokens() {
+	if _, err := db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		log.Printf("Revoked token cleanup error: %v", err)
+	}
+	if _, err := db.Exec(`DELETE FROM refresh_tokens WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		log.Printf("Refresh token cleanup error: %v", err)
+	}
+	if _, err := db.Exec(`DELETE FROM phone_verifications WHERE created_at < $1`, time.Now().Add(-24*time.Hour)); err != nil {
+		log.Printf("Phone verification cleanup error: %v", err)
+	}
+	if _, err := db.Exec(`DELETE FROM rate_limit_buckets WHERE updated_at < $1`, time.Now().Add(-time.Hour)); err != nil {
+		log.Printf("Rate limit cleanup error: %v", err)
+	}
+	if _, err := db.Exec(`DELETE FROM two_factor_challenges WHERE expires_at < $1`, time.Now()); err != nil {
+		log.Printf("Two-factor challenge cleanup error: %v", err)
+	}
+	// Access tokens of a deleted session stop working, so keep revoked ones until those expire
+	if _, err := db.Exec(`DELETE FROM sessions WHERE expires_at < $1 OR revoked_at < $2`,
+		time.Now(), time.Now().Add(-config.JWT.AccessTTL)); err != nil {
+		log.Printf("Session cleanup error: %v", err)
+	}
+	pruneSessionTouches()
+}
+
+// ========== SESSIONS ==========
+
+const SESSION_TOUCH_EVERY = time.Minute
+
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// deviceName prefers the name the app sends in X-Device-Name and falls
+// back to a rough guess from the user agent
+func deviceName(c *gin.Context) string {
+	if name := strings.TrimSpace(c.GetHeader("X-Device-Name")); name != "" {
+		if len(name) > 100 {
+			name = name[:100]
+		}
+		return name
+	}
+
+	userAgent := c.Request.UserAgent()
+	for _, known := range []struct{ marker, name string }{
+		{"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"},
+		{"Windows", "Windows"}, {"Macintosh", "Mac"}, {"Linux", "Linux"},
+		{"okhttp", "Android app"}, {"Dart", "Mobile app"}, {"curl", "curl"},
+	} {
+		if strings.Contains(userAgent, known.marker) {
+			return known.name
+		}
+	}
+	return "Unknown device"
+}
+
+func startSession(c *gin.Context, userID string) (string, error) {
+	id := generateID("sess")
+	_, err := db.Exec(`INSERT INTO sessions (id, user_id, device, ip, user_agent, expires_at)
+					   VALUES ($1, $2, $3, $4, $5, $6)`,
+		id, userID, deviceName(c), c.ClientIP(), c.Request.UserAgent(), time.Now().Add(config.JWT.RefreshTTL))
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// markSessionTwoFactor records that a session was opened with a second factor
+func markSessionTwoFactor(sessionID string) error {
+	_, err := db.Exec(`UPDATE sessions SET two_factor_at = CURRENT_TIMESTAMP WHERE id = $1`, sessionID)
+	return err
+}
+
+// sessionHasTwoFactor tells whether a session was opened with a second factor
+func sessionHasTwoFactor(sessionID string) (bool, error) {
+	var verified bool
+	err := db.QueryRow(`SELECT two_factor_at IS NOT NULL FROM sessions WHERE id = $1`, sessionID).Scan(&verified)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return verified, err
+}
+
+// migrateSessionTwoFactor marks the sessions opened after their user enabled
+// 2FA, which could only be done through a challenge. Older sessions have to
+// sign in again once 2FA applies to them.
+func migrateSessionTwoFactor(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE sessions s SET two_factor_at = s.created_at FROM users u
+					   WHERE u.id = s.user_id AND u.totp_enabled_at IS NOT NULL AND s.created_at >= u.totp_enabled_at`)
+	return err
+}
+
+var sessionTouches = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+// touchSession records activity at most once per SESSION_TOUCH_EVERY per
+// session and instance; other requests neither write nor start a goroutine
+func touchSession(sessionID, ip string) {
+	now := time.Now()
+	sessionTouches.Lock()
+	if now.Sub(sessionTouches.last[sessionID]) < SESSION_TOUCH_EVERY {
+		sessionTouches.Unlock()
+		return
+	}
+	sessionTouches.last[sessionID] = now
+	sessionTouches.Unlock()
+
+	go func() {
+		if _, err := db.Exec(`UPDATE sessions SET last_seen_at = CURRENT_TIMESTAMP, ip = $2
+							  WHERE id = $1 AND last_seen_at < $3`, sessionID, ip, now.Add(-SESSION_TOUCH_EVERY)); err != nil {
+			log.Printf("Session touch error: %v", err)
+		}
+	}()
+}
+
+// pruneSessionTouches forgets sessions that haven't been seen lately
+func pruneSessionTouches() {
+	cutoff := time.Now().Add(-SESSION_TOUCH_EVERY)
+	sessionTouches.Lock()
+	for id, last := range sessionTouches.last {
+		if last.Before(cutoff) {
+			delete(sessionTouches.last, id)
+		}
+	}
+	sessionTouches.Unlock()
+}
+
+// revokeSession ends one session; its access tokens are rejected from the
+// next request on and its refresh token can't be used anymore
+func revokeSession(userID, sessionID string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+							WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+						  WHERE session_id = $1 AND revoked_at IS NULL`, sessionID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func getActiveSessions(userID string) ([]Session, error) {
+	rows, err := db.Query(`SELECT id, COALESCE(device, ''), COALESCE(ip, ''), COALESCE(user_agent, ''),
+						   created_at, last_seen_at, expires_at
+						   FROM sessions WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+						   ORDER BY last_seen_at DESC`, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(&session.ID, &session.Device, &session.IP, &session.UserAgent,
+			&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func getSessionsHandler(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	sessions, err := getActiveSessions(user.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == user.SessionID
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions, "total": len(sessions)})
+}
+
+func revokeSessionHandler(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+	sessionID := c.Param("session_id")
+
+	revoked, err := revokeSession(user.UserID, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Session revoke error"})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+func getUserSessionsHandler(c *gin.Context) {
+	userID := c.Param("user_id")
+
+	if _, err := getUserByID(userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	sessions, err := getActiveSessions(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions, "total": len(sessions)})
+}
+
+// forceLogoutUserHandler ends every session of a user, or a single one
+// with ?session_id=
+func forceLogoutUserHandler(c *gin.Context) {
+	actor := c.MustGet("user").(*Claims)
+	userID := c.Param("user_id")
+	sessionID := c.Query("session_id")
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if !canAssignRole(actor, user.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	if sessionID != "" {
+		revoked, err := revokeSession(userID, sessionID)
 		if err != nil {
-			log.Printf("ID check error: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":   "ID check error",
-				"details": err.Error(),
-			})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Session revoke error"})
 			return
 		}
-		if exists {
-			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("ID %d already exists", *req.CustomID)})
+		if !revoked {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
 			return
 		}
+	} else if err := revokeAllUserTokens(db, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Session revoke error"})
+		return
 	}
+	recordAudit(c, "user.force_logout", "user", userID, gin.H{"session_id": sessionID})
 
-	// Set defaults
-	if req.PreparationTime == 0 {
-		req.PreparationTime = 15
+	c.JSON(http.StatusOK, gin.H{"message": "User logged out"})
+}
+
+// ========== TWO-FACTOR AUTHENTICATION ==========
+
+const (
+	TOTP_ISSUER                  = "Restaurant"
+	TOTP_DIGITS                  = 6
+	TOTP_PERIOD                  = 30 // seconds
+	TOTP_SKEW                    = 1  // accepted steps before and after the current one
+	RECOVERY_CODE_COUNT          = 10
+	TWO_FACTOR_CHALLENGE_MINUTES = 5
+	TWO_FACTOR_MAX_ATTEMPTS      = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
 	}
-	if req.Stock == 0 {
-		req.Stock = 100
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpCode computes the RFC 6238 code (HMAC-SHA1) for a time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
 	}
 
-	// Create multilingual names
-	names := map[string]string{
-		"uz": req.NameUz,
-		"ru": req.NameRu,
-		"en": req.NameEn,
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%uint32(math.Pow10(TOTP_DIGITS))), nil
+}
+
+// matchTOTP returns the time step the code belongs to
+func matchTOTP(secret, code string) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	current := time.Now().Unix() / TOTP_PERIOD
+	for skew := -TOTP_SKEW; skew <= TOTP_SKEW; skew++ {
+		step := current + int64(skew)
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI is what authenticator apps expect in the QR code
+func totpProvisioningURI(secret, account string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTP_ISSUER)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(TOTP_DIGITS))
+	params.Set("period", strconv.Itoa(TOTP_PERIOD))
+	return "otpauth://totp/" + url.PathEscape(TOTP_ISSUER+":"+account) + "?" + params.Encode()
+}
+
+type totpState struct {
+	Secret  string
+	Pending string
+	Enabled bool
+}
+
+func getTOTPState(userID string) (*totpState, error) {
+	var state totpState
+	err := db.QueryRow(`SELECT COALESCE(totp_secret, ''), COALESCE(totp_pending_secret, ''), totp_enabled_at IS NOT NULL
+						FROM users WHERE id = $1`, userID).Scan(&state.Secret, &state.Pending, &state.Enabled)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func roleRequires2FA(role string) bool {
+	var required bool
+	db.QueryRow(`SELECT COALESCE(require_2fa, false) FROM roles WHERE name = $1`, role).Scan(&required)
+	return required
+}
+
+// verifyTOTP checks a code against the enrolled secret. Each time step is
+// accepted once so an observed code can't be replayed.
+func verifyTOTP(userID, code string) bool {
+	state, err := getTOTPState(userID)
+	if err != nil || !state.Enabled {
+		return false
+	}
+	step, ok := matchTOTP(state.Secret, code)
+	if !ok {
+		return false
+	}
+	result, err := db.Exec(`UPDATE users SET totp_last_step = $2 WHERE id = $1 AND COALESCE(totp_last_step, 0) < $2`,
+		userID, step)
+	if err != nil {
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n == 1
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// generateRecoveryCodes replaces the user's recovery codes
+func generateRecoveryCodes(userID string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, RECOVERY_CODE_COUNT)
+	for i := 0; i < RECOVERY_CODE_COUNT; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		code = code[:4] + "-" + code[4:]
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (id, user_id, code_hash) VALUES ($1, $2, $3)`,
+			generateID("rc"), userID, hashToken(normalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func useRecoveryCode(userID, code string) bool {
+	result, err := db.Exec(`UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+							WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n > 0
+}
+
+// verifySecondFactor accepts either an authenticator code or a recovery code
+func verifySecondFactor(userID, code, recoveryCode string) bool {
+	if code != "" {
+		return verifyTOTP(userID, code)
+	}
+	if recoveryCode != "" {
+		return useRecoveryCode(userID, recoveryCode)
+	}
+	return false
+}
+
+// enableTOTP activates the pending secret when the code matches it
+func enableTOTP(userID, code string) (bool, error) {
+	state, err := getTOTPState(userID)
+	if err != nil {
+		return false, err
+	}
+	if state.Pending == "" {
+		return false, nil
+	}
+	step, ok := matchTOTP(state.Pending, code)
+	if !ok {
+		return false, nil
+	}
+	_, err = db.Exec(`UPDATE users SET totp_secret = totp_pending_secret, totp_pending_secret = NULL,
+					  totp_enabled_at = CURRENT_TIMESTAMP, totp_last_step = $2 WHERE id = $1`, userID, step)
+	return err == nil, err
+}
+
+func startTOTPEnrollment(user *User) (gin.H, error) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`UPDATE users SET totp_pending_secret = $2 WHERE id = $1`, user.ID, secret); err != nil {
+		return nil, err
 	}
+	return gin.H{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(secret, user.Number),
+		"digits":           TOTP_DIGITS,
+		"period":           TOTP_PERIOD,
+	}, nil
+}
+
+func createTwoFactorChallenge(userID string) (string, error) {
+	token, err := generateSecureToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(`INSERT INTO two_factor_challenges (id, user_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)`,
+		generateID("2fa"), userID, hashToken(token), time.Now().Add(TWO_FACTOR_CHALLENGE_MINUTES*time.Minute))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// takeTwoFactorChallenge counts an attempt against a live challenge and
+// returns the challenge and user ids
+func takeTwoFactorChallenge(token string) (string, string, error) {
+	var id, userID string
+	err := db.QueryRow(`UPDATE two_factor_challenges SET attempts = attempts + 1
+						WHERE token_hash = $1 AND consumed_at IS NULL AND expires_at > $2 AND attempts < $3
+						RETURNING id, user_id`,
+		hashToken(token), time.Now(), TWO_FACTOR_MAX_ATTEMPTS).Scan(&id, &userID)
+	return id, userID, err
+}
+
+// completeLogin is the last step of every sign-in: accounts with 2FA, or
+// with a role that requires it, get a challenge instead of tokens. Failed
+// attempts are only forgiven once tokens are issued, so that wrong 2FA codes
+// keep counting across fresh challenges.
+func completeLogin(c *gin.Context, user *User) {
+	state, err := getTOTPState(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Login error"})
+		return
+	}
+
+	if state.Enabled || roleRequires2FA(user.Role) {
+		challenge, err := createTwoFactorChallenge(user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Login error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"two_factor_required": true,
+			"setup_required":      !state.Enabled,
+			"challenge_token":     challenge,
+			"expires_in":          TWO_FACTOR_CHALLENGE_MINUTES * 60,
+		})
+		return
+	}
+
+	response, err := issueTokens(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation error"})
+		return
+	}
+	clearLoginFailures(user.Number, c.ClientIP())
+
+	c.JSON(http.StatusOK, response)
+}
+
+// loginTwoFactorSetup starts enrollment for users whose role requires 2FA
+// but who haven't set it up yet
+func loginTwoFactorSetup(c *gin.Context) {
+	var req TwoFactorChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, userID, err := takeTwoFactorChallenge(req.ChallengeToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+	user, err := getUserByID(userID)
+	if err != nil || !user.IsActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+	if state, err := getTOTPState(userID); err != nil || state.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	enrollment, err := startTOTPEnrollment(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Two-factor setup error"})
+		return
+	}
+	c.JSON(http.StatusOK, enrollment)
+}
+
+// loginTwoFactor finishes a login with an authenticator or recovery code.
+// During forced enrollment the first valid code also enables 2FA.
+func loginTwoFactor(c *gin.Context) {
+	var req TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	challengeID, userID, err := takeTwoFactorChallenge(req.ChallengeToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+	user, err := getUserByID(userID)
+	if err != nil || !user.IsActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+	if wait := loginLockedFor(user.Number, c.ClientIP()); wait > 0 {
+		respondTooManyRequests(c, wait, "Too many failed login attempts, try again later")
+		return
+	}
+	state, err := getTOTPState(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Login error"})
+		return
+	}
+
+	var recoveryCodes []string
+	if state.Enabled {
+		if !verifySecondFactor(userID, req.Code, req.RecoveryCode) {
+			recordLoginFailure(user.Number, c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+	} else {
+		enabled, err := enableTOTP(userID, req.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Two-factor setup error"})
+			return
+		}
+		if !enabled {
+			recordLoginFailure(user.Number, c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+		if recoveryCodes, err = generateRecoveryCodes(userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Two-factor setup error"})
+			return
+		}
+	}
+
+	db.Exec(`UPDATE two_factor_challenges SET consumed_at = CURRENT_TIMESTAMP WHERE id = $1`, challengeID)
+	clearLoginFailures(user.Number, c.ClientIP())
+
+	sessionID, err := startSession(c, user.ID)
+	if err == nil {
+		err = markSessionTwoFactor(sessionID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation error"})
+		return
+	}
+	response, err := issueSessionTokens(user, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation error"})
+		return
+	}
+	response.RecoveryCodes = recoveryCodes
+
+	c.JSON(http.StatusOK, response)
+}
+
+func getTwoFactorStatus(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	state, err := getTOTPState(user.UserID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var remaining int
+	db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL`, user.UserID).Scan(&remaining)
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":                  state.Enabled,
+		"required":                 roleRequires2FA(user.Role),
+		"available":                isStaffRole(user.Role),
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+func setupTwoFactor(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	if !isStaffRole(user.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is available for staff accounts"})
+		return
+	}
+	userDB, err := getUserByID(user.UserID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if state, err := getTOTPState(user.UserID); err != nil || state.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	enrollment, err := startTOTPEnrollment(userDB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Two-factor setup error"})
+		return
+	}
+	c.JSON(http.StatusOK, enrollment)
+}
+
+func enableTwoFactor(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	enabled, err := enableTOTP(user.UserID, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Two-factor setup error"})
+		return
+	}
+	if !enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, err := generateRecoveryCodes(user.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Two-factor setup error"})
+		return
+	}
+	// The code just proved the second factor for this session
+	if user.SessionID != "" {
+		if err := markSessionTwoFactor(user.SessionID); err != nil {
+			log.Printf("Session 2FA mark error: %v", err)
+		}
+	}
+	recordAudit(c, "user.2fa_enable", "user", user.UserID, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+func disableTwoFactor(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	var req TwoFactorDisableRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if roleRequires2FA(user.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for your role"})
+		return
+	}
+	userDB, err := getUserByID(user.UserID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if ok, _ := verifyPassword(userDB.Password, req.Password); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is incorrect"})
+		return
+	}
+	if !verifySecondFactor(user.UserID, req.Code, req.RecoveryCode) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	if err := resetTwoFactor(user.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Two-factor update error"})
+		return
+	}
+	recordAudit(c, "user.2fa_disable", "user", user.UserID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+func regenerateRecoveryCodes(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !verifyTOTP(user.UserID, req.Code) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, err := generateRecoveryCodes(user.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Two-factor update error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+func resetTwoFactor(userID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET totp_secret = NULL, totp_pending_secret = NULL, totp_enabled_at = NULL
+						  WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// resetUserTwoFactorHandler helps staff who lost their authenticator; they
+// are signed out and set 2FA up again at the next login if their role requires it
+func resetUserTwoFactorHandler(c *gin.Context) {
+	actor := c.MustGet("user").(*Claims)
+	userID := c.Param("user_id")
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if !canAssignRole(actor, user.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	if err := resetTwoFactor(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User update error"})
+		return
+	}
+	if err := revokeAllUserTokens(db, userID); err != nil {
+		log.Printf("Token revocation error: %v", err)
+	}
+	recordAudit(c, "user.2fa_reset", "user", userID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset"})
+}
+
+// ========== ROLES AND PERMISSIONS ==========
+
+// Permissions
+const (
+	PermAll                = "*"
+	PermFoodsWrite         = "foods:write"
+	PermFoodsReadAll       = "foods:read_all"
+	PermOrdersCreate       = "orders:create"
+	PermOrdersReadAll      = "orders:read_all"
+	PermOrdersUpdateStatus = "orders:update_status"
+	PermStatsRead          = "stats:read"
+	PermRolesManage        = "roles:manage"
+	PermSystemMaintenance  = "system:maintenance"
+	PermUsersRead          = "users:read"
+	PermUsersManage        = "users:manage"
+	PermAuditRead          = "audit:read"
+	PermAPIKeysManage      = "api_keys:manage"
+)
+
+var AllPermissions = []string{
+	PermFoodsWrite,
+	PermFoodsReadAll,
+	PermOrdersCreate,
+	PermOrdersReadAll,
+	PermOrdersUpdateStatus,
+	PermStatsRead,
+	PermRolesManage,
+	PermSystemMaintenance,
+	PermUsersRead,
+	PermUsersManage,
+	PermAuditRead,
+	PermAPIKeysManage,
+}
+
+// Roles
+const (
+	RoleOwner   = "owner"
+	RoleAdmin   = "admin"
+	RoleManager = "manager"
+	RoleCashier = "cashier"
+	RoleKitchen = "kitchen"
+	RoleCourier = "courier"
+	RoleWaiter  = "waiter"
+	RoleUser    = "user"
+)
+
+// Default permissions, only applied when a role is first created
+var DefaultRoles = []struct {
+	Name        string
+	Description string
+	Permissions []string
+}{
+	{RoleOwner, "Full access, manages roles", []string{PermAll}},
+	{RoleAdmin, "Restaurant administrator", []string{
+		PermFoodsWrite, PermFoodsReadAll, PermOrdersCreate, PermOrdersReadAll, PermOrdersUpdateStatus,
+		PermStatsRead, PermSystemMaintenance, PermUsersRead, PermUsersManage, PermAuditRead,
+		PermAPIKeysManage,
+	}},
+	{RoleManager, "Menu and order management", []string{
+		PermFoodsWrite, PermFoodsReadAll, PermOrdersCreate, PermOrdersReadAll, PermOrdersUpdateStatus, PermStatsRead,
+		PermUsersRead,
+	}},
+	{RoleCashier, "Takes payments and closes orders", []string{PermOrdersCreate, PermOrdersReadAll, PermOrdersUpdateStatus}},
+	{RoleKitchen, "Prepares orders", []string{PermFoodsReadAll, PermOrdersReadAll, PermOrdersUpdateStatus}},
+	{RoleCourier, "Delivers orders", []string{PermOrdersReadAll, PermOrdersUpdateStatus}},
+	{RoleWaiter, "Serves restaurant tables", []string{PermFoodsReadAll, PermOrdersCreate, PermOrdersReadAll, PermOrdersUpdateStatus}},
+	{RoleUser, "Customer", []string{}},
+}
+
+const ROLE_CACHE_TTL = 30 * time.Second
+
+var rolePermCache = struct {
+	sync.RWMutex
+	perms    map[string]map[string]bool
+	loadedAt time.Time
+}{}
+
+// firstPermissions shipped with roles, before the permissions catalogue
+// recorded which ones a deployment had already seen
+var firstPermissions = []string{
+	PermAll, PermFoodsWrite, PermFoodsReadAll, PermOrdersReadAll, PermOrdersUpdateStatus,
+	PermStatsRead, PermRolesManage, PermSystemMaintenance,
+}
+
+func seedRoles() error {
+	var existingRoles, knownPerms int
+	if err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM roles), (SELECT COUNT(*) FROM permissions)`).
+		Scan(&existingRoles, &knownPerms); err != nil {
+		return err
+	}
+	if existingRoles > 0 && knownPerms == 0 {
+		// Roles predate the catalogue: what they were set up with isn't new,
+		// so owner edits made since must not be undone by the grants below
+		if _, err := db.Exec(`INSERT INTO permissions (name) SELECT DISTINCT permission FROM role_permissions
+							  ON CONFLICT (name) DO NOTHING`); err != nil {
+			return err
+		}
+		for _, perm := range firstPermissions {
+			if _, err := db.Exec(`INSERT INTO permissions (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, perm); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, role := range DefaultRoles {
+		result, err := db.Exec(`INSERT INTO roles (name, description, is_system) VALUES ($1, $2, true) 
+								ON CONFLICT (name) DO NOTHING`, role.Name, role.Description)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			continue
+		}
+		for _, perm := range role.Permissions {
+			if _, err := db.Exec(`INSERT INTO role_permissions (role, permission) VALUES ($1, $2) 
+								  ON CONFLICT DO NOTHING`, role.Name, perm); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Grant permissions added in later versions to the default roles once
+	for _, perm := range AllPermissions {
+		result, err := db.Exec(`INSERT INTO permissions (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, perm)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			continue
+		}
+		for _, role := range DefaultRoles {
+			for _, rolePerm := range role.Permissions {
+				if rolePerm != perm {
+					continue
+				}
+				if _, err := db.Exec(`INSERT INTO role_permissions (role, permission) VALUES ($1, $2) 
+									  ON CONFLICT DO NOTHING`, role.Name, perm); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// promoteFirstOwner runs once, on the upgrade that introduced roles:
+// deployments from before then have admins but no owner, so the
+// longest-standing active admin becomes the owner and roles stay editable.
+// Later owner changes are left to the owners.
+func promoteFirstOwner(tx *sql.Tx) error {
+	var owners int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE role = $1`, RoleOwner).Scan(&owners); err != nil {
+		return err
+	}
+	if owners == 0 {
+		var number string
+		err := tx.QueryRow(`UPDATE users SET role = $1 WHERE id = (SELECT id FROM users WHERE role = $2 AND is_active
+							ORDER BY created_at, id LIMIT 1) RETURNING number`, RoleOwner, RoleAdmin).Scan(&number)
+		if err == sql.ErrNoRows {
+			log.Printf("⚠️ No user has the %q role; roles can't be edited until one is assigned", RoleOwner)
+		} else if err != nil {
+			return err
+		} else {
+			log.Printf("👑 Promoted admin %s to %q so roles can be managed", number, RoleOwner)
+		}
+	}
+	return nil
+}
+
+func loadRolePermissions() (map[string]map[string]bool, error) {
+	rows, err := db.Query(`SELECT r.name, rp.permission FROM roles r 
+						   LEFT JOIN role_permissions rp ON rp.role = r.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	perms := make(map[string]map[string]bool)
+	for rows.Next() {
+		var role string
+		var perm sql.NullString
+		if err := rows.Scan(&role, &perm); err != nil {
+			return nil, err
+		}
+		if perms[role] == nil {
+			perms[role] = make(map[string]bool)
+		}
+		if perm.Valid {
+			perms[role][perm.String] = true
+		}
+	}
+	return perms, rows.Err()
+}
+
+// rolePermissions returns the cached permission set of a role. The cache
+// is short-lived so edits made on another instance are picked up quickly.
+func rolePermissions(role string) map[string]bool {
+	rolePermCache.RLock()
+	perms, fresh := rolePermCache.perms, time.Since(rolePermCache.loadedAt) < ROLE_CACHE_TTL
+	rolePermCache.RUnlock()
+
+	if perms == nil || !fresh {
+		loaded, err := loadRolePermissions()
+		if err != nil {
+			log.Printf("Role permissions load error: %v", err)
+		} else {
+			rolePermCache.Lock()
+			rolePermCache.perms = loaded
+			rolePermCache.loadedAt = time.Now()
+			rolePermCache.Unlock()
+			perms = loaded
+		}
+	}
+	return perms[role]
+}
+
+func invalidateRoleCache() {
+	rolePermCache.Lock()
+	rolePermCache.loadedAt = time.Time{}
+	rolePermCache.Unlock()
+}
+
+func hasPermission(role, permission string) bool {
+	perms := rolePermissions(role)
+	return perms[PermAll] || perms[permission]
+}
+
+// allows checks a permission for a user's role or an API key's scopes
+func (claims *Claims) allows(permission string) bool {
+	if claims.APIKeyID != "" {
+		for _, scope := range claims.Scopes {
+			if scope == permission {
+				return true
+			}
+		}
+		return false
+	}
+	return hasPermission(claims.Role, permission)
+}
+
+func isStaffRole(role string) bool {
+	return len(rolePermissions(role)) > 0
+}
+
+func validPermission(permission string) bool {
+	if permission == PermAll {
+		return true
+	}
+	for _, p := range AllPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func roleExists(role string) bool {
+	var exists bool
+	db.QueryRow(`SELECT EXISTS(SELECT 1 FROM roles WHERE name = $1)`, role).Scan(&exists)
+	return exists
+}
+
+func setRolePermissions(role string, permissions []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM role_permissions WHERE role = $1`, role); err != nil {
+		return err
+	}
+	for _, perm := range permissions {
+		if _, err := tx.Exec(`INSERT INTO role_permissions (role, permission) VALUES ($1, $2) 
+							  ON CONFLICT DO NOTHING`, role, perm); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	invalidateRoleCache()
+	return nil
+}
+
+// ungrantablePermissions lists the permissions the actor doesn't hold and so
+// can't hand out; only owners can grant "*"
+func ungrantablePermissions(actor *Claims, permissions []string) []string {
+	var denied []string
+	for _, perm := range permissions {
+		if !actor.allows(perm) {
+			denied = append(denied, perm)
+		}
+	}
+	return denied
+}
+
+func invalidPermissions(permissions []string) []string {
+	var invalid []string
+	for _, perm := range permissions {
+		if !validPermission(perm) {
+			invalid = append(invalid, perm)
+		}
+	}
+	return invalid
+}
+
+func listPermissionsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"permissions": AllPermissions})
+}
+
+func listRolesHandler(c *gin.Context) {
+	rows, err := db.Query(`SELECT name, COALESCE(description, ''), is_system, COALESCE(require_2fa, false), created_at
+						   FROM roles ORDER BY created_at, name`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	defer rows.Close()
+
+	perms, _ := loadRolePermissions()
+	roles := []gin.H{}
+	for rows.Next() {
+		var name, description string
+		var isSystem, require2FA bool
+		var createdAt time.Time
+		if err := rows.Scan(&name, &description, &isSystem, &require2FA, &createdAt); err != nil {
+			continue
+		}
+
+		rolePerms := []string{}
+		for perm := range perms[name] {
+			rolePerms = append(rolePerms, perm)
+		}
+		sort.Strings(rolePerms)
+
+		roles = append(roles, gin.H{
+			"name":        name,
+			"description": description,
+			"is_system":   isSystem,
+			"require_2fa": require2FA,
+			"permissions": rolePerms,
+			"created_at":  createdAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+func createRoleHandler(c *gin.Context) {
+	var req RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req.Name = strings.ToLower(strings.TrimSpace(req.Name))
+	if !regexp.MustCompile(`^[a-z][a-z0-9_]{1,49}$`).MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role name"})
+		return
+	}
+	if invalid := invalidPermissions(req.Permissions); len(invalid) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown permissions", "permissions": invalid})
+		return
+	}
+	if denied := ungrantablePermissions(c.MustGet("user").(*Claims), req.Permissions); len(denied) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only grant permissions you hold", "permissions": denied})
+		return
+	}
+	if roleExists(req.Name) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Role already exists"})
+		return
+	}
+
+	if _, err := db.Exec(`INSERT INTO roles (name, description, require_2fa) VALUES ($1, $2, $3)`,
+		req.Name, req.Description, req.Require2FA); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Role creation error"})
+		return
+	}
+	if err := setRolePermissions(req.Name, req.Permissions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Role creation error"})
+		return
+	}
+	recordAudit(c, "role.create", "role", req.Name, gin.H{"permissions": req.Permissions, "require_2fa": req.Require2FA})
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Role created successfully", "role": req.Name})
+}
+
+func updateRoleHandler(c *gin.Context) {
+	role := c.Param("role")
+
+	var req RoleUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !roleExists(role) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+	// The owner role must keep full access so roles stay editable
+	if role == RoleOwner && req.Permissions != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Owner permissions can't be changed"})
+		return
+	}
+	if invalid := invalidPermissions(req.Permissions); len(invalid) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown permissions", "permissions": invalid})
+		return
+	}
+	if denied := ungrantablePermissions(c.MustGet("user").(*Claims), req.Permissions); len(denied) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only grant permissions you hold", "permissions": denied})
+		return
+	}
+
+	if req.Description != nil {
+		if _, err := db.Exec(`UPDATE roles SET description = $2 WHERE name = $1`, role, *req.Description); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Role update error"})
+			return
+		}
+	}
+	if req.Permissions != nil {
+		if err := setRolePermissions(role, req.Permissions); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Role update error"})
+			return
+		}
+	}
+	if req.Require2FA != nil {
+		if _, err := db.Exec(`UPDATE roles SET require_2fa = $2 WHERE name = $1`, role, *req.Require2FA); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Role update error"})
+			return
+		}
+	}
+
+	recordAudit(c, "role.update", "role", role, gin.H{
+		"description": req.Description,
+		"permissions": req.Permissions,
+		"require_2fa": req.Require2FA,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated successfully"})
+}
+
+func deleteRoleHandler(c *gin.Context) {
+	role := c.Param("role")
+
+	var isSystem bool
+	err := db.QueryRow(`SELECT is_system FROM roles WHERE name = $1`, role).Scan(&isSystem)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if isSystem {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "System roles can't be deleted"})
+		return
+	}
+
+	var users int
+	db.QueryRow(`SELECT COUNT(*) FROM users WHERE role = $1`, role).Scan(&users)
+	if users > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Role is assigned to users", "users": users})
+		return
+	}
+
+	if _, err := db.Exec(`DELETE FROM roles WHERE name = $1`, role); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Role deletion error"})
+		return
+	}
+	invalidateRoleCache()
+	recordAudit(c, "role.delete", "role", role, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted successfully"})
+}
+
+// ========== API KEYS ==========
+
+const (
+	API_KEY_HEADER      = "X-API-Key"
+	API_KEY_PREFIX      = "rk_"
+	API_KEY_TOUCH_EVERY = time.Minute
+)
+
+// Permissions that only people may hold
+var apiKeyForbiddenPermissions = map[string]bool{
+	PermAll:           true,
+	PermRolesManage:   true,
+	PermUsersManage:   true,
+	PermAPIKeysManage: true,
+}
+
+var apiKeyTouches = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+// touchAPIKey records the key's last use at most once per
+// API_KEY_TOUCH_EVERY per instance, so busy terminals don't write on
+// every request
+func touchAPIKey(id, ip string) {
+	now := time.Now()
+	apiKeyTouches.Lock()
+	if now.Sub(apiKeyTouches.last[id]) < API_KEY_TOUCH_EVERY {
+		apiKeyTouches.Unlock()
+		return
+	}
+	apiKeyTouches.last[id] = now
+	apiKeyTouches.Unlock()
+
+	if _, err := db.Exec(`UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP, last_used_ip = $2
+						  WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $3)`,
+		id, ip, now.Add(-API_KEY_TOUCH_EVERY)); err != nil {
+		log.Printf("API key touch error: %v", err)
+	}
+}
+
+// authenticateAPIKey turns a key into claims carrying its scopes. The key id
+// stands in for the user id and number so orders and audit entries can be
+// traced back to the key.
+func authenticateAPIKey(key, ip string) (*Claims, error) {
+	if !strings.HasPrefix(key, API_KEY_PREFIX) {
+		return nil, errors.New("malformed API key")
+	}
+
+	var id, name string
+	var creatorRole sql.NullString
+	var creatorActive sql.NullBool
+	var permissionsJSON []byte
+	var expiresAt, revokedAt sql.NullTime
+	err := db.QueryRow(`SELECT k.id, k.name, k.permissions, k.expires_at, k.revoked_at, u.role, u.is_active
+						FROM api_keys k LEFT JOIN users u ON u.id = k.created_by WHERE k.key_hash = $1`,
+		hashToken(key)).Scan(&id, &name, &permissionsJSON, &expiresAt, &revokedAt, &creatorRole, &creatorActive)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		return nil, errors.New("API key revoked")
+	}
+	if expiresAt.Valid && time.Now().After(expiresAt.Time) {
+		return nil, errors.New("API key expired")
+	}
+	// A key acts for the staff member who made it and can't outlive them
+	if !creatorRole.Valid || !creatorActive.Bool {
+		return nil, errors.New("API key creator is no longer active")
+	}
+
+	var granted []string
+	if err := json.Unmarshal(permissionsJSON, &granted); err != nil {
+		return nil, err
+	}
+	// Scopes the creator has since lost are dropped
+	scopes := []string{}
+	for _, scope := range granted {
+		if hasPermission(creatorRole.String, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	touchAPIKey(id, ip)
+
+	return &Claims{
+		Number:   id,
+		UserID:   id,
+		APIKeyID: id,
+		Scopes:   scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject: name,
+		},
+	}, nil
+}
+
+func listAPIKeysHandler(c *gin.Context) {
+	rows, err := db.Query(`SELECT id, name, key_prefix, permissions, COALESCE(created_by, ''), created_at,
+						   expires_at, last_used_at, COALESCE(last_used_ip, ''), revoked_at
+						   FROM api_keys ORDER BY created_at DESC`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	defer rows.Close()
+
+	keys := []gin.H{}
+	for rows.Next() {
+		var id, name, prefix, createdBy, lastUsedIP string
+		var permissionsJSON []byte
+		var createdAt time.Time
+		var expiresAt, lastUsedAt, revokedAt sql.NullTime
+		if err := rows.Scan(&id, &name, &prefix, &permissionsJSON, &createdBy, &createdAt,
+			&expiresAt, &lastUsedAt, &lastUsedIP, &revokedAt); err != nil {
+			continue
+		}
+
+		var permissions []string
+		json.Unmarshal(permissionsJSON, &permissions)
+
+		status := "active"
+		if revokedAt.Valid {
+			status = "revoked"
+		} else if expiresAt.Valid && time.Now().After(expiresAt.Time) {
+			status = "expired"
+		}
+
+		key := gin.H{
+			"id":          id,
+			"name":        name,
+			"prefix":      prefix,
+			"permissions": permissions,
+			"created_by":  createdBy,
+			"created_at":  createdAt,
+			"status":      status,
+		}
+		if expiresAt.Valid {
+			key["expires_at"] = expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			key["last_used_at"] = lastUsedAt.Time
+			key["last_used_ip"] = lastUsedIP
+		}
+		if revokedAt.Valid {
+			key["revoked_at"] = revokedAt.Time
+		}
+		keys = append(keys, key)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys, "total": len(keys)})
+}
+
+// createAPIKeyHandler returns the key once; only its hash is kept
+func createAPIKeyHandler(c *gin.Context) {
+	actor := c.MustGet("user").(*Claims)
+
+	var req APIKeyCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, permission := range req.Permissions {
+		if !validPermission(permission) || apiKeyForbiddenPermissions[permission] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Permission not allowed for API keys", "permission": permission})
+			return
+		}
+		// Nobody can hand out more than they have
+		if !actor.allows(permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied", "permission": permission})
+			return
+		}
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays != nil {
+		if *req.ExpiresInDays <= 0 || *req.ExpiresInDays > 3650 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_days must be between 1 and 3650"})
+			return
+		}
+		expiry := time.Now().AddDate(0, 0, *req.ExpiresInDays)
+		expiresAt = &expiry
+	}
+
+	secret, err := generateSecureToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "API key creation error"})
+		return
+	}
+	key := API_KEY_PREFIX + secret
+	prefix := key[:len(API_KEY_PREFIX)+8]
+
+	permissionsJSON, _ := json.Marshal(req.Permissions)
+	keyID := generateID("key")
+	_, err = db.Exec(`INSERT INTO api_keys (id, name, key_prefix, key_hash, permissions, created_by, expires_at)
+					  VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		keyID, req.Name, prefix, hashToken(key), permissionsJSON, actor.UserID, expiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "API key creation error"})
+		return
+	}
+	recordAudit(c, "api_key.create", "api_key", keyID, gin.H{"name": req.Name, "permissions": req.Permissions})
+
+	response := gin.H{
+		"message":     "API key created, store it now: it won't be shown again",
+		"id":          keyID,
+		"name":        req.Name,
+		"key":         key,
+		"prefix":      prefix,
+		"permissions": req.Permissions,
+	}
+	if expiresAt != nil {
+		response["expires_at"] = *expiresAt
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+func revokeAPIKeyHandler(c *gin.Context) {
+	actor := c.MustGet("user").(*Claims)
+	keyID := c.Param("key_id")
+
+	result, err := db.Exec(`UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP, revoked_by = $2
+							WHERE id = $1 AND revoked_at IS NULL`, keyID, actor.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "API key revoke error"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	recordAudit(c, "api_key.revoke", "api_key", keyID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+// ========== RATE LIMITING ==========
+
+// RateLimit allows Requests per Period, refilled continuously (token bucket)
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func (l RateLimit) refillPerSecond() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// RateLimitStore keeps token buckets. Take consumes one token and returns
+// whether the request is allowed and, if not, how long to wait.
+type RateLimitStore interface {
+	Take(key string, limit RateLimit) (bool, time.Duration, error)
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// MemoryRateLimitStore is enough for a single instance
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	store := &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			store.mu.Lock()
+			for key, bucket := range store.buckets {
+				if time.Since(bucket.updatedAt) > time.Hour {
+					delete(store.buckets, key)
+				}
+			}
+			store.mu.Unlock()
+		}
+	}()
+	return store
+}
+
+func (s *MemoryRateLimitStore) Take(key string, limit RateLimit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	bucket, exists := s.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: float64(limit.Requests), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+
+	rate := limit.refillPerSecond()
+	bucket.tokens = math.Min(float64(limit.Requests), bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*rate)
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second)), nil
+	}
+	bucket.tokens--
+	return true, 0, nil
+}
+
+// PostgresRateLimitStore shares buckets between replicas. Each Take is a
+// single atomic upsert.
+type PostgresRateLimitStore struct{}
+
+func (s *PostgresRateLimitStore) Take(key string, limit RateLimit) (bool, time.Duration, error) {
+	const refilled = `LEAST($2::float8, b.tokens + EXTRACT(EPOCH FROM (LOCALTIMESTAMP - b.updated_at)) * $3::float8)`
+	query := `INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at) 
+			  VALUES ($1, $2::float8 - 1, true, LOCALTIMESTAMP)
+			  ON CONFLICT (key) DO UPDATE SET
+				tokens = CASE WHEN ` + refilled + ` >= 1 THEN ` + refilled + ` - 1 ELSE ` + refilled + ` END,
+				allowed = ` + refilled + ` >= 1,
+				updated_at = LOCALTIMESTAMP
+			  RETURNING b.tokens, b.allowed`
+
+	rate := limit.refillPerSecond()
+	var tokens float64
+	var allowed bool
+	if err := db.QueryRow(query, key, float64(limit.Requests), rate).Scan(&tokens, &allowed); err != nil {
+		return true, 0, err
+	}
+	if allowed {
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - tokens) / rate * float64(time.Second)), nil
+}
+
+var rateLimitStore RateLimitStore
+
+// Configured limits, see initRateLimiter
+var (
+	RateLimitAPI        = RateLimit{300, time.Minute}
+	RateLimitLoginIP    = RateLimit{10, time.Minute}
+	RateLimitLoginPhone = RateLimit{5, time.Minute}
+	RateLimitRegisterIP = RateLimit{5, time.Minute}
+	RateLimitUploadIP   = RateLimit{20, time.Minute}
+)
+
+// Progressive lockout after repeated failed logins. It is kept per number
+// and client IP, so guessing from one place can't lock the owner out
+// everywhere; a short number-wide lock only slows down distributed guessing.
+const (
+	LOGIN_LOCK_THRESHOLD        = 5
+	LOGIN_LOCK_BASE_SECONDS     = 60
+	LOGIN_LOCK_MAX_SECONDS      = 24 * 60 * 60
+	LOGIN_FAILURE_WINDOW        = 24 * time.Hour
+	LOGIN_NUMBER_LOCK_THRESHOLD = 20
+	LOGIN_NUMBER_LOCK_SECONDS   = 15 * 60
+	loginAnyIP                  = "*"
+)
+
+// parseRateLimit reads limits written as "<requests>/<duration>", e.g. "10/1m"
+func parseRateLimit(value string) (RateLimit, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	requests, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || requests <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || period <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	return RateLimit{Requests: requests, Period: period}, nil
+}
+
+func initRateLimiter() error {
+	// A slice rather than a map keyed by the value: several limits may share
+	// the same "5/1m" spelling
+	for _, limit := range []struct {
+		value string
+		dst   *RateLimit
+	}{
+		{config.RateLimit.API, &RateLimitAPI},
+		{config.RateLimit.LoginIP, &RateLimitLoginIP},
+		{config.RateLimit.LoginPhone, &RateLimitLoginPhone},
+		{config.RateLimit.RegisterIP, &RateLimitRegisterIP},
+		{config.RateLimit.UploadIP, &RateLimitUploadIP},
+	} {
+		parsed, err := parseRateLimit(limit.value)
+		if err != nil {
+			return err
+		}
+		*limit.dst = parsed
+	}
+
+	switch config.RateLimit.Store {
+	case "postgres":
+		rateLimitStore = &PostgresRateLimitStore{}
+	default:
+		rateLimitStore = NewMemoryRateLimitStore()
+	}
+	return nil
+}
+
+func rateLimitKeyByIP(c *gin.Context) string {
+	return c.ClientIP()
+}
+
+// rateLimitKeyByPhone reads "number" from the JSON body and restores the
+// body for the handler
+func rateLimitKeyByPhone(c *gin.Context) string {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return ""
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var payload struct {
+		Number string `json:"number"`
+	}
+	json.Unmarshal(body, &payload)
+	// Different spellings of one number share a bucket
+	if number, err := normalizePhone(payload.Number); err == nil {
+		return number
+	}
+	return payload.Number
+}
+
+func respondTooManyRequests(c *gin.Context, wait time.Duration, message string) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       message,
+		"retry_after": int(math.Ceil(wait.Seconds())),
+	})
+}
+
+func rateLimitMiddleware(name string, limit *RateLimit, keyFunc func(*gin.Context) string) gin.HandlerFunc {
+	return gin.HandlerFunc(func(c *gin.Context) {
+		key := keyFunc(c)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		allowed, wait, err := rateLimitStore.Take(name+":"+key, *limit)
+		if err != nil {
+			// Fail open, an outage of the store shouldn't take the API down
+			log.Printf("Rate limit error (%s): %v", name, err)
+		}
+		if !allowed {
+			respondTooManyRequests(c, wait, "Too many requests")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	})
+}
+
+// loginLockedFor returns how long the number is still locked out for this
+// client, by its own lockout or the number-wide one
+func loginLockedFor(number, ip string) time.Duration {
+	var lockedUntil sql.NullTime
+	err := db.QueryRow(`SELECT MAX(locked_until) FROM login_lockouts WHERE number = $1 AND ip IN ($2, $3)`,
+		number, ip, loginAnyIP).Scan(&lockedUntil)
+	if err != nil || !lockedUntil.Valid {
+		return 0
+	}
+	return time.Until(lockedUntil.Time)
+}
+
+// countLoginFailure adds a failure to the counter of the number and ip and
+// returns the failures within LOGIN_FAILURE_WINDOW
+func countLoginFailure(number, ip string, now time.Time) (int, error) {
+	var failures int
+	err := db.QueryRow(`INSERT INTO login_lockouts AS f (number, ip, failures, last_failure_at) VALUES ($1, $2, 1, $3)
+						ON CONFLICT (number, ip) DO UPDATE SET
+						  failures = CASE WHEN f.last_failure_at < $4 THEN 1 ELSE f.failures + 1 END,
+						  last_failure_at = $3
+						RETURNING failures`, number, ip, now, now.Add(-LOGIN_FAILURE_WINDOW)).Scan(&failures)
+	return failures, err
+}
+
+// recordLoginFailure counts a failed login. From LOGIN_LOCK_THRESHOLD
+// failures from one IP on, every further failure doubles that IP's
+// lockout; many failures from anywhere lock the number briefly.
+func recordLoginFailure(number, ip string) {
+	now := time.Now()
+	failures, err := countLoginFailure(number, ip, now)
+	if err != nil {
+		log.Printf("Login failure record error: %v", err)
+		return
+	}
+	if failures >= LOGIN_LOCK_THRESHOLD {
+		seconds := float64(LOGIN_LOCK_BASE_SECONDS) * math.Pow(2, float64(failures-LOGIN_LOCK_THRESHOLD))
+		lock := time.Duration(math.Min(seconds, LOGIN_LOCK_MAX_SECONDS)) * time.Second
+		db.Exec(`UPDATE login_lockouts SET locked_until = $3 WHERE number = $1 AND ip = $2`, number, ip, now.Add(lock))
+		log.Printf("⚠️ Login locked for %s from %s after %d failures (%s)", number, ip, failures, lock)
+	}
+
+	total, err := countLoginFailure(number, loginAnyIP, now)
+	if err != nil {
+		log.Printf("Login failure record error: %v", err)
+		return
+	}
+	if total >= LOGIN_NUMBER_LOCK_THRESHOLD {
+		db.Exec(`UPDATE login_lockouts SET locked_until = $3 WHERE number = $1 AND ip = $2`,
+			number, loginAnyIP, now.Add(LOGIN_NUMBER_LOCK_SECONDS*time.Second))
+		log.Printf("⚠️ Login locked for %s from every client after %d failures", number, total)
+	}
+}
+
+// clearLoginFailures forgets the failures of this client only; the
+// number-wide counter runs out on its own
+func clearLoginFailures(number, ip string) {
+	db.Exec(`DELETE FROM login_lockouts WHERE number = $1 AND ip = $2`, number, ip)
+}
+
+// ========== MIDDLEWARE ==========
+
+func corsMiddleware() gin.HandlerFunc {
+	allowAll := false
+	allowed := make(map[string]bool)
+	for _, origin := range config.CORS.AllowedOrigins {
+		if origin == "*" {
+			allowAll = true
+		}
+		allowed[origin] = true
+	}
+
+	return gin.HandlerFunc(func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if allowAll {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else if allowed[origin] {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+			c.Header("Vary", "Origin")
+		}
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Key, X-Device-Name, If-Match, accept, origin, Cache-Control, X-Requested-With")
+		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
+		// Browsers hide ETag from scripts unless it is exposed, and clients
+		// need it for If-Match on PUT/PATCH
+		c.Header("Access-Control-Expose-Headers", "ETag")
+
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(204)
+			return
+		}
+
+		c.Next()
+	})
+}
+
+func optionalAuthMiddleware() gin.HandlerFunc {
+	return gin.HandlerFunc(func(c *gin.Context) {
+		if apiKey := c.GetHeader(API_KEY_HEADER); apiKey != "" {
+			if claims, err := authenticateAPIKey(apiKey, c.ClientIP()); err == nil {
+				c.Set("user", claims)
+			}
+			c.Next()
+			return
+		}
+
+		authHeader := c.GetHeader("Authorization")
+		if authHeader != "" {
+			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+			if tokenString != authHeader {
+				if claims, err := parseAccessToken(tokenString); err == nil {
+					c.Set("user", claims)
+				}
+			}
+		}
+		c.Next()
+	})
+}
+
+func authMiddleware() gin.HandlerFunc {
+	return gin.HandlerFunc(func(c *gin.Context) {
+		if apiKey := c.GetHeader(API_KEY_HEADER); apiKey != "" {
+			claims, err := authenticateAPIKey(apiKey, c.ClientIP())
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+				c.Abort()
+				return
+			}
+			c.Set("user", claims)
+			c.Next()
+			return
+		}
+
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+			c.Abort()
+			return
+		}
+
+		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		if tokenString == authHeader {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Bearer token required"})
+			c.Abort()
+			return
+		}
+
+		claims, err := parseAccessToken(tokenString)
+		if err != nil {
+			if err == errTokenRevoked {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Token revoked"})
+			} else {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			}
+			c.Abort()
+			return
+		}
+		if claims.SessionID != "" {
+			touchSession(claims.SessionID, c.ClientIP())
+		}
+
+		c.Set("user", claims)
+		c.Next()
+	})
+}
+
+// accountMiddleware keeps API keys away from endpoints that act on a
+// person's own account
+func accountMiddleware() gin.HandlerFunc {
+	return gin.HandlerFunc(func(c *gin.Context) {
+		if user, exists := c.Get("user"); exists && user.(*Claims).APIKeyID != "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not available for API keys"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	})
+}
+
+// staffMiddleware admits any role with at least one permission; the
+// individual routes are gated with requirePermission.
+func staffMiddleware() gin.HandlerFunc {
+	return gin.HandlerFunc(func(c *gin.Context) {
+		user, exists := c.Get("user")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			c.Abort()
+			return
+		}
+
+		claims := user.(*Claims)
+		if claims.APIKeyID == "" && !isStaffRole(claims.Role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Staff access required"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	})
+}
+
+// requirePermission allows the request if the user's role has any of the
+// given permissions
+func requirePermission(permissions ...string) gin.HandlerFunc {
+	return gin.HandlerFunc(func(c *gin.Context) {
+		user, exists := c.Get("user")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			c.Abort()
+			return
+		}
+
+		claims := user.(*Claims)
+		for _, permission := range permissions {
+			if claims.allows(permission) {
+				c.Next()
+				return
+			}
+		}
+
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":    "Permission denied",
+			"required": permissions,
+		})
+		c.Abort()
+	})
+}
+
+// requireAPIKeyScope gates routes open to every signed-in person: API keys
+// need the scope, people are let through
+func requireAPIKeyScope(permission string) gin.HandlerFunc {
+	return gin.HandlerFunc(func(c *gin.Context) {
+		if user, exists := c.Get("user"); exists {
+			if claims := user.(*Claims); claims.APIKeyID != "" && !claims.allows(permission) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error":    "Permission denied",
+					"required": []string{permission},
+				})
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	})
+}
+
+// ========== DATABASE HELPER FUNCTIONS ==========
+
+func getUserByNumber(number string) (*User, error) {
+	if normalized, err := normalizePhone(number); err == nil {
+		number = normalized
+	}
+
+	query := `SELECT id, number, password, role, full_name, email, created_at, is_active, tg_id, language, 
+			  COALESCE(token_version, 0)
+			  FROM users WHERE number = $1`
+
+	var user User
+	err := db.QueryRow(query, number).Scan(
+		&user.ID, &user.Number, &user.Password, &user.Role,
+		&user.FullName, &user.Email, &user.CreatedAt,
+		&user.IsActive, &user.TgID, &user.Language, &user.TokenVersion,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func getUserByID(userID string) (*User, error) {
+	query := `SELECT id, number, password, role, full_name, email, created_at, is_active, tg_id, language, 
+			  COALESCE(token_version, 0)
+			  FROM users WHERE id = $1`
+
+	var user User
+	err := db.QueryRow(query, userID).Scan(
+		&user.ID, &user.Number, &user.Password, &user.Role,
+		&user.FullName, &user.Email, &user.CreatedAt,
+		&user.IsActive, &user.TgID, &user.Language, &user.TokenVersion,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func updateUserPassword(execer sqlExecer, userID, passwordHash string) error {
+	query := `UPDATE users SET password = $2 WHERE id = $1`
+	_, err := execer.Exec(query, userID, passwordHash)
+	return err
+}
+
+func createUser(execer sqlExecer, user *User) error {
+	query := `INSERT INTO users (id, number, password, role, full_name, email, created_at, is_active, tg_id, language) 
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	_, err := execer.Exec(query, user.ID, user.Number, user.Password, user.Role,
+		user.FullName, user.Email, user.CreatedAt, user.IsActive, user.TgID, user.Language)
+
+	return err
+}
+
+func getFoodByID(foodID int64) (*Food, error) {
+	query := `SELECT id, names, name, descriptions, description, category, price, is_there, 
+			  image_url, ingredients, allergens, rating, review_count, preparation_time, 
+			  stock, is_popular, discount, comment, created_at, updated_at, deleted_at
+			  FROM foods WHERE id = $1`
+
+	var food Food
+	var namesJSON, descriptionsJSON, ingredientsJSON, allergensJSON []byte
+
+	err := db.QueryRow(query, foodID).Scan(
+		&food.ID, &namesJSON, &food.Name, &descriptionsJSON, &food.Description,
+		&food.Category, &food.Price, &food.IsThere, &food.ImageURL,
+		&ingredientsJSON, &allergensJSON, &food.Rating, &food.ReviewCount,
+		&food.PreparationTime, &food.Stock, &food.IsPopular, &food.Discount,
+		&food.Comment, &food.CreatedAt, &food.UpdatedAt, &food.DeletedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON unmarshal
+	if namesJSON != nil {
+		json.Unmarshal(namesJSON, &food.Names)
+	}
+	if descriptionsJSON != nil {
+		json.Unmarshal(descriptionsJSON, &food.Descriptions)
+	}
+	if ingredientsJSON != nil {
+		json.Unmarshal(ingredientsJSON, &food.Ingredients)
+	}
+	if allergensJSON != nil {
+		json.Unmarshal(allergensJSON, &food.Allergens)
+	}
+
+	return &food, nil
+}
+
+func getAllFoods() ([]*Food, error) {
+	// Only available foods (not archived, isThere = true, stock > 0, within their schedule) ordered by ID
+	query := `SELECT id, names, name, descriptions, description, category, price, is_there, 
+			  image_url, ingredients, allergens, rating, review_count, preparation_time, 
+			  stock, is_popular, discount, comment, created_at, updated_at
+			  FROM foods WHERE deleted_at IS NULL AND is_there = true AND stock > 0 ORDER BY id ASC`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := restaurantNow()
+	var foods []*Food
+	for rows.Next() {
+		var food Food
+		var namesJSON, descriptionsJSON, ingredientsJSON, allergensJSON []byte
+
+		err := rows.Scan(
+			&food.ID, &namesJSON, &food.Name, &descriptionsJSON, &food.Description,
+			&food.Category, &food.Price, &food.IsThere, &food.ImageURL,
+			&ingredientsJSON, &allergensJSON, &food.Rating, &food.ReviewCount,
+			&food.PreparationTime, &food.Stock, &food.IsPopular, &food.Discount,
+			&food.Comment, &food.CreatedAt, &food.UpdatedAt,
+		)
+
+		if err != nil {
+			continue
+		}
+
+		// Outside its menu hours (breakfast at 21:00)
+		if !foodScheduledAt(food.ID, food.Category, now) {
+			continue
+		}
+
+		// JSON unmarshal
+		if namesJSON != nil {
+			json.Unmarshal(namesJSON, &food.Names)
+		}
+		if descriptionsJSON != nil {
+			json.Unmarshal(descriptionsJSON, &food.Descriptions)
+		}
+		if ingredientsJSON != nil {
+			json.Unmarshal(ingredientsJSON, &food.Ingredients)
+		}
+		if allergensJSON != nil {
+			json.Unmarshal(allergensJSON, &food.Allergens)
+		}
+
+		foods = append(foods, &food)
+	}
+
+	return foods, nil
+}
+
+func getAllFoodsForAdmin() ([]*Food, error) {
+	// All foods for admin ordered by ID; archived ones have their own view
+	query := `SELECT id, names, name, descriptions, description, category, price, is_there, 
+			  image_url, ingredients, allergens, rating, review_count, preparation_time, 
+			  stock, is_popular, discount, comment, created_at, updated_at
+			  FROM foods WHERE deleted_at IS NULL ORDER BY id ASC`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var foods []*Food
+	for rows.Next() {
+		var food Food
+		var namesJSON, descriptionsJSON, ingredientsJSON, allergensJSON []byte
+
+		err := rows.Scan(
+			&food.ID, &namesJSON, &food.Name, &descriptionsJSON, &food.Description,
+			&food.Category, &food.Price, &food.IsThere, &food.ImageURL,
+			&ingredientsJSON, &allergensJSON, &food.Rating, &food.ReviewCount,
+			&food.PreparationTime, &food.Stock, &food.IsPopular, &food.Discount,
+			&food.Comment, &food.CreatedAt, &food.UpdatedAt,
+		)
+
+		if err != nil {
+			continue
+		}
+
+		// JSON unmarshal
+		if namesJSON != nil {
+			json.Unmarshal(namesJSON, &food.Names)
+		}
+		if descriptionsJSON != nil {
+			json.Unmarshal(descriptionsJSON, &food.Descriptions)
+		}
+		if ingredientsJSON != nil {
+			json.Unmarshal(ingredientsJSON, &food.Ingredients)
+		}
+		if allergensJSON != nil {
+			json.Unmarshal(allergensJSON, &food.Allergens)
+		}
+
+		foods = append(foods, &food)
+	}
+
+	return foods, nil
+}
+
+func createFoodWithCustomID(tx *sql.Tx, food *Food, customID *int64) error {
+	var query string
+	var err error
+
+	namesJSON, err := json.Marshal(food.Names)
+	if err != nil {
+		return fmt.Errorf("names JSON marshal error: %w", err)
+	}
+
+	descriptionsJSON, err := json.Marshal(food.Descriptions)
+	if err != nil {
+		return fmt.Errorf("descriptions JSON marshal error: %w", err)
+	}
+
+	ingredientsJSON, err := json.Marshal(food.Ingredients)
+	if err != nil {
+		return fmt.Errorf("ingredients JSON marshal error: %w", err)
+	}
+
+	allergensJSON, err := json.Marshal(food.Allergens)
+	if err != nil {
+		return fmt.Errorf("allergens JSON marshal error: %w", err)
+	}
+
+	if customID != nil {
+		// Manual ID insertion
+		query = `INSERT INTO foods (id, names, name, descriptions, description, category, price, 
+				 is_there, image_url, ingredients, allergens, rating, review_count, 
+				 preparation_time, stock, is_popular, discount, comment, created_at, updated_at) 
+				 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)`
+
+		_, err = tx.Exec(query, *customID, namesJSON, food.Name, descriptionsJSON, food.Description,
+			food.Category, food.Price, food.IsThere, food.ImageURL, ingredientsJSON,
+			allergensJSON, food.Rating, food.ReviewCount, food.PreparationTime,
+			food.Stock, food.IsPopular, food.Discount, food.Comment,
+			food.CreatedAt, food.UpdatedAt)
+
+		if err != nil {
+			return fmt.Errorf("manual ID insertion error: %w", err)
+		}
+
+		food.ID = *customID
+	} else {
+		// Automatic ID (BIGSERIAL)
+		query = `INSERT INTO foods (names, name, descriptions, description, category, price, 
+				 is_there, image_url, ingredients, allergens, rating, review_count, 
+				 preparation_time, stock, is_popular, discount, comment, created_at, updated_at) 
+				 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
+				 RETURNING id`
+
+		err = tx.QueryRow(query, namesJSON, food.Name, descriptionsJSON, food.Description,
+			food.Category, food.Price, food.IsThere, food.ImageURL, ingredientsJSON,
+			allergensJSON, food.Rating, food.ReviewCount, food.PreparationTime,
+			food.Stock, food.IsPopular, food.Discount, food.Comment,
+			food.CreatedAt, food.UpdatedAt).Scan(&food.ID)
+
+		if err != nil {
+			return fmt.Errorf("automatic ID insertion error: %w", err)
+		}
+	}
+
+	log.Printf("✅ Food created successfully with ID: %d", food.ID)
+	return nil
+}
+
+// updateFood saves the food unless the row changed since food was read,
+// in which case it returns sql.ErrNoRows. food.UpdatedAt is refreshed.
+func updateFood(tx *sql.Tx, food *Food) error {
+	namesJSON, _ := json.Marshal(food.Names)
+	descriptionsJSON, _ := json.Marshal(food.Descriptions)
+	ingredientsJSON, _ := json.Marshal(food.Ingredients)
+	allergensJSON, _ := json.Marshal(food.Allergens)
+
+	query := `UPDATE foods SET names = $2, name = $3, descriptions = $4, description = $5, 
+			  category = $6, price = $7, is_there = $8, image_url = $9, ingredients = $10, 
+			  allergens = $11, rating = $12, review_count = $13, preparation_time = $14, 
+			  stock = $15, is_popular = $16, discount = $17, comment = $18, updated_at = CURRENT_TIMESTAMP
+			  WHERE id = $1 AND updated_at = $19 RETURNING updated_at`
+
+	return tx.QueryRow(query, food.ID, namesJSON, food.Name, descriptionsJSON, food.Description,
+		food.Category, food.Price, food.IsThere, food.ImageURL, ingredientsJSON,
+		allergensJSON, food.Rating, food.ReviewCount, food.PreparationTime,
+		food.Stock, food.IsPopular, food.Discount, food.Comment, food.UpdatedAt).Scan(&food.UpdatedAt)
+}
+
+func createOrder(execer sqlExecer, order *Order) error {
+	foodsJSON, _ := json.Marshal(order.Foods)
+	deliveryInfoJSON, _ := json.Marshal(order.DeliveryInfo)
+	paymentInfoJSON, _ := json.Marshal(order.PaymentInfo)
+	statusHistoryJSON, _ := json.Marshal(order.StatusHistory)
+
+	query := `INSERT INTO orders (order_id, user_number, user_name, foods, total_price, 
+			  order_time, delivery_type, delivery_info, status, payment_info, 
+			  special_instructions, estimated_time, delivered_at, status_history, 
+			  created_at, updated_at) 
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`
+
+	_, err := execer.Exec(query, order.OrderID, order.UserNumber, order.UserName, foodsJSON,
+		order.TotalPrice, order.OrderTime, order.DeliveryType, deliveryInfoJSON,
+		order.Status, paymentInfoJSON, order.SpecialInstructions, order.EstimatedTime,
+		order.DeliveredAt, statusHistoryJSON, order.CreatedAt, order.UpdatedAt)
+
+	return err
+}
+
+// takeStock reserves portions inside the order transaction. It leaves the
+// row alone and returns false when the stock ran out in the meantime.
+func takeStock(tx *sql.Tx, foodID int64, quantity int) (bool, error) {
+	result, err := tx.Exec(`UPDATE foods SET stock = stock - $2, updated_at = CURRENT_TIMESTAMP
+							WHERE id = $1 AND stock >= $2`, foodID, quantity)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+func getOrderByID(orderID string) (*Order, error) {
+	query := `SELECT order_id, user_number, user_name, foods, total_price, order_time, 
+			  delivery_type, delivery_info, status, payment_info, special_instructions, 
+			  estimated_time, delivered_at, status_history, created_at, updated_at
+			  FROM orders WHERE order_id = $1`
+
+	var order Order
+	var foodsJSON, deliveryInfoJSON, paymentInfoJSON, statusHistoryJSON []byte
+
+	err := db.QueryRow(query, orderID).Scan(
+		&order.OrderID, &order.UserNumber, &order.UserName, &foodsJSON,
+		&order.TotalPrice, &order.OrderTime, &order.DeliveryType, &deliveryInfoJSON,
+		&order.Status, &paymentInfoJSON, &order.SpecialInstructions,
+		&order.EstimatedTime, &order.DeliveredAt, &statusHistoryJSON,
+		&order.CreatedAt, &order.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON unmarshal
+	json.Unmarshal(foodsJSON, &order.Foods)
+	json.Unmarshal(deliveryInfoJSON, &order.DeliveryInfo)
+	json.Unmarshal(paymentInfoJSON, &order.PaymentInfo)
+	json.Unmarshal(statusHistoryJSON, &order.StatusHistory)
+
+	return &order, nil
+}
+
+func scanOrders(rows *sql.Rows) []*Order {
+	var orders []*Order
+	for rows.Next() {
+		var order Order
+		var foodsJSON, deliveryInfoJSON, paymentInfoJSON, statusHistoryJSON []byte
+
+		err := rows.Scan(
+			&order.OrderID, &order.UserNumber, &order.UserName, &foodsJSON,
+			&order.TotalPrice, &order.OrderTime, &order.DeliveryType, &deliveryInfoJSON,
+			&order.Status, &paymentInfoJSON, &order.SpecialInstructions,
+			&order.EstimatedTime, &order.DeliveredAt, &statusHistoryJSON,
+			&order.CreatedAt, &order.UpdatedAt,
+		)
+
+		if err != nil {
+			continue
+		}
+
+		// JSON unmarshal
+		json.Unmarshal(foodsJSON, &order.Foods)
+		json.Unmarshal(deliveryInfoJSON, &order.DeliveryInfo)
+		json.Unmarshal(paymentInfoJSON, &order.PaymentInfo)
+		json.Unmarshal(statusHistoryJSON, &order.StatusHistory)
+
+		orders = append(orders, &order)
+	}
+	return orders
+}
+
+func updateOrder(order *Order) error {
+	foodsJSON, _ := json.Marshal(order.Foods)
+	deliveryInfoJSON, _ := json.Marshal(order.DeliveryInfo)
+	paymentInfoJSON, _ := json.Marshal(order.PaymentInfo)
+	statusHistoryJSON, _ := json.Marshal(order.StatusHistory)
+
+	query := `UPDATE orders SET user_number = $2, user_name = $3, foods = $4, total_price = $5, 
+			  order_time = $6, delivery_type = $7, delivery_info = $8, status = $9, 
+			  payment_info = $10, special_instructions = $11, estimated_time = $12, 
+			  delivered_at = $13, status_history = $14, updated_at = CURRENT_TIMESTAMP
+			  WHERE order_id = $1`
+
+	_, err := db.Exec(query, order.OrderID, order.UserNumber, order.UserName, foodsJSON,
+		order.TotalPrice, order.OrderTime, order.DeliveryType, deliveryInfoJSON,
+		order.Status, paymentInfoJSON, order.SpecialInstructions, order.EstimatedTime,
+		order.DeliveredAt, statusHistoryJSON)
+
+	return err
+}
+
+func updateSequenceAfterManualInsert() error {
+	query := `SELECT setval('foods_id_seq', (SELECT MAX(id) FROM foods))`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("sequence update error: %w", err)
+	}
+	log.Println("✅ Sequence updated")
+	return nil
+}
+
+// Helper functions
+func stringPtr(s string) *string {
+	return &s
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func getLocalizedFood(food *Food, lang string) *Food {
+	localizedFood := *food
+
+	// Get multilingual name
+	if food.Names != nil {
+		if name, exists := food.Names[lang]; exists {
+			localizedFood.Name = name
+		} else if name, exists := food.Names["uz"]; exists {
+			localizedFood.Name = name
+		}
+	}
+
+	// Get multilingual description
+	if food.Descriptions != nil {
+		if desc, exists := food.Descriptions[lang]; exists {
+			localizedFood.Description = desc
+		} else if desc, exists := food.Descriptions["uz"]; exists {
+			localizedFood.Description = desc
+		}
+	}
+
+	// Translate category name
+	localizedFood.CategoryName = getCategoryName(food.Category, lang)
+
+	// Price with the promotion running now
+	price := priceFood(food, 1, restaurantNow())
+	if price.Promotion != nil {
+		localizedFood.Promotion = price.Promotion.summary(lang)
+		if price.UnitPrice != food.Price {
+			localizedFood.OriginalPrice = food.Price
+			localizedFood.Price = price.UnitPrice
+		}
+	}
+
+	return &localizedFood
+}
+
+func getAllLocalizedFoods(lang string, isAdmin bool) ([]*Food, error) {
+	var foods []*Food
+	var err error
+
+	if isAdmin {
+		foods, err = getAllFoodsForAdmin()
+	} else {
+		foods, err = getAllFoods()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var localizedFoods []*Food
+	for _, food := range foods {
+		// Foods of a hidden category are hidden with it
+		if !isAdmin && !categoryIsActive(food.Category) {
+			continue
+		}
+		localizedFood := getLocalizedFood(food, lang)
+		localizedFoods = append(localizedFoods, localizedFood)
+	}
+
+	if err := attachModifiers(localizedFoods, lang, isAdmin); err != nil {
+		return nil, err
+	}
+	if err := attachFoodImages(localizedFoods, lang); err != nil {
+		return nil, err
+	}
+
+	return attachComboComponents(localizedFoods, lang, !isAdmin)
+}
+
+// ========== AUTHENTICATION HANDLERS ==========
+
+func register(c *gin.Context) {
+	var req RegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !bindPhone(c, &req.Number) {
+		return
+	}
+
+	lang := req.Language
+	if lang == "" {
+		lang = "uz"
+	}
+
+	// Check if user exists
+	_, err := getUserByNumber(req.Number)
+	if err == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Phone number already registered"})
+		return
+	}
+
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid password"})
+		return
+	}
+
+	user := &User{
+		ID:        generateID("user"),
+		Number:    req.Number,
+		Password:  passwordHash,
+		Role:      "user",
+		FullName:  req.FullName,
+		Email:     req.Email,
+		CreatedAt: time.Now(),
+		IsActive:  true,
+		TgID:      req.TgID,
+		Language:  lang,
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User creation error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Proof of phone ownership from /api/otp/verify, spent only if the
+	// account is created
+	if err := consumeVerificationToken(tx, req.VerificationToken, req.Number, OTPPurposeRegister); err != nil {
+		if err == errOTPInvalid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Phone number not verified"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "User creation error"})
+		}
+		return
+	}
+	if err := createUser(tx, user); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Phone number already registered"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User creation error"})
+		return
+	}
+	if _, err := tx.Exec(`UPDATE users SET phone_verified_at = CURRENT_TIMESTAMP WHERE id = $1`, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User creation error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User creation error"})
+		return
+	}
+
+	response, err := issueTokens(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func login(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// An unparseable number can't belong to an account
+	if number, err := normalizePhone(req.Number); err == nil {
+		req.Number = number
+	}
+
+	if wait := loginLockedFor(req.Number, c.ClientIP()); wait > 0 {
+		respondTooManyRequests(c, wait, "Too many failed login attempts, try again later")
+		return
+	}
+
+	user, err := getUserByNumber(req.Number)
+	if err != nil {
+		recordLoginFailure(req.Number, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	ok, needsRehash := verifyPassword(user.Password, req.Password)
+	if !ok {
+		recordLoginFailure(req.Number, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	if !user.IsActive {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is blocked"})
+		return
+	}
+
+	// Transparently upgrade legacy hashes
+	if needsRehash {
+		if newHash, err := hashPassword(req.Password); err != nil {
+			log.Printf("Password rehash error: %v", err)
+		} else if err := updateUserPassword(db, user.ID, newHash); err != nil {
+			log.Printf("Password rehash save error: %v", err)
+		} else {
+			log.Printf("✅ Password hash upgraded for user: %s", user.ID)
+		}
+	}
+
+	completeLogin(c, user)
+}
+
+// refreshTokenHandler rotates a refresh token. Presenting an already
+// rotated token is treated as theft and revokes every session of the user.
+func refreshTokenHandler(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var tokenID, userID, sessionID string
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+	query := `SELECT id, user_id, COALESCE(session_id, ''), expires_at, revoked_at FROM refresh_tokens WHERE token_hash = $1`
+	err := db.QueryRow(query, hashToken(req.RefreshToken)).Scan(&tokenID, &userID, &sessionID, &expiresAt, &revokedAt)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	if revokedAt.Valid {
+		// Tokens of a signed-out session are expected to come back once.
+		// Revoked sessions are cleaned up before their refresh tokens, so a
+		// missing session counts as revoked too.
+		var sessionRevoked bool
+		err := db.QueryRow(`SELECT revoked_at IS NOT NULL FROM sessions WHERE id = $1`, sessionID).Scan(&sessionRevoked)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Token rotation error"})
+			return
+		}
+		if sessionID != "" && (err == sql.ErrNoRows || sessionRevoked) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session revoked"})
+			return
+		}
+
+		log.Printf("⚠️ Refresh token reuse detected for user: %s", userID)
+		if err := revokeAllUserTokens(db, userID); err != nil {
+			log.Printf("Token revocation error: %v", err)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token revoked"})
+		return
+	}
+	if time.Now().After(expiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token expired"})
+		return
+	}
+
+	user, err := getUserByID(userID)
+	if err != nil || !user.IsActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	// Sessions opened without a second factor end once 2FA applies to the
+	// account, either enabled by the user or required by the role
+	state, err := getTOTPState(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token rotation error"})
+		return
+	}
+	if state.Enabled || roleRequires2FA(user.Role) {
+		verified, err := sessionHasTwoFactor(sessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Token rotation error"})
+			return
+		}
+		if !verified {
+			db.Exec(`UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL`, tokenID)
+			if sessionID != "" {
+				if _, err := revokeSession(user.ID, sessionID); err != nil {
+					log.Printf("Session revocation error: %v", err)
+				}
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Two-factor authentication required, sign in again"})
+			return
+		}
+	}
+
+	// Only one concurrent refresh may win the rotation
+	result, err := db.Exec(`UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP 
+							WHERE id = $1 AND revoked_at IS NULL`, tokenID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token rotation error"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token revoked"})
+		return
+	}
+
+	// Tokens issued before sessions existed get a session now
+	if sessionID == "" {
+		if sessionID, err = startSession(c, user.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation error"})
+			return
+		}
+	}
+	result, err = db.Exec(`UPDATE sessions SET last_seen_at = CURRENT_TIMESTAMP, ip = $2, expires_at = $3
+						   WHERE id = $1 AND revoked_at IS NULL`, sessionID, c.ClientIP(), time.Now().Add(config.JWT.RefreshTTL))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token rotation error"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session revoked"})
+		return
+	}
+
+	response, err := issueSessionTokens(user, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func logout(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	var req LogoutRequest
+	c.ShouldBindJSON(&req)
+
+	if err := revokeAccessToken(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Logout error"})
+		return
+	}
+	if user.SessionID != "" {
+		if _, err := revokeSession(user.UserID, user.SessionID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Logout error"})
+			return
+		}
+	}
+
+	if req.RefreshToken != "" {
+		db.Exec(`UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP 
+				 WHERE token_hash = $1 AND user_id = $2 AND revoked_at IS NULL`,
+			hashToken(req.RefreshToken), user.UserID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+func logoutAll(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	if err := revokeAllUserTokens(db, user.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Logout error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out from all devices"})
+}
+
+func getProfile(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	userDB, err := getUserByNumber(user.Number)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Remove password
+	userResponse := *userDB
+	userResponse.Password = ""
+
+	c.JSON(http.StatusOK, userResponse)
+}
+
+func isSupportedLanguage(lang string) bool {
+	return lang == "uz" || lang == "ru" || lang == "en"
+}
+
+func updateProfile(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	var req ProfileUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userDB, err := getUserByID(user.UserID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if req.FullName != nil {
+		name := strings.TrimSpace(*req.FullName)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Full name can't be empty"})
+			return
+		}
+		userDB.FullName = name
+	}
+	if req.Email != nil {
+		email := strings.TrimSpace(*req.Email)
+		if email == "" {
+			userDB.Email = nil
+		} else if !regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`).MatchString(email) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+			return
+		} else {
+			userDB.Email = &email
+		}
+	}
+	if req.Language != nil {
+		if !isSupportedLanguage(*req.Language) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported language"})
+			return
+		}
+		userDB.Language = *req.Language
+	}
+
+	query := `UPDATE users SET full_name = $2, email = $3, language = $4 WHERE id = $1`
+	if _, err := db.Exec(query, userDB.ID, userDB.FullName, userDB.Email, userDB.Language); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Profile update error"})
+		return
+	}
+
+	userDB.Password = ""
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Profile updated successfully",
+		"user":    userDB,
+	})
+}
+
+// changePassword signs out every other device and returns fresh tokens
+func changePassword(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	var req PasswordChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userDB, err := getUserByID(user.UserID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if ok, _ := verifyPassword(userDB.Password, req.CurrentPassword); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	passwordHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid password"})
+		return
+	}
+	if err := updateUserPassword(db, userDB.ID, passwordHash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password update error"})
+		return
+	}
+	if err := revokeAllUserTokens(db, userDB.ID); err != nil {
+		log.Printf("Token revocation error: %v", err)
+	}
+
+	// Reload to pick up the new token version
+	if userDB, err = getUserByID(user.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation error"})
+		return
+	}
+	response, err := issueTokens(c, userDB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation error"})
+		return
+	}
+	// The new session keeps the second factor of the one it replaces
+	if verified, err := sessionHasTwoFactor(user.SessionID); err != nil {
+		log.Printf("Session 2FA check error: %v", err)
+	} else if verified {
+		if err := markSessionTwoFactor(response.SessionID); err != nil {
+			log.Printf("Session 2FA mark error: %v", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Password changed successfully",
+		"tokens":  response,
+	})
+}
+
+func requestPhoneChange(c *gin.Context) {
+	var req PhoneChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !bindPhone(c, &req.NewNumber) {
+		return
+	}
+
+	if _, err := getUserByNumber(req.NewNumber); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Phone number already registered"})
+		return
+	}
+
+	wait, err := checkOTPRateLimit(req.NewNumber, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Verification error"})
+		return
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many code requests, try again later"})
+		return
+	}
+
+	if err := sendOTP(req.NewNumber, OTPPurposeChangePhone, c.ClientIP()); err != nil {
+		log.Printf("OTP send error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "SMS send error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Verification code sent to the new number",
+		"expires_in": OTP_TTL_MINUTES * 60,
+	})
+}
+
+// confirmPhoneChange moves the account and its order history to the new number
+func confirmPhoneChange(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	var req PhoneChangeConfirm
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !bindPhone(c, &req.NewNumber) {
+		return
+	}
+
+	if _, err := verifyOTP(req.NewNumber, OTPPurposeChangePhone, req.Code); err != nil {
+		respondOTPError(c, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Phone update error"})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET number = $2, phone_verified_at = CURRENT_TIMESTAMP WHERE id = $1`,
+		user.UserID, req.NewNumber)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Phone number already registered"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Phone update error"})
+		return
+	}
+	if _, err := tx.Exec(`UPDATE orders SET user_number = $2 WHERE user_number = $1`, user.Number, req.NewNumber); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Phone update error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Phone update error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Phone number changed successfully",
+		"number":  req.NewNumber,
+	})
+}
+
+// exportProfileData returns everything stored about the user as a JSON download
+func exportProfileData(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	userDB, err := getUserByID(user.UserID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	userDB.Password = ""
+
+	rows, err := db.Query(`SELECT order_id, user_number, user_name, foods, total_price, order_time, 
+						   delivery_type, delivery_info, status, payment_info, special_instructions, 
+						   estimated_time, delivered_at, status_history, created_at, updated_at
+						   FROM orders WHERE user_number = $1 ORDER BY order_time DESC`, userDB.Number)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	orders := scanOrders(rows)
+	rows.Close()
+
+	reviews := []Review{}
+	reviewRows, err := db.Query(`SELECT id, user_id, food_id, rating, comment, created_at, updated_at 
+								 FROM reviews WHERE user_id = $1 ORDER BY created_at DESC`, userDB.ID)
+	if err == nil {
+		for reviewRows.Next() {
+			var review Review
+			if err := reviewRows.Scan(&review.ID, &review.UserID, &review.FoodID, &review.Rating,
+				&review.Comment, &review.CreatedAt, &review.UpdatedAt); err == nil {
+				reviews = append(reviews, review)
+			}
+		}
+		reviewRows.Close()
+	}
+
+	addresses, err := getSavedAddresses(userDB.ID)
+	if err != nil {
+		addresses = []SavedAddress{}
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_export.json"`, userDB.ID))
+	c.JSON(http.StatusOK, gin.H{
+		"exported_at": time.Now(),
+		"profile":     userDB,
+		"orders":      orders,
+		"reviews":     reviews,
+		"addresses":   addresses,
+	})
+}
+
+// deleteAccount removes the user but keeps their orders for reporting,
+// with the name and phone number anonymized.
+func deleteAccount(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	var req AccountDeleteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userDB, err := getUserByID(user.UserID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if ok, _ := verifyPassword(userDB.Password, req.Password); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is incorrect"})
+		return
+	}
+	if isStaffRole(userDB.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Staff accounts must be removed by an administrator"})
+		return
+	}
+
+	anonymousNumber := "deleted_" + uuid.New().String()[:8]
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Account deletion error"})
+		return
+	}
+	defer tx.Rollback()
+
+	queries := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`UPDATE orders SET user_name = 'Deleted user', user_number = $2,
+		  delivery_info = delivery_info - 'phone' - 'address' - 'latitude' - 'longitude'
+		  - 'entrance' - 'floor' - 'apartment' - 'courier_notes' - 'address_label'
+		  WHERE user_number = $1`, []interface{}{userDB.Number, anonymousNumber}},
+		{`DELETE FROM phone_verifications WHERE phone = $1`, []interface{}{userDB.Number}},
+		{`DELETE FROM users WHERE id = $1`, []interface{}{userDB.ID}},
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(q.query, q.args...); err != nil {
+			log.Printf("Account deletion error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Account deletion error"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Account deletion error"})
+		return
+	}
+
+	log.Printf("Account deleted: %s", userDB.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted successfully"})
+}
+
+// ========== ADDRESS BOOK HANDLERS ==========
+
+const savedAddressColumns = `id, label, address, latitude, longitude, entrance, floor, apartment,
+	courier_notes, is_default, created_at, updated_at`
+
+func scanSavedAddress(row interface{ Scan(...interface{}) error }) (*SavedAddress, error) {
+	var address SavedAddress
+	err := row.Scan(&address.ID, &address.Label, &address.Address, &address.Latitude, &address.Longitude,
+		&address.Entrance, &address.Floor, &address.Apartment, &address.CourierNotes,
+		&address.IsDefault, &address.CreatedAt, &address.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+func getSavedAddress(userID, addressID string) (*SavedAddress, error) {
+	row := db.QueryRow(`SELECT `+savedAddressColumns+` FROM user_addresses WHERE id = $1 AND user_id = $2`,
+		addressID, userID)
+	return scanSavedAddress(row)
+}
+
+func getSavedAddresses(userID string) ([]SavedAddress, error) {
+	rows, err := db.Query(`SELECT `+savedAddressColumns+` FROM user_addresses
+						   WHERE user_id = $1 ORDER BY is_default DESC, created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := []SavedAddress{}
+	for rows.Next() {
+		address, err := scanSavedAddress(rows)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, *address)
+	}
+	return addresses, rows.Err()
+}
+
+// deliveryInfo returns the order delivery_info for a saved address
+func (a *SavedAddress) deliveryInfo() map[string]interface{} {
+	info := map[string]interface{}{
+		"type":          "delivery",
+		"address":       a.Address,
+		"address_id":    a.ID,
+		"address_label": a.Label,
+	}
+	if a.Latitude != nil && a.Longitude != nil {
+		info["latitude"] = *a.Latitude
+		info["longitude"] = *a.Longitude
+	}
+	for key, value := range map[string]*string{
+		"entrance":      a.Entrance,
+		"floor":         a.Floor,
+		"apartment":     a.Apartment,
+		"courier_notes": a.CourierNotes,
+	} {
+		if value != nil && *value != "" {
+			info[key] = *value
+		}
+	}
+	return info
+}
+
+func validateAddressRequest(req *AddressRequest) string {
+	req.Label = strings.TrimSpace(req.Label)
+	req.Address = strings.TrimSpace(req.Address)
+	if req.Label == "" || req.Address == "" {
+		return "Label and address are required"
+	}
+	if (req.Latitude == nil) != (req.Longitude == nil) {
+		return "Latitude and longitude must be given together"
+	}
+	if req.Latitude != nil && (*req.Latitude < -90 || *req.Latitude > 90 || *req.Longitude < -180 || *req.Longitude > 180) {
+		return "Invalid coordinates"
+	}
+	return ""
+}
+
+func getAddressesHandler(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	addresses, err := getSavedAddresses(user.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"addresses": addresses, "total": len(addresses)})
+}
+
+func createAddressHandler(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+
+	var req AddressRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if problem := validateAddressRequest(&req); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Address creation error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Serializes concurrent inserts for the same user so the limit holds
+	if _, err := tx.Exec(`SELECT id FROM users WHERE id = $1 FOR UPDATE`, user.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Address creation error"})
+		return
+	}
+
+	var count int
+	tx.QueryRow(`SELECT COUNT(*) FROM user_addresses WHERE user_id = $1`, user.UserID).Scan(&count)
+	if count >= MAX_SAVED_ADDRESSES {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d addresses can be saved", MAX_SAVED_ADDRESSES)})
+		return
+	}
+
+	// The first address becomes the default one
+	isDefault := req.IsDefault || count == 0
+	if isDefault {
+		if _, err := tx.Exec(`UPDATE user_addresses SET is_default = false WHERE user_id = $1`, user.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Address creation error"})
+			return
+		}
+	}
+
+	addressID := generateID("addr")
+	_, err = tx.Exec(`INSERT INTO user_addresses (id, user_id, label, address, latitude, longitude, entrance,
+					  floor, apartment, courier_notes, is_default)
+					  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		addressID, user.UserID, req.Label, req.Address, req.Latitude, req.Longitude, req.Entrance,
+		req.Floor, req.Apartment, req.CourierNotes, isDefault)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Address creation error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Address creation error"})
+		return
+	}
+
+	address, err := getSavedAddress(user.UserID, addressID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Address saved successfully",
+		"address": address,
+	})
+}
+
+func updateAddressHandler(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+	addressID := c.Param("address_id")
+
+	var req AddressRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if problem := validateAddressRequest(&req); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Address update error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if req.IsDefault {
+		if _, err := tx.Exec(`UPDATE user_addresses SET is_default = false WHERE user_id = $1 AND id <> $2`,
+			user.UserID, addressID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Address update error"})
+			return
+		}
+	}
+
+	// Unsetting is_default keeps the current flag, another address has to be made default instead
+	result, err := tx.Exec(`UPDATE user_addresses SET label = $3, address = $4, latitude = $5, longitude = $6,
+							entrance = $7, floor = $8, apartment = $9, courier_notes = $10,
+							is_default = is_default OR $11, updated_at = CURRENT_TIMESTAMP
+							WHERE id = $1 AND user_id = $2`,
+		addressID, user.UserID, req.Label, req.Address, req.Latitude, req.Longitude,
+		req.Entrance, req.Floor, req.Apartment, req.CourierNotes, req.IsDefault)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Address update error"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Address update error"})
+		return
+	}
+
+	address, err := getSavedAddress(user.UserID, addressID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Address updated successfully",
+		"address": address,
+	})
+}
+
+func deleteAddressHandler(c *gin.Context) {
+	user := c.MustGet("user").(*Claims)
+	addressID := c.Param("address_id")
+
+	var wasDefault bool
+	err := db.QueryRow(`DELETE FROM user_addresses WHERE id = $1 AND user_id = $2 RETURNING is_default`,
+		addressID, user.UserID).Scan(&wasDefault)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Address deletion error"})
+		return
+	}
+
+	// Promote the oldest remaining address
+	if wasDefault {
+		db.Exec(`UPDATE user_addresses SET is_default = true
+				 WHERE id = (SELECT id FROM user_addresses WHERE user_id = $1 ORDER BY created_at LIMIT 1)`, user.UserID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Address deleted successfully"})
+}
+
+// ========== CATEGORY HANDLERS ==========
+
+const CATEGORY_CACHE_TTL = 30 * time.Second
+
+var categoryCache = struct {
+	sync.RWMutex
+	categories map[string]*Category
+	loadedAt   time.Time
+}{}
+
+var categoryKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,99}$`)
+
+// seedCategories fills an empty table with the default categories and
+// registers any category foods already use, so validation doesn't reject
+// existing menu items
+func seedCategories() error {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM categories`).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		for i, key := range []string{"shashlik", "milliy_taomlar", "ichimliklar", "salatlar", "shirinliklar"} {
+			names := make(map[string]string)
+			for lang, translations := range FOOD_TRANSLATIONS {
+				names[lang] = translations[key]
+			}
+			namesJSON, _ := json.Marshal(names)
+			if _, err := db.Exec(`INSERT INTO categories (key, names, sort_order) VALUES ($1, $2, $3)
+								  ON CONFLICT (key) DO NOTHING`, key, namesJSON, (i+1)*10); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := db.Exec(`INSERT INTO categories (key, names, sort_order)
+					   SELECT DISTINCT category, jsonb_build_object('uz', category), 1000 FROM foods
+					   ON CONFLICT (key) DO NOTHING`)
+	return err
+}
+
+func loadCategories() (map[string]*Category, error) {
+	rows, err := db.Query(`SELECT key, names, sort_order, COALESCE(icon_url, ''), is_active, parent_key,
+						   created_at, updated_at FROM categories`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := make(map[string]*Category)
+	for rows.Next() {
+		var category Category
+		var namesJSON []byte
+		var parentKey sql.NullString
+		if err := rows.Scan(&category.Key, &namesJSON, &category.SortOrder, &category.IconURL,
+			&category.IsActive, &parentKey, &category.CreatedAt, &category.UpdatedAt); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(namesJSON, &category.Names)
+		if parentKey.Valid {
+			category.ParentKey = &parentKey.String
+		}
+		categories[category.Key] = &category
+	}
+	return categories, rows.Err()
+}
+
+// cachedCategories is short-lived, and dropped on every instance right
+// away on edits
+func cachedCategories() map[string]*Category {
+	categoryCache.RLock()
+	categories, fresh := categoryCache.categories, time.Since(categoryCache.loadedAt) < CATEGORY_CACHE_TTL
+	categoryCache.RUnlock()
+
+	if categories == nil || !fresh {
+		loaded, err := loadCategories()
+		if err != nil {
+			log.Printf("Categories load error: %v", err)
+		} else {
+			categoryCache.Lock()
+			categoryCache.categories = loaded
+			categoryCache.loadedAt = time.Now()
+			categoryCache.Unlock()
+			categories = loaded
+		}
+	}
+	return categories
+}
+
+func invalidateCategoryCache() {
+	publishCacheInvalidation("categories")
+}
+
+func clearCategoryCache() {
+	categoryCache.Lock()
+	categoryCache.loadedAt = time.Time{}
+	categoryCache.Unlock()
+}
+
+func categoryExists(key string) bool {
+	_, exists := cachedCategories()[key]
+	return exists
+}
+
+// unknownCategoryKeys remembers the unknown keys already logged
+var unknownCategoryKeys sync.Map
+
+// categoryIsActive also hides the subcategories of an inactive category.
+// Foods pointing at an unknown category are hidden until an admin fixes them.
+func categoryIsActive(key string) bool {
+	categories := cachedCategories()
+	if categories == nil {
+		// Not loaded even once (a failed load keeps the last good map): every
+		// key would look unknown and the whole menu would disappear, so don't
+		// hide anything until the next load works
+		return true
+	}
+	for depth := 0; depth < len(categories); depth++ {
+		category, exists := categories[key]
+		if !exists {
+			break
+		}
+		if !category.IsActive {
+			return false
+		}
+		if category.ParentKey == nil {
+			return true
+		}
+		key = *category.ParentKey
+	}
+	if _, logged := unknownCategoryKeys.LoadOrStore(key, true); !logged {
+		log.Printf("⚠️ Unknown category %q treated as inactive", key)
+	}
+	return false
+}
+
+func localizedName(names map[string]string, lang, fallback string) string {
+	if name, exists := names[lang]; exists && name != "" {
+		return name
+	}
+	if name, exists := names["uz"]; exists && name != "" {
+		return name
+	}
+	return fallback
+}
+
+func getCategoryName(key, lang string) string {
+	if category, exists := cachedCategories()[key]; exists {
+		return localizedName(category.Names, lang, key)
+	}
+	return key
+}
+
+func validateLocalizedNames(names map[string]string) string {
+	if strings.TrimSpace(names["uz"]) == "" {
+		return "Uzbek name is required"
+	}
+	for lang := range names {
+		if !isSupportedLanguage(lang) {
+			return fmt.Sprintf("Unsupported language: %s", lang)
+		}
+	}
+	return ""
+}
+
+// validateCategoryParent rejects unknown parents and cycles
+func validateCategoryParent(key, parentKey string) string {
+	categories := cachedCategories()
+	for current := parentKey; current != ""; {
+		if current == key {
+			return "A category can't be its own ancestor"
+		}
+		parent, exists := categories[current]
+		if !exists {
+			return "Parent category not found"
+		}
+		if parent.ParentKey == nil {
+			break
+		}
+		current = *parent.ParentKey
+	}
+	return ""
+}
+
+// sortedCategories returns the categories in menu order
+func sortedCategories(includeInactive bool) []*Category {
+	categories := []*Category{}
+	for _, category := range cachedCategories() {
+		if includeInactive || categoryIsActive(category.Key) {
+			copied := *category
+			categories = append(categories, &copied)
+		}
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].SortOrder != categories[j].SortOrder {
+			return categories[i].SortOrder < categories[j].SortOrder
+		}
+		return categories[i].Key < categories[j].Key
+	})
+	return categories
+}
+
+// getCategories lists active categories; ?tree=true nests subcategories
+// under their parent
+func getCategories(c *gin.Context) {
+	lang := getUserLanguage(c.Request.Header)
+	hostURL := getHostURL(c)
+
+	categories := sortedCategories(false)
+	for _, category := range categories {
+		category.Name = localizedName(category.Names, lang, category.Key)
+		category.Names = nil
+		if category.IconURL != "" && !strings.HasPrefix(category.IconURL, "http") {
+			category.IconURL = hostURL + category.IconURL
+		}
+	}
+
+	if c.Query("tree") != "true" {
+		c.JSON(http.StatusOK, categories)
+		return
+	}
+
+	byKey := make(map[string]*Category)
+	for _, category := range categories {
+		byKey[category.Key] = category
+	}
+	roots := []*Category{}
+	for _, category := range categories {
+		if category.ParentKey != nil {
+			if parent, exists := byKey[*category.ParentKey]; exists {
+				parent.Children = append(parent.Children, category)
+				continue
+			}
+		}
+		roots = append(roots, category)
+	}
+	c.JSON(http.StatusOK, roots)
+}
+
+func getAdminCategoriesHandler(c *gin.Context) {
+	counts := make(map[string]int)
+	rows, err := db.Query(`SELECT category, COUNT(*) FROM foods GROUP BY category`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	for rows.Next() {
+		var key string
+		var count int
+		if rows.Scan(&key, &count) == nil {
+			counts[key] = count
+		}
+	}
+	rows.Close()
+
+	categories := []gin.H{}
+	for _, category := range sortedCategories(true) {
+		categories = append(categories, gin.H{
+			"key":        category.Key,
+			"names":      category.Names,
+			"sort_order": category.SortOrder,
+			"icon_url":   category.IconURL,
+			"is_active":  category.IsActive,
+			"parent_key": category.ParentKey,
+			"food_count": counts[category.Key],
+			"created_at": category.CreatedAt,
+			"updated_at": category.UpdatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"categories": categories, "total": len(categories)})
+}
+
+func createCategoryHandler(c *gin.Context) {
+	var req CategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req.Key = strings.ToLower(strings.TrimSpace(req.Key))
+	if !categoryKeyPattern.MatchString(req.Key) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category key"})
+		return
+	}
+	if problem := validateLocalizedNames(req.Names); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+	if req.ParentKey != nil && *req.ParentKey == "" {
+		req.ParentKey = nil
+	}
+	if req.ParentKey != nil {
+		if problem := validateCategoryParent(req.Key, *req.ParentKey); problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+			return
+		}
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	namesJSON, _ := json.Marshal(req.Names)
+	_, err := db.Exec(`INSERT INTO categories (key, names, sort_order, icon_url, is_active, parent_key)
+					   VALUES ($1, $2, $3, $4, $5, $6)`,
+		req.Key, namesJSON, req.SortOrder, req.IconURL, isActive, req.ParentKey)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Category already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Category creation error"})
+		return
+	}
+	invalidateCategoryCache()
+	recordAudit(c, "category.create", "category", req.Key, req)
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Category created successfully", "key": req.Key})
+}
+
+func updateCategoryHandler(c *gin.Context) {
+	key := c.Param("key")
+
+	var req CategoryUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !categoryExists(key) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+	if req.Names != nil {
+		if problem := validateLocalizedNames(req.Names); problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+			return
+		}
+	}
+	if req.ParentKey != nil && *req.ParentKey != "" {
+		if problem := validateCategoryParent(key, *req.ParentKey); problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+			return
+		}
+	}
+
+	sets := []string{"updated_at = CURRENT_TIMESTAMP"}
+	args := []interface{}{key}
+	addSet := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	if req.Names != nil {
+		namesJSON, _ := json.Marshal(req.Names)
+		addSet("names", namesJSON)
+	}
+	if req.SortOrder != nil {
+		addSet("sort_order", *req.SortOrder)
+	}
+	if req.IconURL != nil {
+		addSet("icon_url", *req.IconURL)
+	}
+	if req.IsActive != nil {
+		addSet("is_active", *req.IsActive)
+	}
+	if req.ParentKey != nil {
+		var parent interface{}
+		if *req.ParentKey != "" {
+			parent = *req.ParentKey
+		}
+		addSet("parent_key", parent)
+	}
+
+	if _, err := db.Exec(`UPDATE categories SET `+strings.Join(sets, ", ")+` WHERE key = $1`, args...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Category update error"})
+		return
+	}
+	invalidateCategoryCache()
+	recordAudit(c, "category.update", "category", key, req)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Category updated successfully"})
+}
+
+// deleteCategoryHandler only removes empty categories; foods and
+// subcategories have to be moved first (or the category deactivated)
+func deleteCategoryHandler(c *gin.Context) {
+	key := c.Param("key")
+
+	if !categoryExists(key) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+
+	var foods, children int
+	db.QueryRow(`SELECT COUNT(*) FROM foods WHERE category = $1`, key).Scan(&foods)
+	db.QueryRow(`SELECT COUNT(*) FROM categories WHERE parent_key = $1`, key).Scan(&children)
+	if foods > 0 || children > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":         "Category is not empty",
+			"foods":         foods,
+			"subcategories": children,
+		})
+		return
+	}
+
+	if _, err := db.Exec(`DELETE FROM categories WHERE key = $1`, key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Category deletion error"})
+		return
+	}
+	invalidateCategoryCache()
+	recordAudit(c, "category.delete", "category", key, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Category deleted successfully"})
+}
+
+// ========== FOOD MODIFIER HANDLERS ==========
+
+// loadModifierGroups returns the modifier groups of the given foods with
+// all their options, in menu order
+func loadModifierGroups(foodIDs []int64) (map[int64][]*ModifierGroup, error) {
+	groups := make(map[int64][]*ModifierGroup)
+	if len(foodIDs) == 0 {
+		return groups, nil
+	}
+
+	rows, err := db.Query(`SELECT id, food_id, names, min_select, max_select, sort_order
+						   FROM modifier_groups WHERE food_id = ANY($1)
+						   ORDER BY sort_order, created_at`, pq.Array(foodIDs))
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*ModifierGroup)
+	groupIDs := []string{}
+	for rows.Next() {
+		var group ModifierGroup
+		var namesJSON []byte
+		if err := rows.Scan(&group.ID, &group.FoodID, &namesJSON, &group.MinSelect,
+			&group.MaxSelect, &group.SortOrder); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		json.Unmarshal(namesJSON, &group.Names)
+		group.Options = []*ModifierOption{}
+		groups[group.FoodID] = append(groups[group.FoodID], &group)
+		byID[group.ID] = &group
+		groupIDs = append(groupIDs, group.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(groupIDs) == 0 {
+		return groups, nil
+	}
+
+	rows, err = db.Query(`SELECT id, group_id, names, price_delta, is_available, sort_order
+						  FROM modifier_options WHERE group_id = ANY($1)
+						  ORDER BY sort_order, created_at`, pq.Array(groupIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var option ModifierOption
+		var namesJSON []byte
+		if err := rows.Scan(&option.ID, &option.GroupID, &namesJSON, &option.PriceDelta,
+			&option.IsAvailable, &option.SortOrder); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(namesJSON, &option.Names)
+		if group, exists := byID[option.GroupID]; exists {
+			group.Options = append(group.Options, &option)
+		}
+	}
+	return groups, rows.Err()
+}
+
+// attachModifiers fills Food.Modifiers with localized names. Customers
+// don't see options that are switched off.
+func attachModifiers(foods []*Food, lang string, includeUnavailable bool) error {
+	foodIDs := make([]int64, 0, len(foods))
+	for _, food := range foods {
+		foodIDs = append(foodIDs, food.ID)
+	}
+	groups, err := loadModifierGroups(foodIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, food := range foods {
+		food.Modifiers = nil
+		for _, group := range groups[food.ID] {
+			group.Name = localizedName(group.Names, lang, group.ID)
+			options := []*ModifierOption{}
+			for _, option := range group.Options {
+				if !option.IsAvailable && !includeUnavailable {
+					continue
+				}
+				option.Name = localizedName(option.Names, lang, option.ID)
+				options = append(options, option)
+			}
+			group.Options = options
+			food.Modifiers = append(food.Modifiers, group)
+		}
+	}
+	return nil
+}
+
+// resolveModifierSelection checks the options chosen for a cart item
+// against the food's groups and returns them as order snapshots. A
+// non-nil gin.H is a client error to send back as is.
+func resolveModifierSelection(foodID int64, optionIDs []string, lang string) ([]OrderFoodOption, gin.H, error) {
+	groupsByFood, err := loadModifierGroups([]int64{foodID})
+	if err != nil {
+		return nil, nil, err
+	}
+	groups := groupsByFood[foodID]
+
+	chosen := make(map[string]bool)
+	for _, id := range optionIDs {
+		if chosen[id] {
+			return nil, gin.H{"error": "Option selected twice", "option_id": id}, nil
+		}
+		chosen[id] = true
+	}
+
+	var selected []OrderFoodOption
+	for _, group := range groups {
+		count := 0
+		for _, option := range group.Options {
+			if !chosen[option.ID] {
+				continue
+			}
+			if !option.IsAvailable {
+				return nil, gin.H{"error": "Option not available", "option_id": option.ID}, nil
+			}
+			delete(chosen, option.ID)
+			count++
+			selected = append(selected, OrderFoodOption{
+				ID:         option.ID,
+				GroupID:    group.ID,
+				GroupName:  localizedName(group.Names, lang, group.ID),
+				Name:       localizedName(option.Names, lang, option.ID),
+				PriceDelta: option.PriceDelta,
+			})
+		}
+		if count < group.MinSelect || count > group.MaxSelect {
+			return nil, gin.H{
+				"error":      "Invalid option selection",
+				"group_id":   group.ID,
+				"min_select": group.MinSelect,
+				"max_select": group.MaxSelect,
+				"selected":   count,
+			}, nil
+		}
+	}
+
+	// Anything left over belongs to another food or doesn't exist
+	for id := range chosen {
+		return nil, gin.H{"error": "Unknown option", "option_id": id}, nil
+	}
+	return selected, nil, nil
+}
+
+func getModifierGroup(groupID string) (*ModifierGroup, error) {
+	var group ModifierGroup
+	var namesJSON []byte
+	err := db.QueryRow(`SELECT id, food_id, names, min_select, max_select, sort_order
+						FROM modifier_groups WHERE id = $1`, groupID).Scan(
+		&group.ID, &group.FoodID, &namesJSON, &group.MinSelect, &group.MaxSelect, &group.SortOrder)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(namesJSON, &group.Names)
+	return &group, nil
+}
+
+func parseFoodIDParam(c *gin.Context) (int64, bool) {
+	foodID, err := strconv.ParseInt(c.Param("food_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
+		return 0, false
+	}
+	if _, err := getFoodByID(foodID); err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
+		return 0, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return 0, false
+	}
+	return foodID, true
+}
+
+func getFoodModifiersHandler(c *gin.Context) {
+	foodID, ok := parseFoodIDParam(c)
+	if !ok {
+		return
+	}
+
+	groups, err := loadModifierGroups([]int64{foodID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	lang := getUserLanguage(c.Request.Header)
+	items := []*ModifierGroup{}
+	for _, group := range groups[foodID] {
+		group.Name = localizedName(group.Names, lang, group.ID)
+		for _, option := range group.Options {
+			option.Name = localizedName(option.Names, lang, option.ID)
+		}
+		items = append(items, group)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": items, "total": len(items)})
+}
+
+// createModifierGroupHandler creates a group together with its options
+func createModifierGroupHandler(c *gin.Context) {
+	foodID, ok := parseFoodIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req ModifierGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if problem := validateLocalizedNames(req.Names); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+	if req.MinSelect > req.MaxSelect {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "min_select can't exceed max_select"})
+		return
+	}
+	available := 0
+	for i, option := range req.Options {
+		if problem := validateLocalizedNames(option.Names); problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": problem, "option": i})
+			return
+		}
+		if option.IsAvailable == nil || *option.IsAvailable {
+			available++
+		}
+	}
+	// A required group needs its options up front, or the food can't be ordered
+	if req.MinSelect > available {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "min_select exceeds the number of available options"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	groupID := generateID("mgrp")
+	namesJSON, _ := json.Marshal(req.Names)
+	if _, err := tx.Exec(`INSERT INTO modifier_groups (id, food_id, names, min_select, max_select, sort_order)
+						  VALUES ($1, $2, $3, $4, $5, $6)`,
+		groupID, foodID, namesJSON, req.MinSelect, req.MaxSelect, req.SortOrder); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier group creation error"})
+		return
+	}
+
+	optionIDs := []string{}
+	for _, option := range req.Options {
+		optionID, err := insertModifierOption(tx, groupID, option)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier option creation error"})
+			return
+		}
+		optionIDs = append(optionIDs, optionID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	recordAudit(c, "modifier_group.create", "food", strconv.FormatInt(foodID, 10), gin.H{"group_id": groupID, "request": req})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":    "Modifier group created successfully",
+		"group_id":   groupID,
+		"option_ids": optionIDs,
+	})
+}
+
+// checkModifierGroupSelectable locks the group and makes sure min_select can
+// still be met with its available options, including when it has none.
+func checkModifierGroupSelectable(tx *sql.Tx, groupID string) (gin.H, error) {
+	var minSelect, available int
+	if err := tx.QueryRow(`SELECT min_select FROM modifier_groups WHERE id = $1 FOR UPDATE`, groupID).Scan(&minSelect); err != nil {
+		return nil, err
+	}
+	err := tx.QueryRow(`SELECT COUNT(*) FROM modifier_options WHERE group_id = $1 AND is_available`,
+		groupID).Scan(&available)
+	if err != nil {
+		return nil, err
+	}
+	if minSelect > available {
+		return gin.H{
+			"error":             "min_select exceeds the number of available options",
+			"group_id":          groupID,
+			"min_select":        minSelect,
+			"available_options": available,
+		}, nil
+	}
+	return nil, nil
+}
+
+func insertModifierOption(tx *sql.Tx, groupID string, req ModifierOptionRequest) (string, error) {
+	isAvailable := true
+	if req.IsAvailable != nil {
+		isAvailable = *req.IsAvailable
+	}
+	optionID := generateID("mopt")
+	namesJSON, _ := json.Marshal(req.Names)
+	_, err := tx.Exec(`INSERT INTO modifier_options (id, group_id, names, price_delta, is_available, sort_order)
+					   VALUES ($1, $2, $3, $4, $5, $6)`,
+		optionID, groupID, namesJSON, req.PriceDelta, isAvailable, req.SortOrder)
+	return optionID, err
+}
+
+func updateModifierGroupHandler(c *gin.Context) {
+	groupID := c.Param("group_id")
+
+	var req ModifierGroupUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	group, err := getModifierGroup(groupID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modifier group not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	if req.Names != nil {
+		if problem := validateLocalizedNames(req.Names); problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+			return
+		}
+		group.Names = req.Names
+	}
+	if req.MinSelect != nil {
+		group.MinSelect = *req.MinSelect
+	}
+	if req.MaxSelect != nil {
+		group.MaxSelect = *req.MaxSelect
+	}
+	if req.SortOrder != nil {
+		group.SortOrder = *req.SortOrder
+	}
+	if group.MinSelect > group.MaxSelect {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "min_select can't exceed max_select"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	namesJSON, _ := json.Marshal(group.Names)
+	_, err = tx.Exec(`UPDATE modifier_groups SET names = $2, min_select = $3, max_select = $4, sort_order = $5,
+					  updated_at = CURRENT_TIMESTAMP WHERE id = $1`,
+		groupID, namesJSON, group.MinSelect, group.MaxSelect, group.SortOrder)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier group update error"})
+		return
+	}
+	if req.MinSelect != nil {
+		problem, err := checkModifierGroupSelectable(tx, groupID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier group update error"})
+			return
+		}
+		if problem != nil {
+			c.JSON(http.StatusBadRequest, problem)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier group update error"})
+		return
+	}
+	recordAudit(c, "modifier_group.update", "food", strconv.FormatInt(group.FoodID, 10), gin.H{"group_id": groupID, "request": req})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Modifier group updated successfully"})
+}
+
+// deleteModifierGroupHandler removes the group and its options. Past
+// orders keep their own copy of the chosen options.
+func deleteModifierGroupHandler(c *gin.Context) {
+	groupID := c.Param("group_id")
+
+	group, err := getModifierGroup(groupID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modifier group not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	if _, err := db.Exec(`DELETE FROM modifier_groups WHERE id = $1`, groupID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier group deletion error"})
+		return
+	}
+	recordAudit(c, "modifier_group.delete", "food", strconv.FormatInt(group.FoodID, 10), gin.H{"group_id": groupID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Modifier group deleted successfully"})
+}
+
+func createModifierOptionHandler(c *gin.Context) {
+	groupID := c.Param("group_id")
+
+	var req ModifierOptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if problem := validateLocalizedNames(req.Names); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	group, err := getModifierGroup(groupID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modifier group not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	optionID, err := insertModifierOption(tx, groupID, req)
+	if err != nil || tx.Commit() != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier option creation error"})
+		return
+	}
+	recordAudit(c, "modifier_option.create", "food", strconv.FormatInt(group.FoodID, 10), gin.H{"option_id": optionID, "request": req})
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Modifier option created successfully", "option_id": optionID})
+}
+
+func updateModifierOptionHandler(c *gin.Context) {
+	optionID := c.Param("option_id")
+
+	var req ModifierOptionUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Names != nil {
+		if problem := validateLocalizedNames(req.Names); problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+			return
+		}
+	}
+
+	sets := []string{"updated_at = CURRENT_TIMESTAMP"}
+	args := []interface{}{optionID}
+	addSet := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	if req.Names != nil {
+		namesJSON, _ := json.Marshal(req.Names)
+		addSet("names", namesJSON)
+	}
+	if req.PriceDelta != nil {
+		addSet("price_delta", *req.PriceDelta)
+	}
+	if req.IsAvailable != nil {
+		addSet("is_available", *req.IsAvailable)
+	}
+	if req.SortOrder != nil {
+		addSet("sort_order", *req.SortOrder)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var groupID string
+	var foodID int64
+	err = tx.QueryRow(`UPDATE modifier_options o SET `+strings.Join(sets, ", ")+`
+					   FROM modifier_groups g WHERE o.id = $1 AND g.id = o.group_id
+					   RETURNING g.id, g.food_id`, args...).Scan(&groupID, &foodID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modifier option not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier option update error"})
+		return
+	}
+	// Switching an option off must leave enough to meet min_select
+	if req.IsAvailable != nil && !*req.IsAvailable {
+		problem, err := checkModifierGroupSelectable(tx, groupID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier option update error"})
+			return
+		}
+		if problem != nil {
+			c.JSON(http.StatusBadRequest, problem)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier option update error"})
+		return
+	}
+	recordAudit(c, "modifier_option.update", "food", strconv.FormatInt(foodID, 10), gin.H{"option_id": optionID, "request": req})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Modifier option updated successfully"})
+}
+
+func deleteModifierOptionHandler(c *gin.Context) {
+	optionID := c.Param("option_id")
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var groupID string
+	var foodID int64
+	err = tx.QueryRow(`DELETE FROM modifier_options o USING modifier_groups g
+					   WHERE o.id = $1 AND g.id = o.group_id RETURNING g.id, g.food_id`, optionID).Scan(&groupID, &foodID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modifier option not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier option deletion error"})
+		return
+	}
+	problem, err := checkModifierGroupSelectable(tx, groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier option deletion error"})
+		return
+	}
+	if problem != nil {
+		c.JSON(http.StatusBadRequest, problem)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier option deletion error"})
+		return
+	}
+	recordAudit(c, "modifier_option.delete", "food", strconv.FormatInt(foodID, 10), gin.H{"option_id": optionID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Modifier option deleted successfully"})
+}
+
+// ========== COMBO HANDLERS ==========
+
+// A combo is a regular food (own names, price, category and stock cap)
+// with slots. A slot with one choice is a fixed component; a slot with
+// several ("any drink") is picked by the customer via combo_choices.
+
+// loadComboSlots returns the slots of the given combos with their
+// choices, including each component's current availability
+func loadComboSlots(foodIDs []int64) (map[int64][]*ComboSlot, error) {
+	slots := make(map[int64][]*ComboSlot)
+	if len(foodIDs) == 0 {
+		return slots, nil
+	}
+
+	rows, err := db.Query(`SELECT id, combo_id, names, quantity, sort_order FROM combo_slots
+						   WHERE combo_id = ANY($1) ORDER BY sort_order, created_at`, pq.Array(foodIDs))
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*ComboSlot)
+	slotIDs := []string{}
+	for rows.Next() {
+		var slot ComboSlot
+		var namesJSON []byte
+		if err := rows.Scan(&slot.ID, &slot.ComboID, &namesJSON, &slot.Quantity, &slot.SortOrder); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		json.Unmarshal(namesJSON, &slot.Names)
+		slot.Choices = []*ComboChoice{}
+		slots[slot.ComboID] = append(slots[slot.ComboID], &slot)
+		byID[slot.ID] = &slot
+		slotIDs = append(slotIDs, slot.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(slotIDs) == 0 {
+		return slots, nil
+	}
+
+	rows, err = db.Query(`SELECT sc.slot_id, sc.food_id, sc.price_delta, f.names, f.name, f.category,
+						  f.is_there, f.stock, f.preparation_time
+						  FROM combo_slot_choices sc JOIN foods f ON f.id = sc.food_id
+						  WHERE sc.slot_id = ANY($1) AND f.deleted_at IS NULL ORDER BY sc.sort_order, f.id`, pq.Array(slotIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var choice ComboChoice
+		var slotID string
+		var namesJSON []byte
+		if err := rows.Scan(&slotID, &choice.FoodID, &choice.PriceDelta, &namesJSON, &choice.fallbackName,
+			&choice.category, &choice.isThere, &choice.stock, &choice.prepTime); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(namesJSON, &choice.names)
+		if slot, exists := byID[slotID]; exists {
+			choice.IsAvailable = choice.isThere && choice.stock >= slot.Quantity && categoryIsActive(choice.category) &&
+				foodScheduledAt(choice.FoodID, choice.category, restaurantNow())
+			slot.Choices = append(slot.Choices, &choice)
+		}
+	}
+	return slots, rows.Err()
+}
+
+// attachComboComponents fills Food.Components for combos. With
+// hideUnavailable, choices that can't be ordered are dropped and so are
+// combos left with an empty slot.
+func attachComboComponents(foods []*Food, lang string, hideUnavailable bool) ([]*Food, error) {
+	foodIDs := make([]int64, 0, len(foods))
+	for _, food := range foods {
+		foodIDs = append(foodIDs, food.ID)
+	}
+	slots, err := loadComboSlots(foodIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Food, 0, len(foods))
+	for _, food := range foods {
+		food.Components = nil
+		orderable := true
+		for _, slot := range slots[food.ID] {
+			slot.Name = localizedName(slot.Names, lang, slot.ID)
+			choices := []*ComboChoice{}
+			for _, choice := range slot.Choices {
+				if hideUnavailable && !choice.IsAvailable {
+					continue
+				}
+				choice.Name = localizedName(choice.names, lang, choice.fallbackName)
+				choices = append(choices, choice)
+			}
+			if len(choices) == 0 {
+				orderable = false
+			}
+			slot.Choices = choices
+			food.Components = append(food.Components, slot)
+		}
+		if hideUnavailable && !orderable {
+			continue
+		}
+		result = append(result, food)
+	}
+	return result, nil
+}
+
+// comboSelection is what a combo cart item adds on top of the combo
+// itself: the picked components, the stock they take and their price
+type comboSelection struct {
+	Components []OrderFoodComponent
+	Stock      map[int64]int
+	PriceDelta int
+	PrepTime   int
+}
+
+// resolveComboSelection picks the component for every slot of a combo
+// cart item. It returns nil for foods that aren't combos; a non-nil gin.H
+// is a client error to send back as is.
+func resolveComboSelection(foodID int64, item CartItem, lang string) (*comboSelection, gin.H, error) {
+	slotsByCombo, err := loadComboSlots([]int64{foodID})
+	if err != nil {
+		return nil, nil, err
+	}
+	slots := slotsByCombo[foodID]
+	if len(slots) == 0 {
+		if len(item.ComboChoices) > 0 {
+			return nil, gin.H{"error": "Food is not a combo"}, nil
+		}
+		return nil, nil, nil
+	}
+
+	selection := &comboSelection{Stock: make(map[int64]int)}
+	known := make(map[string]bool)
+	for _, slot := range slots {
+		known[slot.ID] = true
+
+		var picked *ComboChoice
+		if chosenID, ok := item.ComboChoices[slot.ID]; ok {
+			for _, choice := range slot.Choices {
+				if choice.FoodID == chosenID {
+					picked = choice
+				}
+			}
+			if picked == nil {
+				return nil, gin.H{"error": "Invalid combo choice", "slot_id": slot.ID, "choice": chosenID}, nil
+			}
+		} else if len(slot.Choices) == 1 {
+			picked = slot.Choices[0]
+		} else {
+			return nil, gin.H{"error": "Combo choice required", "slot_id": slot.ID}, nil
+		}
+
+		if !picked.isThere || !categoryIsActive(picked.category) ||
+			!foodScheduledAt(picked.FoodID, picked.category, restaurantNow()) {
+			return nil, gin.H{"error": "Combo component not available", "slot_id": slot.ID, "component_id": picked.FoodID}, nil
+		}
+
+		quantity := slot.Quantity * item.Quantity
+		selection.Stock[picked.FoodID] += quantity
+		if picked.stock < selection.Stock[picked.FoodID] {
+			return nil, gin.H{
+				"error":        "Insufficient stock",
+				"component_id": picked.FoodID,
+				"required":     selection.Stock[picked.FoodID],
+				"available":    picked.stock,
+			}, nil
+		}
+
+		selection.PriceDelta += picked.PriceDelta
+		if picked.prepTime > selection.PrepTime {
+			selection.PrepTime = picked.prepTime
+		}
+		selection.Components = append(selection.Components, OrderFoodComponent{
+			FoodID:     picked.FoodID,
+			SlotID:     slot.ID,
+			SlotName:   localizedName(slot.Names, lang, slot.ID),
+			Name:       localizedName(picked.names, lang, picked.fallbackName),
+			Quantity:   slot.Quantity,
+			PriceDelta: picked.PriceDelta,
+		})
+	}
+
+	for slotID := range item.ComboChoices {
+		if !known[slotID] {
+			return nil, gin.H{"error": "Unknown combo slot", "slot_id": slotID}, nil
+		}
+	}
+	return selection, nil, nil
+}
+
+func getComboHandler(c *gin.Context) {
+	foodID, ok := parseFoodIDParam(c)
+	if !ok {
+		return
+	}
+
+	food := &Food{ID: foodID}
+	if _, err := attachComboComponents([]*Food{food}, getUserLanguage(c.Request.Header), false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	slots := food.Components
+	if slots == nil {
+		slots = []*ComboSlot{}
+	}
+	c.JSON(http.StatusOK, gin.H{"food_id": foodID, "slots": slots, "total": len(slots)})
+}
+
+// setComboHandler replaces the combo definition of a food. Slots sent with
+// their id keep it, so carts built against the old definition still work.
+func setComboHandler(c *gin.Context) {
+	foodID, ok := parseFoodIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req ComboRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Combos don't nest: a component can't be a combo, and a food used
+	// as a component can't become one
+	var usedAsComponent bool
+	db.QueryRow(`SELECT EXISTS(SELECT 1 FROM combo_slot_choices WHERE food_id = $1)`, foodID).Scan(&usedAsComponent)
+	if usedAsComponent {
+		c.JSON(http.StatusConflict, gin.H{"error": "Food is a component of another combo"})
+		return
+	}
+
+	componentIDs := []int64{}
+	for i, slot := range req.Slots {
+		if problem := validateLocalizedNames(slot.Names); problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": problem, "slot": i})
+			return
+		}
+		seen := make(map[int64]bool)
+		for _, choice := range slot.Choices {
+			if choice.FoodID == foodID {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "A combo can't contain itself", "slot": i})
+				return
+			}
+			if seen[choice.FoodID] {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Duplicate combo choice", "slot": i, "food_id": choice.FoodID})
+				return
+			}
+			seen[choice.FoodID] = true
+			componentIDs = append(componentIDs, choice.FoodID)
+		}
+	}
+
+	var found, combos int
+	err := db.QueryRow(`SELECT COUNT(*), COUNT(*) FILTER (WHERE EXISTS(SELECT 1 FROM combo_slots s WHERE s.combo_id = f.id))
+						FROM foods f WHERE f.id = ANY($1) AND f.deleted_at IS NULL`, pq.Array(uniqueInt64s(componentIDs))).Scan(&found, &combos)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if found != len(uniqueInt64s(componentIDs)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Component food not found"})
+		return
+	}
+	if combos > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A combo can't contain another combo"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	keep := []string{}
+	slotIDs := make([]string, len(req.Slots))
+	for i, slot := range req.Slots {
+		slotIDs[i] = slot.ID
+		if slot.ID != "" {
+			keep = append(keep, slot.ID)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM combo_slots WHERE combo_id = $1 AND NOT (id = ANY($2))`,
+		foodID, pq.Array(keep)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Combo update error"})
+		return
+	}
+
+	for i, slot := range req.Slots {
+		namesJSON, _ := json.Marshal(slot.Names)
+		if slot.ID != "" {
+			res, err := tx.Exec(`UPDATE combo_slots SET names = $3, quantity = $4, sort_order = $5
+								 WHERE id = $1 AND combo_id = $2`, slot.ID, foodID, namesJSON, slot.Quantity, i)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Combo update error"})
+				return
+			}
+			if affected, _ := res.RowsAffected(); affected == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Combo slot not found", "slot_id": slot.ID})
+				return
+			}
+		} else {
+			slotIDs[i] = generateID("cslot")
+			if _, err := tx.Exec(`INSERT INTO combo_slots (id, combo_id, names, quantity, sort_order)
+								  VALUES ($1, $2, $3, $4, $5)`, slotIDs[i], foodID, namesJSON, slot.Quantity, i); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Combo update error"})
+				return
+			}
+		}
+
+		if _, err := tx.Exec(`DELETE FROM combo_slot_choices WHERE slot_id = $1`, slotIDs[i]); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Combo update error"})
+			return
+		}
+		for j, choice := range slot.Choices {
+			if _, err := tx.Exec(`INSERT INTO combo_slot_choices (slot_id, food_id, price_delta, sort_order)
+								  VALUES ($1, $2, $3, $4)`, slotIDs[i], choice.FoodID, choice.PriceDelta, j); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Combo update error"})
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	recordAudit(c, "combo.update", "food", strconv.FormatInt(foodID, 10), req)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Combo updated successfully", "slot_ids": slotIDs})
+}
+
+// deleteComboHandler turns a combo back into a plain food
+func deleteComboHandler(c *gin.Context) {
+	foodID, ok := parseFoodIDParam(c)
+	if !ok {
+		return
+	}
+
+	if _, err := db.Exec(`DELETE FROM combo_slots WHERE combo_id = $1`, foodID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Combo deletion error"})
+		return
+	}
+	recordAudit(c, "combo.delete", "food", strconv.FormatInt(foodID, 10), nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Combo removed successfully"})
+}
+
+func uniqueInt64s(values []int64) []int64 {
+	seen := make(map[int64]bool)
+	unique := []int64{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// ========== AVAILABILITY SCHEDULES ==========
+
+// A food or category with schedules is only on the menu while at least one
+// of its active schedules matches; without schedules it's always on. Foods
+// also need every schedule-carrying ancestor category to be open.
+
+const SCHEDULE_CACHE_TTL = 30 * time.Second
+
+var scheduleCache = struct {
+	sync.RWMutex
+	schedules map[string][]*AvailabilitySchedule // "food:12", "category:salatlar"
+	loadedAt  time.Time
+}{}
+
+var clockPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+// restaurantNow is the wall clock schedules are written in
+func restaurantNow() time.Time {
+	if config != nil && config.Restaurant.location != nil {
+		return time.Now().In(config.Restaurant.location)
+	}
+	return time.Now()
+}
+
+func scheduleTargetKey(targetType, targetID string) string {
+	return targetType + ":" + targetID
+}
+
+func loadSchedules() (map[string][]*AvailabilitySchedule, error) {
+	rows, err := db.Query(`SELECT id, target_type, target_id, days, COALESCE(start_time, ''), COALESCE(end_time, ''),
+						   start_date, end_date, is_active, created_at, updated_at
+						   FROM availability_schedules ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := make(map[string][]*AvailabilitySchedule)
+	for rows.Next() {
+		schedule, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		if schedule.IsActive {
+			key := scheduleTargetKey(schedule.TargetType, schedule.TargetID)
+			schedules[key] = append(schedules[key], schedule)
+		}
+	}
+	return schedules, rows.Err()
+}
+
+func scanSchedule(scanner interface{ Scan(...interface{}) error }) (*AvailabilitySchedule, error) {
+	var schedule AvailabilitySchedule
+	var days pq.Int64Array
+	var startDate, endDate sql.NullTime
+	if err := scanner.Scan(&schedule.ID, &schedule.TargetType, &schedule.TargetID, &days,
+		&schedule.StartTime, &schedule.EndTime, &startDate, &endDate, &schedule.IsActive,
+		&schedule.CreatedAt, &schedule.UpdatedAt); err != nil {
+		return nil, err
+	}
+	schedule.Days = []int{}
+	for _, day := range days {
+		schedule.Days = append(schedule.Days, int(day))
+	}
+	if startDate.Valid {
+		schedule.StartDate = startDate.Time.Format("2006-01-02")
+	}
+	if endDate.Valid {
+		schedule.EndDate = endDate.Time.Format("2006-01-02")
+	}
+	return &schedule, nil
+}
+
+func cachedSchedules() map[string][]*AvailabilitySchedule {
+	scheduleCache.RLock()
+	schedules, fresh := scheduleCache.schedules, time.Since(scheduleCache.loadedAt) < SCHEDULE_CACHE_TTL
+	scheduleCache.RUnlock()
+
+	if schedules == nil || !fresh {
+		loaded, err := loadSchedules()
+		if err != nil {
+			log.Printf("Schedules load error: %v", err)
+		} else {
+			scheduleCache.Lock()
+			scheduleCache.schedules = loaded
+			scheduleCache.loadedAt = time.Now()
+			scheduleCache.Unlock()
+			schedules = loaded
+		}
+	}
+	return schedules
+}
+
+func invalidateScheduleCache() {
+	publishCacheInvalidation("schedules")
+}
+
+func clearScheduleCache() {
+	scheduleCache.Lock()
+	scheduleCache.loadedAt = time.Time{}
+	scheduleCache.Unlock()
+}
+
+func clockMinutes(clock string) int {
+	hours, _ := strconv.Atoi(clock[:2])
+	minutes, _ := strconv.Atoi(clock[3:])
+	return hours*60 + minutes
+}
+
+// coversDay reports whether the schedule runs on the given calendar day,
+// ignoring the time window
+func (s *AvailabilitySchedule) coversDay(day time.Time) bool {
+	date := day.Format("2006-01-02")
+	if s.StartDate != "" && date < s.StartDate {
+		return false
+	}
+	if s.EndDate != "" && date > s.EndDate {
+		return false
+	}
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, weekday := range s.Days {
+		if time.Weekday(weekday) == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the schedule is open at the given restaurant
+// time. A window ending before it starts (22:00-02:00) runs past midnight;
+// the early hours then belong to the previous day's schedule.
+func (s *AvailabilitySchedule) matches(at time.Time) bool {
+	if s.StartTime == "" || s.EndTime == "" {
+		return s.coversDay(at)
+	}
+
+	now := at.Hour()*60 + at.Minute()
+	start, end := clockMinutes(s.StartTime), clockMinutes(s.EndTime)
+	if start < end {
+		return now >= start && now < end && s.coversDay(at)
+	}
+	if now >= start {
+		return s.coversDay(at)
+	}
+	return now < end && s.coversDay(at.AddDate(0, 0, -1))
+}
+
+// targetOpen is true when the target has no schedules or one of them matches
+func targetOpen(schedules map[string][]*AvailabilitySchedule, key string, at time.Time) bool {
+	list := schedules[key]
+	if len(list) == 0 {
+		return true
+	}
+	for _, schedule := range list {
+		if schedule.matches(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// foodScheduledAt checks the food's own schedules and those of its category
+// and the category's ancestors
+func foodScheduledAt(foodID int64, category string, at time.Time) bool {
+	schedules := cachedSchedules()
+	if len(schedules) == 0 {
+		return true
+	}
+	if !targetOpen(schedules, scheduleTargetKey(ScheduleTargetFood, strconv.FormatInt(foodID, 10)), at) {
+		return false
+	}
+
+	categories := cachedCategories()
+	for depth := 0; depth <= len(categories) && category != ""; depth++ {
+		if !targetOpen(schedules, scheduleTargetKey(ScheduleTargetCategory, category), at) {
+			return false
+		}
+		parent, exists := categories[category]
+		if !exists || parent.ParentKey == nil {
+			break
+		}
+		category = *parent.ParentKey
+	}
+	return true
+}
+
+// validateScheduleRequest normalizes the request in place and returns a
+// client error, if any
+func validateScheduleRequest(req *ScheduleRequest) string {
+	switch req.TargetType {
+	case ScheduleTargetFood:
+		foodID, err := strconv.ParseInt(req.TargetID, 10, 64)
+		if err != nil {
+			return "Invalid food ID format"
+		}
+		if _, err := getFoodByID(foodID); err != nil {
+			return "Food not found"
+		}
+	case ScheduleTargetCategory:
+		if !categoryExists(req.TargetID) {
+			return "Category not found"
+		}
+	}
+
+	if problem := validateWeeklyWindow(&req.Days, req.StartTime, req.EndTime); problem != "" {
+		return problem
+	}
+
+	for _, date := range []string{req.StartDate, req.EndDate} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return "Dates must be YYYY-MM-DD"
+		}
+	}
+	if req.StartDate != "" && req.EndDate != "" && req.StartDate > req.EndDate {
+		return "start_date must not be after end_date"
+	}
+	return ""
+}
+
+// validateWeeklyWindow checks the days and times shared by schedules and
+// promotions, sorting the days in place
+func validateWeeklyWindow(days *[]int, startTime, endTime string) string {
+	if *days == nil {
+		*days = []int{}
+	}
+	seen := make(map[int]bool)
+	for _, day := range *days {
+		if day < 0 || day > 6 {
+			return "Days must be 0 (Sunday) to 6 (Saturday)"
+		}
+		if seen[day] {
+			return "Duplicate day"
+		}
+		seen[day] = true
+	}
+	sort.Ints(*days)
+
+	if (startTime == "") != (endTime == "") {
+		return "start_time and end_time must be set together"
+	}
+	if startTime != "" {
+		if !clockPattern.MatchString(startTime) || !clockPattern.MatchString(endTime) {
+			return "Times must be HH:MM"
+		}
+		if startTime == endTime {
+			return "start_time and end_time must differ"
+		}
+	}
+	return ""
+}
+
+func nullableString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+func getSchedulesHandler(c *gin.Context) {
+	query := `SELECT id, target_type, target_id, days, COALESCE(start_time, ''), COALESCE(end_time, ''),
+			  start_date, end_date, is_active, created_at, updated_at
+			  FROM availability_schedules WHERE 1=1`
+	args := []interface{}{}
+	if targetType := c.Query("target_type"); targetType != "" {
+		args = append(args, targetType)
+		query += fmt.Sprintf(" AND target_type = $%d", len(args))
+	}
+	if targetID := c.Query("target_id"); targetID != "" {
+		args = append(args, targetID)
+		query += fmt.Sprintf(" AND target_id = $%d", len(args))
+	}
+	query += " ORDER BY target_type, target_id, created_at"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	defer rows.Close()
+
+	now := restaurantNow()
+	items := []gin.H{}
+	for rows.Next() {
+		schedule, err := scanSchedule(rows)
+		if err != nil {
+			continue
+		}
+		items = append(items, gin.H{
+			"schedule":    schedule,
+			"matches_now": schedule.IsActive && schedule.matches(now),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items":           items,
+		"total":           len(items),
+		"restaurant_time": now.Format("2006-01-02 15:04 MST"),
+	})
+}
+
+func createScheduleHandler(c *gin.Context) {
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if problem := validateScheduleRequest(&req); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	scheduleID := generateID("sched")
+	_, err := db.Exec(`INSERT INTO availability_schedules (id, target_type, target_id, days, start_time, end_time,
+					   start_date, end_date, is_active) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		scheduleID, req.TargetType, req.TargetID, pq.Array(req.Days), nullableString(req.StartTime),
+		nullableString(req.EndTime), nullableString(req.StartDate), nullableString(req.EndDate), isActive)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Schedule creation error"})
+		return
+	}
+	invalidateScheduleCache()
+	recordAudit(c, "schedule.create", req.TargetType, req.TargetID, gin.H{"schedule_id": scheduleID, "request": req})
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Schedule created successfully", "schedule_id": scheduleID})
+}
+
+// updateScheduleHandler replaces every field of the schedule
+func updateScheduleHandler(c *gin.Context) {
+	scheduleID := c.Param("schedule_id")
+
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if problem := validateScheduleRequest(&req); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	result, err := db.Exec(`UPDATE availability_schedules SET target_type = $2, target_id = $3, days = $4,
+							start_time = $5, end_time = $6, start_date = $7, end_date = $8, is_active = $9,
+							updated_at = CURRENT_TIMESTAMP WHERE id = $1`,
+		scheduleID, req.TargetType, req.TargetID, pq.Array(req.Days), nullableString(req.StartTime),
+		nullableString(req.EndTime), nullableString(req.StartDate), nullableString(req.EndDate), isActive)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Schedule update error"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	}
+	invalidateScheduleCache()
+	recordAudit(c, "schedule.update", req.TargetType, req.TargetID, gin.H{"schedule_id": scheduleID, "request": req})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule updated successfully"})
+}
+
+func deleteScheduleHandler(c *gin.Context) {
+	scheduleID := c.Param("schedule_id")
+
+	var targetType, targetID string
+	err := db.QueryRow(`DELETE FROM availability_schedules WHERE id = $1 RETURNING target_type, target_id`,
+		scheduleID).Scan(&targetType, &targetID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Schedule deletion error"})
+		return
+	}
+	invalidateScheduleCache()
+	recordAudit(c, "schedule.delete", targetType, targetID, gin.H{"schedule_id": scheduleID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule deleted successfully"})
+}
+
+// ========== PROMOTIONS ==========
+
+// Promotions replace the single permanent Food.Discount, which still works
+// as a priority 0 percent promotion of its own food. For every food one
+// promotion wins: the highest priority, then the narrowest scope (the
+// food, then the closest category, then the whole menu), then the oldest.
+// Promotions don't stack and only change the food's own price; modifier
+// and combo deltas are always charged in full.
+
+const PROMOTION_CACHE_TTL = 30 * time.Second
+
+var promotionCache = struct {
+	sync.RWMutex
+	promotions []*Promotion // active ones, oldest first
+	loadedAt   time.Time
+}{}
+
+// legacyDiscountNames label the promotion made from Food.Discount
+var legacyDiscountNames = map[string]string{"uz": "Chegirma", "ru": "Скидка", "en": "Discount"}
+
+const promotionColumns = `id, names, type, value, buy_quantity, get_quantity, scope, COALESCE(scope_id, ''),
+						  starts_at, ends_at, days, COALESCE(start_time, ''), COALESCE(end_time, ''),
+						  priority, is_active, created_at, updated_at`
+
+func scanPromotion(scanner interface{ Scan(...interface{}) error }) (*Promotion, error) {
+	var promotion Promotion
+	var namesJSON []byte
+	var days pq.Int64Array
+	var startsAt, endsAt sql.NullTime
+	if err := scanner.Scan(&promotion.ID, &namesJSON, &promotion.Type, &promotion.Value,
+		&promotion.BuyQuantity, &promotion.GetQuantity, &promotion.Scope, &promotion.ScopeID,
+		&startsAt, &endsAt, &days, &promotion.StartTime, &promotion.EndTime, &promotion.Priority,
+		&promotion.IsActive, &promotion.CreatedAt, &promotion.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if namesJSON != nil {
+		json.Unmarshal(namesJSON, &promotion.Names)
+	}
+	promotion.Days = []int{}
+	for _, day := range days {
+		promotion.Days = append(promotion.Days, int(day))
+	}
+	if startsAt.Valid {
+		at := fromRestaurantTimestamp(startsAt.Time)
+		promotion.StartsAt = &at
+	}
+	if endsAt.Valid {
+		at := fromRestaurantTimestamp(endsAt.Time)
+		promotion.EndsAt = &at
+	}
+	return &promotion, nil
+}
+
+// Promotion bounds are stored as restaurant wall clock, like schedules
+func restaurantTimestamp(at *time.Time) interface{} {
+	if at == nil {
+		return nil
+	}
+	return at.In(restaurantNow().Location()).Format("2006-01-02 15:04:05")
+}
+
+func fromRestaurantTimestamp(stored time.Time) time.Time {
+	return time.Date(stored.Year(), stored.Month(), stored.Day(), stored.Hour(), stored.Minute(),
+		stored.Second(), stored.Nanosecond(), restaurantNow().Location())
+}
+
+func loadPromotions() ([]*Promotion, error) {
+	rows, err := db.Query(`SELECT ` + promotionColumns + ` FROM promotions WHERE is_active ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promotions := []*Promotion{}
+	for rows.Next() {
+		promotion, err := scanPromotion(rows)
+		if err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, promotion)
+	}
+	return promotions, rows.Err()
+}
+
+func cachedPromotions() []*Promotion {
+	promotionCache.RLock()
+	promotions, fresh := promotionCache.promotions, time.Since(promotionCache.loadedAt) < PROMOTION_CACHE_TTL
+	promotionCache.RUnlock()
+
+	if promotions == nil || !fresh {
+		loaded, err := loadPromotions()
+		if err != nil {
+			log.Printf("Promotions load error: %v", err)
+		} else {
+			promotionCache.Lock()
+			promotionCache.promotions = loaded
+			promotionCache.loadedAt = time.Now()
+			promotionCache.Unlock()
+			promotions = loaded
+		}
+	}
+	return promotions
+}
+
+func invalidatePromotionCache() {
+	publishCacheInvalidation("promotions")
+}
+
+func clearPromotionCache() {
+	promotionCache.Lock()
+	promotionCache.loadedAt = time.Time{}
+	promotionCache.Unlock()
+}
+
+// runningAt reports whether the promotion is on at the given restaurant
+// time: inside its start and end, and inside its weekly window if any
+func (p *Promotion) runningAt(at time.Time) bool {
+	if !p.IsActive {
+		return false
+	}
+	if p.StartsAt != nil && at.Before(*p.StartsAt) {
+		return false
+	}
+	if p.EndsAt != nil && !at.Before(*p.EndsAt) {
+		return false
+	}
+	window := AvailabilitySchedule{Days: p.Days, StartTime: p.StartTime, EndTime: p.EndTime}
+	return window.matches(at)
+}
+
+// scopeRank grows with how narrowly the promotion targets the food and is
+// 0 when it doesn't cover the food at all
+func (p *Promotion) scopeRank(food *Food) int {
+	switch p.Scope {
+	case PromotionScopeFood:
+		if p.ScopeID == strconv.FormatInt(food.ID, 10) {
+			return 1000
+		}
+	case PromotionScopeCategory:
+		categories := cachedCategories()
+		category := food.Category
+		for depth := 0; depth <= len(categories) && category != ""; depth++ {
+			if p.ScopeID == category {
+				return 999 - depth
+			}
+			parent, exists := categories[category]
+			if !exists || parent.ParentKey == nil {
+				break
+			}
+			category = *parent.ParentKey
+		}
+	case PromotionScopeMenu:
+		return 1
+	}
+	return 0
+}
+
+func (p *Promotion) summary(lang string) *AppliedPromotion {
+	return &AppliedPromotion{
+		ID:          p.ID,
+		Name:        localizedName(p.Names, lang, ""),
+		Type:        p.Type,
+		Value:       p.Value,
+		BuyQuantity: p.BuyQuantity,
+		GetQuantity: p.GetQuantity,
+		EndsAt:      p.EndsAt,
+	}
+}
+
+func legacyDiscountPromotion(food *Food) *Promotion {
+	return &Promotion{
+		ID:       "discount",
+		Names:    legacyDiscountNames,
+		Type:     PromotionPercent,
+		Value:    food.Discount,
+		Scope:    PromotionScopeFood,
+		ScopeID:  strconv.FormatInt(food.ID, 10),
+		IsActive: true,
+	}
+}
+
+// FoodPrice is what priceFood charges for some portions of a food
+type FoodPrice struct {
+	BasePrice int
+	UnitPrice int // one portion after a percent or fixed promotion
+	FreeItems int // portions given away by buy X get Y
+	Promotion *Promotion
+}
+
+// Total charges quantity portions whose price is raised by extras
+// (modifiers, combo choices). Free portions still pay for their extras.
+func (p FoodPrice) Total(quantity, extras int) int {
+	unit := p.UnitPrice + extras
+	if unit < 0 {
+		unit = 0
+	}
+	total := unit*quantity - p.FreeItems*p.UnitPrice
+	if total < 0 {
+		total = 0
+	}
+	return total
+}
+
+// priceFood is the one place a food's price is decided. The menu, search
+// and order creation all call it, so the price shown is the price charged.
+func priceFood(food *Food, quantity int, at time.Time) FoodPrice {
+	candidates := cachedPromotions()
+	if food.Discount > 0 {
+		// After the real promotions, so they win ties
+		candidates = append(candidates[:len(candidates):len(candidates)], legacyDiscountPromotion(food))
+	}
+
+	var best *Promotion
+	bestRank := 0
+	for _, promotion := range candidates {
+		rank := promotion.scopeRank(food)
+		if rank == 0 || !promotion.runningAt(at) {
+			continue
+		}
+		if best == nil || promotion.Priority > best.Priority ||
+			(promotion.Priority == best.Priority && rank > bestRank) {
+			best, bestRank = promotion, rank
+		}
+	}
+
+	price := FoodPrice{BasePrice: food.Price, UnitPrice: food.Price, Promotion: best}
+	if best == nil {
+		return price
+	}
+	switch best.Type {
+	case PromotionPercent:
+		price.UnitPrice = food.Price - (food.Price * best.Value / 100)
+	case PromotionFixed:
+		price.UnitPrice = food.Price - best.Value
+	case PromotionBuyXGetY:
+		price.FreeItems = quantity / (best.BuyQuantity + best.GetQuantity) * best.GetQuantity
+	}
+	if price.UnitPrice < 0 {
+		price.UnitPrice = 0
+	}
+	return price
+}
+
+// validatePromotionRequest normalizes the request in place and returns a
+// client error, if any
+func validatePromotionRequest(req *PromotionRequest) string {
+	if problem := validateLocalizedNames(req.Names); problem != "" {
+		return problem
+	}
+
+	switch req.Type {
+	case PromotionPercent:
+		if req.Value < 1 || req.Value > 100 {
+			return "Percent value must be between 1 and 100"
+		}
+	case PromotionFixed:
+		if req.Value < 1 {
+			return "Fixed value must be positive"
+		}
+	case PromotionBuyXGetY:
+		if req.BuyQuantity < 1 || req.GetQuantity < 1 {
+			return "buy_quantity and get_quantity must be at least 1"
+		}
+		req.Value = 0
+	}
+	if req.Type != PromotionBuyXGetY {
+		req.BuyQuantity, req.GetQuantity = 0, 0
+	}
+
+	switch req.Scope {
+	case PromotionScopeFood:
+		foodID, err := strconv.ParseInt(req.ScopeID, 10, 64)
+		if err != nil {
+			return "Invalid food ID format"
+		}
+		if food, err := getFoodByID(foodID); err != nil || food.DeletedAt != nil {
+			return "Food not found"
+		}
+	case PromotionScopeCategory:
+		if !categoryExists(req.ScopeID) {
+			return "Category not found"
+		}
+	case PromotionScopeMenu:
+		if req.ScopeID != "" {
+			return "scope_id must be empty for the whole menu"
+		}
+	}
+
+	if req.StartsAt != nil && req.EndsAt != nil && !req.StartsAt.Before(*req.EndsAt) {
+		return "starts_at must be before ends_at"
+	}
+	return validateWeeklyWindow(&req.Days, req.StartTime, req.EndTime)
+}
+
+func getPromotionsHandler(c *gin.Context) {
+	query := `SELECT ` + promotionColumns + ` FROM promotions WHERE 1=1`
+	args := []interface{}{}
+	if scope := c.Query("scope"); scope != "" {
+		args = append(args, scope)
+		query += fmt.Sprintf(" AND scope = $%d", len(args))
+	}
+	if scopeID := c.Query("scope_id"); scopeID != "" {
+		args = append(args, scopeID)
+		query += fmt.Sprintf(" AND scope_id = $%d", len(args))
+	}
+	query += " ORDER BY priority DESC, created_at"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	defer rows.Close()
+
+	now := restaurantNow()
+	items := []gin.H{}
+	for rows.Next() {
+		promotion, err := scanPromotion(rows)
+		if err != nil {
+			continue
+		}
+		items = append(items, gin.H{
+			"promotion":   promotion,
+			"running_now": promotion.runningAt(now),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items":           items,
+		"total":           len(items),
+		"restaurant_time": now.Format("2006-01-02 15:04 MST"),
+	})
+}
+
+// getActivePromotionsHandler lists the promotions running right now for
+// customers; the prices themselves come with the foods
+func getActivePromotionsHandler(c *gin.Context) {
+	lang := getUserLanguage(c.Request.Header)
+	now := restaurantNow()
+
+	items := []gin.H{}
+	for _, promotion := range cachedPromotions() {
+		if !promotion.runningAt(now) {
+			continue
+		}
+		items = append(items, gin.H{
+			"promotion":  promotion.summary(lang),
+			"scope":      promotion.Scope,
+			"scope_id":   promotion.ScopeID,
+			"start_time": promotion.StartTime,
+			"end_time":   promotion.EndTime,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": items, "total": len(items)})
+}
+
+func createPromotionHandler(c *gin.Context) {
+	var req PromotionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if problem := validatePromotionRequest(&req); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	promotionID := generateID("promo")
+	namesJSON, _ := json.Marshal(req.Names)
+	_, err := db.Exec(`INSERT INTO promotions (id, names, type, value, buy_quantity, get_quantity, scope, scope_id,
+					   starts_at, ends_at, days, start_time, end_time, priority, is_active)
+					   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+		promotionID, namesJSON, req.Type, req.Value, req.BuyQuantity, req.GetQuantity, req.Scope,
+		nullableString(req.ScopeID), restaurantTimestamp(req.StartsAt), restaurantTimestamp(req.EndsAt),
+		pq.Array(req.Days), nullableString(req.StartTime), nullableString(req.EndTime), req.Priority, isActive)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Promotion creation error"})
+		return
+	}
+	invalidatePromotionCache()
+	recordAudit(c, "promotion.create", "promotion", promotionID, req)
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Promotion created successfully", "promotion_id": promotionID})
+}
+
+// updatePromotionHandler replaces every field of the promotion
+func updatePromotionHandler(c *gin.Context) {
+	promotionID := c.Param("promotion_id")
+
+	var req PromotionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if problem := validatePromotionRequest(&req); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	namesJSON, _ := json.Marshal(req.Names)
+	result, err := db.Exec(`UPDATE promotions SET names = $2, type = $3, value = $4, buy_quantity = $5,
+							get_quantity = $6, scope = $7, scope_id = $8, starts_at = $9, ends_at = $10, days = $11,
+							start_time = $12, end_time = $13, priority = $14, is_active = $15,
+							updated_at = CURRENT_TIMESTAMP WHERE id = $1`,
+		promotionID, namesJSON, req.Type, req.Value, req.BuyQuantity, req.GetQuantity, req.Scope,
+		nullableString(req.ScopeID), restaurantTimestamp(req.StartsAt), restaurantTimestamp(req.EndsAt),
+		pq.Array(req.Days), nullableString(req.StartTime), nullableString(req.EndTime), req.Priority, isActive)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Promotion update error"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Promotion not found"})
+		return
+	}
+	invalidatePromotionCache()
+	recordAudit(c, "promotion.update", "promotion", promotionID, req)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Promotion updated successfully"})
+}
+
+func deletePromotionHandler(c *gin.Context) {
+	promotionID := c.Param("promotion_id")
+
+	result, err := db.Exec(`DELETE FROM promotions WHERE id = $1`, promotionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Promotion deletion error"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Promotion not found"})
+		return
+	}
+	invalidatePromotionCache()
+	recordAudit(c, "promotion.delete", "promotion", promotionID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Promotion deleted successfully"})
+}
+
+// ========== FOOD IMAGE GALLERY ==========
+
+// loadFoodImages returns the galleries of the given foods in display order
+func loadFoodImages(foodIDs []int64) (map[int64][]*FoodImage, error) {
+	images := make(map[int64][]*FoodImage)
+	if len(foodIDs) == 0 {
+		return images, nil
+	}
+
+	rows, err := db.Query(`SELECT i.id, i.food_id, i.file_id, f.url, i.position, i.is_primary, i.alt_texts, i.created_at
+						   FROM food_images i JOIN file_uploads f ON f.id = i.file_id
+						   WHERE i.food_id = ANY($1) ORDER BY i.food_id, i.position, i.created_at`, pq.Array(foodIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var image FoodImage
+		var altJSON []byte
+		if err := rows.Scan(&image.ID, &image.FoodID, &image.FileID, &image.URL, &image.Position,
+			&image.IsPrimary, &altJSON, &image.CreatedAt); err != nil {
+			return nil, err
+		}
+		if altJSON != nil {
+			json.Unmarshal(altJSON, &image.AltTexts)
+		}
+		images[image.FoodID] = append(images[image.FoodID], &image)
+	}
+	return images, rows.Err()
+}
+
+// attachFoodImages fills Food.Images with the alt text in the given language
+func attachFoodImages(foods []*Food, lang string) error {
+	foodIDs := make([]int64, 0, len(foods))
+	for _, food := range foods {
+		foodIDs = append(foodIDs, food.ID)
+	}
+	images, err := loadFoodImages(foodIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, food := range foods {
+		food.Images = images[food.ID]
+		for _, image := range food.Images {
+			image.Alt = localizedName(image.AltTexts, lang, food.Name)
+		}
+	}
+	return nil
+}
+
+// absolutizeFoodURLs turns stored /uploads/... paths into full URLs
+func absolutizeFoodURLs(food *Food, hostURL string) {
+	if food.ImageURL != "" && !strings.HasPrefix(food.ImageURL, "http") {
+		food.ImageURL = hostURL + food.ImageURL
+	}
+	for _, image := range food.Images {
+		if image.URL != "" && !strings.HasPrefix(image.URL, "http") {
+			image.URL = hostURL + image.URL
+		}
+	}
+}
+
+// relativeUploadURL turns the full URL of one of our uploads, as handed
+// out by absolutizeFoodURLs, back into the stored /uploads/... path. The
+// scheme is not compared since TLS may end at a proxy. Other URLs are kept.
+func relativeUploadURL(imageURL, host string) string {
+	for _, scheme := range []string{"http://", "https://"} {
+		if path, ok := strings.CutPrefix(imageURL, scheme+host); ok && strings.HasPrefix(path, "/uploads/") {
+			return path
+		}
+	}
+	return imageURL
+}
+
+// migrateFoodImageURLs stores the full upload URLs saved by earlier
+// versions as paths, so uploads are matched by their url again
+func migrateFoodImageURLs(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE foods f SET image_url = u.url FROM file_uploads u
+					   WHERE substring(f.image_url from '^https?://[^/]+(/uploads/.*)$') = u.url`)
+	return err
+}
+
+func validateAltTexts(altTexts map[string]string) string {
+	for lang, text := range altTexts {
+		if !isSupportedLanguage(lang) {
+			return fmt.Sprintf("Unsupported language: %s", lang)
+		}
+		if len(text) > 255 {
+			return "Alt text is too long"
+		}
+	}
+	return ""
+}
+
+// syncPrimaryImage keeps foods.image_url pointing at the primary gallery
+// image, so clients that only read imageUrl keep working. With no images
+// left the previous gallery URL is cleared.
+func syncPrimaryImage(tx *sql.Tx, c *gin.Context, foodID int64, removedURL string) error {
+	var previousURL string
+	if err := tx.QueryRow(`SELECT image_url FROM foods WHERE id = $1 FOR UPDATE`, foodID).Scan(&previousURL); err != nil {
+		return err
+	}
+	logImage := func(url string) error {
+		return recordFoodChange(tx, c, foodID, FoodChangeImage,
+			map[string]interface{}{"imageUrl": previousURL}, map[string]interface{}{"imageUrl": url})
+	}
+
+	var url string
+	err := tx.QueryRow(`SELECT f.url FROM food_images i JOIN file_uploads f ON f.id = i.file_id
+						WHERE i.food_id = $1 ORDER BY i.is_primary DESC, i.position, i.created_at LIMIT 1`,
+		foodID).Scan(&url)
+	if err == sql.ErrNoRows {
+		if removedURL == "" || previousURL != removedURL {
+			return nil
+		}
+		if _, err := tx.Exec(`UPDATE foods SET image_url = '' WHERE id = $1`, foodID); err != nil {
+			return err
+		}
+		return logImage("")
+	}
+	if err != nil {
+		return err
+	}
+
+	// The first image becomes primary when the primary one was removed
+	if _, err := tx.Exec(`UPDATE food_images SET is_primary = true WHERE food_id = $1
+						  AND NOT EXISTS (SELECT 1 FROM food_images WHERE food_id = $1 AND is_primary)
+						  AND id = (SELECT id FROM food_images WHERE food_id = $1 ORDER BY position, created_at LIMIT 1)`,
+		foodID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE foods SET image_url = $2 WHERE id = $1`, foodID, url); err != nil {
+		return err
+	}
+	return logImage(url)
+}
+
+// cleanupUnreferencedFiles removes uploads that no gallery, food or
+// category points at any more, both the row and the file on disk
+func cleanupUnreferencedFiles(fileIDs []string) {
+	for _, fileID := range fileIDs {
+		var filePath string
+		err := db.QueryRow(`DELETE FROM file_uploads f WHERE f.id = $1
+							AND NOT EXISTS (SELECT 1 FROM food_images WHERE file_id = f.id)
+							AND NOT EXISTS (SELECT 1 FROM foods WHERE image_url = f.url)
+							AND NOT EXISTS (SELECT 1 FROM categories WHERE icon_url = f.url)
+							RETURNING f.file_path`, fileID).Scan(&filePath)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("File cleanup error (%s): %v", fileID, err)
+			continue
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("File remove error (%s): %v", filePath, err)
+		}
+	}
+}
+
+// foodFileIDs lists the uploads a food uses, gallery and image_url alike
+func foodFileIDs(foodID int64) []string {
+	rows, err := db.Query(`SELECT file_id FROM food_images WHERE food_id = $1
+						   UNION SELECT f.id FROM file_uploads f JOIN foods ON foods.image_url = f.url
+						   WHERE foods.id = $1`, foodID)
+	if err != nil {
+		log.Printf("Food files fetch error: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	fileIDs := []string{}
+	for rows.Next() {
+		var fileID string
+		if rows.Scan(&fileID) == nil {
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	return fileIDs
+}
+
+func getFoodImagesHandler(c *gin.Context) {
+	foodID, ok := parseFoodIDParam(c)
+	if !ok {
+		return
+	}
+
+	images, err := loadFoodImages([]int64{foodID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	food := &Food{ID: foodID, Images: images[foodID]}
+	absolutizeFoodURLs(food, getHostURL(c))
+	if food.Images == nil {
+		food.Images = []*FoodImage{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": food.Images, "total": len(food.Images)})
+}
+
+func addFoodImageHandler(c *gin.Context) {
+	foodID, ok := parseFoodIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req FoodImageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if problem := validateAltTexts(req.AltTexts); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	var mimeType string
+	if err := db.QueryRow(`SELECT mime_type FROM file_uploads WHERE id = $1`, req.FileID).Scan(&mimeType); err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is not an image"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM food_images WHERE food_id = $1`, foodID).Scan(&count); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if count >= MAX_FOOD_IMAGES {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A food can have at most %d images", MAX_FOOD_IMAGES)})
+		return
+	}
+	if req.IsPrimary {
+		if _, err := tx.Exec(`UPDATE food_images SET is_primary = false WHERE food_id = $1`, foodID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+
+	imageID := generateID("img")
+	altJSON, _ := json.Marshal(req.AltTexts)
+	_, err = tx.Exec(`INSERT INTO food_images (id, food_id, file_id, position, is_primary, alt_texts)
+					  VALUES ($1, $2, $3, $4, $5, $6)`, imageID, foodID, req.FileID, count, req.IsPrimary || count == 0, altJSON)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Image already in the gallery"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Image save error"})
+		return
+	}
+	if err := syncPrimaryImage(tx, c, foodID, ""); err != nil || tx.Commit() != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Image save error"})
+		return
+	}
+	recordAudit(c, "food_image.add", "food", strconv.FormatInt(foodID, 10), gin.H{"image_id": imageID, "file_id": req.FileID})
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Image added successfully", "image_id": imageID})
+}
+
+func updateFoodImageHandler(c *gin.Context) {
+	foodID, ok := parseFoodIDParam(c)
+	if !ok {
+		return
+	}
+	imageID := c.Param("image_id")
+
+	var req FoodImageUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if problem := validateAltTexts(req.AltTexts); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM food_images WHERE id = $1 AND food_id = $2)`, imageID, foodID).Scan(&exists)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	if req.AltTexts != nil {
+		altJSON, _ := json.Marshal(req.AltTexts)
+		if _, err := tx.Exec(`UPDATE food_images SET alt_texts = $2 WHERE id = $1`, imageID, altJSON); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Image update error"})
+			return
+		}
+	}
+	if req.IsPrimary != nil && *req.IsPrimary {
+		// Two steps: the unique index allows only one primary image at any time
+		if _, err := tx.Exec(`UPDATE food_images SET is_primary = false WHERE food_id = $1 AND id <> $2`, foodID, imageID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Image update error"})
+			return
+		}
+		if _, err := tx.Exec(`UPDATE food_images SET is_primary = true WHERE id = $1`, imageID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Image update error"})
+			return
+		}
+	}
+	if err := syncPrimaryImage(tx, c, foodID, ""); err != nil || tx.Commit() != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Image update error"})
+		return
+	}
+	recordAudit(c, "food_image.update", "food", strconv.FormatInt(foodID, 10), gin.H{"image_id": imageID, "request": req})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Image updated successfully"})
+}
+
+// reorderFoodImagesHandler takes every image id of the gallery in the new order
+func reorderFoodImagesHandler(c *gin.Context) {
+	foodID, ok := parseFoodIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req FoodImageOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var count int
+	tx.QueryRow(`SELECT COUNT(*) FROM food_images WHERE food_id = $1`, foodID).Scan(&count)
+	if len(uniqueStrings(req.ImageIDs)) != len(req.ImageIDs) || len(req.ImageIDs) != count {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "image_ids must list every image of the food once"})
+		return
+	}
+
+	for position, imageID := range req.ImageIDs {
+		result, err := tx.Exec(`UPDATE food_images SET position = $3 WHERE id = $1 AND food_id = $2`, imageID, foodID, position)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Image reorder error"})
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Image not found", "image_id": imageID})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Image reorder error"})
+		return
+	}
+	recordAudit(c, "food_image.reorder", "food", strconv.FormatInt(foodID, 10), req)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Images reordered successfully"})
+}
+
+func deleteFoodImageHandler(c *gin.Context) {
+	foodID, ok := parseFoodIDParam(c)
+	if !ok {
+		return
+	}
+	imageID := c.Param("image_id")
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var fileID, url string
+	err = tx.QueryRow(`DELETE FROM food_images i USING file_uploads f
+					   WHERE i.id = $1 AND i.food_id = $2 AND f.id = i.file_id
+					   RETURNING i.file_id, f.url`, imageID, foodID).Scan(&fileID, &url)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Image deletion error"})
+		return
+	}
+
+	// Close the gap left in the positions
+	if _, err := tx.Exec(`UPDATE food_images SET position = ordered.rn - 1 FROM (
+							  SELECT id, ROW_NUMBER() OVER (ORDER BY position, created_at) AS rn
+							  FROM food_images WHERE food_id = $1
+						  ) ordered WHERE food_images.id = ordered.id`, foodID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Image deletion error"})
+		return
+	}
+	if err := syncPrimaryImage(tx, c, foodID, url); err != nil || tx.Commit() != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Image deletion error"})
+		return
+	}
+	cleanupUnreferencedFiles([]string{fileID})
+	recordAudit(c, "food_image.delete", "food", strconv.FormatInt(foodID, 10), gin.H{"image_id": imageID, "file_id": fileID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Image deleted successfully"})
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// ========== FOOD CHANGE LOG ==========
+
+// Every admin edit of a food appends a row to food_changes with the fields
+// that changed, before and after, and who changed them. The table refuses
+// UPDATE and DELETE and outlives purged foods. Stock taken by orders is not
+// an edit and isn't logged. Each row also carries the price, discount and
+// names the food had right after the change, which is what the price
+// history and the price-on-date report read.
+
+const (
+	FoodChangeBaseline = "baseline" // state of a food that predates the log
+	FoodChangeCreate   = "create"
+	FoodChangeUpdate   = "update"
+	FoodChangeImage    = "image"
+	FoodChangeImport   = "import"
+	FoodChangeArchive  = "archive"
+	FoodChangeRestore  = "restore"
+	FoodChangePurge    = "purge"
+)
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// foodSnapshot flattens the editable fields of a food to plain JSON values,
+// translated fields one key per language ("names.ru"), so two snapshots
+// compare key by key. It copies, so the food can be modified afterwards.
+func foodSnapshot(doc FoodDocument) map[string]interface{} {
+	data, _ := json.Marshal(doc)
+	var document map[string]interface{}
+	json.Unmarshal(data, &document)
+
+	snapshot := make(map[string]interface{})
+	for field, value := range document {
+		if value == nil {
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			for lang, text := range nested {
+				snapshot[field+"."+lang] = text
+			}
+			continue
+		}
+		snapshot[field] = value
+	}
+	return snapshot
+}
+
+func diffSnapshots(before, after map[string]interface{}) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+	for field, value := range after {
+		old := before[field]
+		oldJSON, _ := json.Marshal(old)
+		newJSON, _ := json.Marshal(value)
+		if !bytes.Equal(oldJSON, newJSON) {
+			changes[field] = FieldChange{Before: old, After: value}
+		}
+	}
+	for field, value := range before {
+		if _, ok := after[field]; !ok && value != nil {
+			changes[field] = FieldChange{Before: value, After: nil}
+		}
+	}
+	return changes
+}
+
+// recordFoodChange appends the difference between two snapshots. Nothing
+// is written when they are equal. c may be nil for changes made by the
+// server itself.
+func recordFoodChange(execer sqlExecer, c *gin.Context, foodID int64, action string, before, after map[string]interface{}) error {
+	changes := diffSnapshots(before, after)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	var actorID, actorNumber, actorRole, apiKeyID string
+	if c != nil {
+		if userInterface, exists := c.Get("user"); exists {
+			user := userInterface.(*Claims)
+			actorID = user.UserID
+			actorNumber = user.Number
+			actorRole = user.Role
+			apiKeyID = user.APIKeyID
+		}
+	}
+
+	// State after the change; archive and restore don't touch the price
+	var price, discount interface{}
+	if value, ok := after["price"].(float64); ok {
+		price = int(value)
+		discount = 0
+		if value, ok := after["discount"].(float64); ok {
+			discount = int(value)
+		}
+	}
+	var namesJSON []byte
+	names := make(map[string]interface{})
+	for field, value := range after {
+		if strings.HasPrefix(field, "names.") {
+			names[strings.TrimPrefix(field, "names.")] = value
+		}
+	}
+	if len(names) > 0 {
+		namesJSON, _ = json.Marshal(names)
+	}
+
+	changesJSON, _ := json.Marshal(changes)
+	_, err := execer.Exec(`INSERT INTO food_changes (food_id, action, actor_id, actor_number, actor_role,
+						   api_key_id, changes, price, discount, names, created_at)
+						   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		foodID, action, nullableString(actorID), nullableString(actorNumber), nullableString(actorRole),
+		nullableString(apiKeyID), changesJSON, price, discount, namesJSON, time.Now())
+	return err
+}
+
+// seedFoodChangeBaselines gives every food without history a baseline row,
+// so prices can be reported from the day the log was introduced
+func seedFoodChangeBaselines(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id FROM foods f WHERE NOT EXISTS
+						   (SELECT 1 FROM food_changes c WHERE c.food_id = f.id)`)
+	if err != nil {
+		return err
+	}
+	var foodIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			foodIDs = append(foodIDs, id)
+		}
+	}
+	rows.Close()
+
+	for _, foodID := range foodIDs {
+		food, err := getFoodByID(foodID)
+		if err != nil {
+			return err
+		}
+		snapshot := foodSnapshot(foodDocumentOf(food))
+		if food.DeletedAt != nil {
+			snapshot["archived"] = true
+		}
+		if err := recordFoodChange(tx, nil, foodID, FoodChangeBaseline, nil, snapshot); err != nil {
+			return err
+		}
+	}
+	if len(foodIDs) > 0 {
+		log.Printf("📝 Food change log baseline recorded for %d foods", len(foodIDs))
+	}
+	return nil
+}
+
+func foodChangeActor(actorID, actorNumber, actorRole, apiKeyID sql.NullString) gin.H {
+	return gin.H{
+		"id":         actorID.String,
+		"number":     actorNumber.String,
+		"role":       actorRole.String,
+		"api_key_id": apiKeyID.String,
+	}
+}
+
+// getFoodChangesHandler lists the change log of one food, newest first.
+// Purged foods keep their history, so the food itself isn't looked up.
+func getFoodChangesHandler(c *gin.Context) {
+	foodID, err := strconv.ParseInt(c.Param("food_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
+		return
+	}
+	page, _ := strconv.Atoi(c.Query("page"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if page <= 0 {
+		page = 1
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	var total int
+	db.QueryRow(`SELECT COUNT(*) FROM food_changes WHERE food_id = $1`, foodID).Scan(&total)
+	if total == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No history for this food"})
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, action, actor_id, actor_number, actor_role, api_key_id, changes, created_at
+						   FROM food_changes WHERE food_id = $1 ORDER BY created_at DESC, id DESC
+						   LIMIT $2 OFFSET $3`, foodID, limit, (page-1)*limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	defer rows.Close()
+
+	items := []gin.H{}
+	for rows.Next() {
+		var id int64
+		var action string
+		var actorID, actorNumber, actorRole, apiKeyID sql.NullString
+		var changesJSON []byte
+		var createdAt time.Time
+		if err := rows.Scan(&id, &action, &actorID, &actorNumber, &actorRole, &apiKeyID, &changesJSON, &createdAt); err != nil {
+			continue
+		}
+		var changes map[string]FieldChange
+		json.Unmarshal(changesJSON, &changes)
+		items = append(items, gin.H{
+			"id":         id,
+			"action":     action,
+			"actor":      foodChangeActor(actorID, actorNumber, actorRole, apiKeyID),
+			"changes":    changes,
+			"created_at": createdAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"food_id": foodID,
+		"items":   items,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+// loggedFoodPrice prices a change log row through priceFood, so reports
+// agree with the menu. Promotions aren't in the change log: the ones
+// configured now are applied at the row's moment.
+func loggedFoodPrice(foodID int64, category string, price, discount int, at time.Time) FoodPrice {
+	return priceFood(&Food{ID: foodID, Category: category, Price: price, Discount: discount}, 1, at)
+}
+
+// getFoodPriceHistoryHandler lists every price or discount a food has had,
+// newest first, with who set it
+func getFoodPriceHistoryHandler(c *gin.Context) {
+	foodID, err := strconv.ParseInt(c.Param("food_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
+		return
+	}
+
+	// Category promotions follow the food's current category; a purged
+	// food has none
+	var category string
+	err = db.QueryRow(`SELECT category FROM foods WHERE id = $1`, foodID).Scan(&category)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	lang := getUserLanguage(c.Request.Header)
+	rows, err := db.Query(`SELECT id, action, actor_id, actor_number, actor_role, api_key_id, price, discount, created_at
+						   FROM food_changes WHERE food_id = $1 AND price IS NOT NULL
+						   AND (action IN ($2, $3) OR changes ? 'price' OR changes ? 'discount')
+						   ORDER BY created_at DESC, id DESC`, foodID, FoodChangeCreate, FoodChangeBaseline)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	defer rows.Close()
+
+	items := []gin.H{}
+	for rows.Next() {
+		var id int64
+		var action string
+		var actorID, actorNumber, actorRole, apiKeyID sql.NullString
+		var price, discount int
+		var createdAt time.Time
+		if err := rows.Scan(&id, &action, &actorID, &actorNumber, &actorRole, &apiKeyID, &price, &discount, &createdAt); err != nil {
+			continue
+		}
+		effective := loggedFoodPrice(foodID, category, price, discount, createdAt)
+		var promotion *AppliedPromotion
+		if effective.Promotion != nil {
+			promotion = effective.Promotion.summary(lang)
+		}
+		items = append(items, gin.H{
+			"id":              id,
+			"action":          action,
+			"price":           price,
+			"discount":        discount,
+			"effective_price": effective.UnitPrice,
+			"promotion":       promotion,
+			"actor":           foodChangeActor(actorID, actorNumber, actorRole, apiKeyID),
+			"created_at":      createdAt,
+		})
+	}
+	if len(items) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No history for this food"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"food_id": foodID, "items": items, "total": len(items)})
+}
+
+// getPricesOnDateHandler reports what every dish cost at a moment:
+// ?date=YYYY-MM-DD means the end of that day in the restaurant's time
+// zone, ?at= takes an RFC 3339 time, and no parameter means now.
+// ?food_id= narrows it to one dish.
+func getPricesOnDateHandler(c *gin.Context) {
+	at := time.Now()
+	if value := c.Query("date"); value != "" {
+		day, err := time.ParseInLocation("2006-01-02", value, restaurantNow().Location())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "date must be YYYY-MM-DD"})
+			return
+		}
+		at = day.AddDate(0, 0, 1).Add(-time.Microsecond)
+	} else if value := c.Query("at"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "at must be an RFC 3339 time"})
+			return
+		}
+		at = parsed
+	}
+
+	args := []interface{}{at.Local()} // created_at holds server local time, like the other tables
+	foodFilter := ""
+	if value := c.Query("food_id"); value != "" {
+		foodID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
+			return
+		}
+		args = append(args, foodID)
+		foodFilter = " AND food_id = $2"
+	}
+
+	// The latest price row and the latest archive state at that moment;
+	// archived after null means the food had been purged
+	rows, err := db.Query(`SELECT p.food_id, p.price, p.discount, p.names, p.created_at,
+						   COALESCE((s.changes->'archived'->'after')::text, 'false'), COALESCE(f.category, '')
+						   FROM (SELECT DISTINCT ON (food_id) food_id, price, discount, names, created_at
+								 FROM food_changes WHERE created_at <= $1 AND price IS NOT NULL`+foodFilter+`
+								 ORDER BY food_id, created_at DESC, id DESC) p
+						   LEFT JOIN (SELECT DISTINCT ON (food_id) food_id, changes FROM food_changes
+								 WHERE created_at <= $1 AND changes ? 'archived'`+foodFilter+`
+								 ORDER BY food_id, created_at DESC, id DESC) s ON s.food_id = p.food_id
+						   LEFT JOIN foods f ON f.id = p.food_id
+						   ORDER BY p.food_id`, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	defer rows.Close()
+
+	lang := getUserLanguage(c.Request.Header)
+	items := []gin.H{}
+	for rows.Next() {
+		var foodID int64
+		var price, discount int
+		var namesJSON []byte
+		var since time.Time
+		var archived, category string
+		if err := rows.Scan(&foodID, &price, &discount, &namesJSON, &since, &archived, &category); err != nil {
+			continue
+		}
+		if archived == "null" {
+			continue
+		}
+		var names map[string]string
+		if namesJSON != nil {
+			json.Unmarshal(namesJSON, &names)
+		}
+		effective := loggedFoodPrice(foodID, category, price, discount, at)
+		var promotion *AppliedPromotion
+		if effective.Promotion != nil {
+			promotion = effective.Promotion.summary(lang)
+		}
+		items = append(items, gin.H{
+			"food_id":         foodID,
+			"name":            localizedName(names, lang, ""),
+			"price":           price,
+			"discount":        discount,
+			"effective_price": effective.UnitPrice,
+			"promotion":       promotion,
+			"archived":        archived == "true",
+			"since":           since,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"at": at, "items": items, "total": len(items)})
+}
+
+// ========== FOOD HANDLERS ==========
+
+func getAllFoodsHandler(c *gin.Context) {
+	lang := getUserLanguage(c.Request.Header)
+	category := c.Query("category")
+	search := c.Query("search")
+	popular := c.Query("popular")
+	sortBy := c.Query("sort")
+	page, _ := strconv.Atoi(c.Query("page"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	if page <= 0 {
+		page = 1
+	}
+	if limit <= 0 {
+		limit = 20
+	}
+
+	// Check if admin or regular user
+	isAdmin := false
+	if userInterface, exists := c.Get("user"); exists {
+		user := userInterface.(*Claims)
+		isAdmin = user.allows(PermFoodsReadAll)
+	}
+
+	foods, err := getAllLocalizedFoods(lang, isAdmin)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	// Filtering
+	if category != "" {
+		filtered := []*Food{}
+		for _, food := range foods {
+			if strings.ToLower(food.Category) == strings.ToLower(category) {
+				filtered = append(filtered, food)
+			}
+		}
+		foods = filtered
+	}
+
+	if search != "" {
+		searchLower := strings.ToLower(search)
+		filtered := []*Food{}
+		for _, food := range foods {
+			if strings.Contains(strings.ToLower(food.Name), searchLower) ||
+				strings.Contains(strings.ToLower(food.Description), searchLower) {
+				filtered = append(filtered, food)
+			}
+		}
+		foods = filtered
+	}
+
+	if popular == "true" {
+		filtered := []*Food{}
+		for _, food := range foods {
+			if food.IsPopular {
+				filtered = append(filtered, food)
+			}
+		}
+		foods = filtered
+	}
+
+	// Sorting
+	switch sortBy {
+	case "price_asc":
+		sort.Slice(foods, func(i, j int) bool {
+			return foods[i].Price < foods[j].Price
+		})
+	case "price_desc":
+		sort.Slice(foods, func(i, j int) bool {
+			return foods[i].Price > foods[j].Price
+		})
+	case "rating":
+		sort.Slice(foods, func(i, j int) bool {
+			return foods[i].Rating > foods[j].Rating
+		})
+	case "popular":
+		sort.Slice(foods, func(i, j int) bool {
+			if foods[i].IsPopular != foods[j].IsPopular {
+				return foods[i].IsPopular
+			}
+			return foods[i].Rating > foods[j].Rating
+		})
+	case "name":
+		sort.Slice(foods, func(i, j int) bool {
+			return foods[i].Name < foods[j].Name
+		})
+	default:
+		// Default: ID ascending (1, 2, 3, 4...)
+		sort.Slice(foods, func(i, j int) bool {
+			return foods[i].ID < foods[j].ID
+		})
+	}
+
+	// Pagination
+	total := len(foods)
+	start := (page - 1) * limit
+	end := start + limit
+	if start >= total {
+		foods = []*Food{}
+	} else {
+		if end > total {
+			end = total
+		}
+		foods = foods[start:end]
+	}
+
+	// Make image URLs full URLs
+	hostURL := getHostURL(c)
+	for _, food := range foods {
+		absolutizeFoodURLs(food, hostURL)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"foods": foods,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+func getFoodHandler(c *gin.Context) {
+	foodIDStr := c.Param("food_id")
+	lang := getUserLanguage(c.Request.Header)
+
+	// Convert string ID to integer
+	foodID, err := strconv.ParseInt(foodIDStr, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
+		return
+	}
+
+	food, err := getFoodByID(foodID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if food.DeletedAt != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
+		return
+	}
+
+	localizedFood := getLocalizedFood(food, lang)
+	c.Header("ETag", foodETag(food))
+	if err := attachModifiers([]*Food{localizedFood}, lang, false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if _, err := attachComboComponents([]*Food{localizedFood}, lang, false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if err := attachFoodImages([]*Food{localizedFood}, lang); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	// Make image URLs full URLs
+	absolutizeFoodURLs(localizedFood, getHostURL(c))
+
+	c.JSON(http.StatusOK, localizedFood)
+}
+
+func createFoodHandler(c *gin.Context) {
+	var req FoodCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Printf("JSON binding error: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid JSON format",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	log.Printf("Received food creation request: %+v", req)
+
+	if !categoryExists(req.Category) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown category", "category": req.Category})
+		return
+	}
+
+	// Check if custom ID already exists
+	if req.CustomID != nil {
+		var exists bool
+		checkQuery := `SELECT EXISTS(SELECT 1 FROM foods WHERE id = $1)`
+		err := db.QueryRow(checkQuery, *req.CustomID).Scan(&exists)
+		if err != nil {
+			log.Printf("ID check error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "ID check error",
+				"details": err.Error(),
+			})
+			return
+		}
+		if exists {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("ID %d already exists", *req.CustomID)})
+			return
+		}
+	}
+
+	// Set defaults
+	if req.PreparationTime == 0 {
+		req.PreparationTime = 15
+	}
+	if req.Stock == 0 {
+		req.Stock = 100
+	}
+
+	// Create multilingual names
+	names := map[string]string{
+		"uz": req.NameUz,
+		"ru": req.NameRu,
+		"en": req.NameEn,
+	}
+
+	// Create multilingual descriptions
+	descriptions := map[string]string{
+		"uz": req.DescriptionUz,
+		"ru": req.DescriptionRu,
+		"en": req.DescriptionEn,
+	}
+
+	// Create multilingual ingredients
+	ingredients := map[string][]string{
+		"uz": req.IngredientsUz,
+		"ru": req.IngredientsRu,
+		"en": req.IngredientsEn,
+	}
+
+	// Create multilingual allergens
+	allergens := map[string][]string{
+		"uz": req.AllergensUz,
+		"ru": req.AllergensRu,
+		"en": req.AllergensEn,
+	}
+
+	food := &Food{
+		Names:           names,
+		Name:            req.NameUz, // Default Uzbek
+		Descriptions:    descriptions,
+		Description:     req.DescriptionUz, // Default Uzbek
+		Category:        req.Category,
+		Price:           req.Price,
+		IsThere:         req.IsThere,
+		ImageURL:        relativeUploadURL(req.ImageURL, c.Request.Host),
+		Ingredients:     ingredients,
+		Allergens:       allergens,
+		Rating:          req.StarRating, // Use star_rating from request
+		ReviewCount:     0,
+		PreparationTime: req.PreparationTime,
+		Stock:           req.Stock,
+		IsPopular:       req.IsPopular,
+		Discount:        req.Discount,
+		Comment:         req.Comment,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	log.Printf("Food object created: %+v", food)
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := createFoodWithCustomID(tx, food, req.CustomID); err != nil {
+		log.Printf("Food creation error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Food creation error",
+			"details": err.Error(),
+		})
+		return
+	}
+	if err := recordFoodChange(tx, c, food.ID, FoodChangeCreate, nil, foodSnapshot(foodDocumentOf(food))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food creation error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food creation error"})
+		return
+	}
+
+	// Update sequence if custom ID was used
+	if req.CustomID != nil {
+		if err := updateSequenceAfterManualInsert(); err != nil {
+			log.Printf("Sequence update warning: %v", err)
+		}
+	}
+
+	log.Printf("Food created successfully: ID=%d, Name=%s", food.ID, food.Name)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Food created successfully",
+		"food":    food,
+		"id_type": map[bool]string{true: "custom", false: "auto"}[req.CustomID != nil],
+	})
+}
+
+func updateFoodHandler(c *gin.Context) {
+	foodIDStr := c.Param("food_id")
+
+	// Convert string ID to integer
+	foodID, err := strconv.ParseInt(foodIDStr, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
+		return
+	}
+
+	food, err := getFoodByID(foodID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	if food.DeletedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Food is archived, restore it first"})
+		return
+	}
+	// Optional here for older clients; PATCH requires it
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" && ifMatch != "*" && ifMatch != foodETag(food) {
+		c.Header("ETag", foodETag(food))
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Food was modified by someone else", "etag": foodETag(food)})
+		return
+	}
+
+	var updates map[string]interface{}
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before := foodSnapshot(foodDocumentOf(food))
+
+	// Update fields. The flat name and description are the Uzbek texts, so
+	// the maps customers are served from are kept in step; PATCH edits
+	// every language.
+	if name, ok := updates["name"].(string); ok {
+		food.Name = name
+		if food.Names == nil {
+			food.Names = make(map[string]string)
+		}
+		food.Names["uz"] = name
+	}
+	if category, ok := updates["category"].(string); ok {
+		if !categoryExists(category) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown category", "category": category})
+			return
+		}
+		food.Category = category
+	}
+	if price, ok := updates["price"].(float64); ok {
+		food.Price = int(price)
+	}
+	if description, ok := updates["description"].(string); ok {
+		food.Description = description
+		if food.Descriptions == nil {
+			food.Descriptions = make(map[string]string)
+		}
+		food.Descriptions["uz"] = description
+	}
+	if isThere, ok := updates["isThere"].(bool); ok {
+		food.IsThere = isThere
+	}
+	if imageURL, ok := updates["imageUrl"].(string); ok {
+		food.ImageURL = relativeUploadURL(imageURL, c.Request.Host)
+	}
+	if prepTime, ok := updates["preparation_time"].(float64); ok {
+		food.PreparationTime = int(prepTime)
+	}
+	if stock, ok := updates["stock"].(float64); ok {
+		food.Stock = int(stock)
+	}
+	if isPopular, ok := updates["is_popular"].(bool); ok {
+		food.IsPopular = isPopular
+	}
+	if discount, ok := updates["discount"].(float64); ok {
+		food.Discount = int(discount)
+	}
+	if comment, ok := updates["comment"].(string); ok {
+		food.Comment = comment
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := updateFood(tx, food); err == sql.ErrNoRows {
+		// Changed between our read and write
+		if latest, err := getFoodByID(foodID); err == nil {
+			c.Header("ETag", foodETag(latest))
+		}
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Food was modified by someone else"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food update error"})
+		return
+	}
+	if err := recordFoodChange(tx, c, food.ID, FoodChangeUpdate, before, foodSnapshot(foodDocumentOf(food))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food update error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food update error"})
+		return
+	}
+
+	c.Header("ETag", foodETag(food))
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Food updated successfully",
+		"food":    food,
+	})
+}
+
+// deleteFoodHandler archives the food; see purgeFoodHandler for removing it
+func deleteFoodHandler(c *gin.Context) {
+	foodIDStr := c.Param("food_id")
+
+	// Convert string ID to integer
+	foodID, err := strconv.ParseInt(foodIDStr, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
+		return
+	}
+
+	// Check if food exists
+	food, err := getFoodByID(foodID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if food.DeletedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Food is already archived"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Archive food
+	query := `UPDATE foods SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1 AND deleted_at IS NULL`
+	result, err := tx.Exec(query, foodID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food deletion error"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Food is already archived"})
+		return
+	}
+	if err := recordFoodChange(tx, c, foodID, FoodChangeArchive,
+		map[string]interface{}{"archived": false}, map[string]interface{}{"archived": true}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food deletion error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food deletion error"})
+		return
+	}
+	recordAudit(c, "food.delete", "food", foodIDStr, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Food archived successfully"})
+}
+
+// ========== FOOD ARCHIVE ==========
+
+// Deleting a food archives it: it disappears from the menu and can't be
+// ordered, but reviews, galleries and the ids in past orders stay valid.
+// Only archived foods nothing points at can be purged for good.
+
+func getArchivedFoodsHandler(c *gin.Context) {
+	rows, err := db.Query(`SELECT id, names, name, category, price, deleted_at FROM foods
+						   WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	defer rows.Close()
+
+	lang := getUserLanguage(c.Request.Header)
+	items := []gin.H{}
+	for rows.Next() {
+		var food Food
+		var namesJSON []byte
+		var deletedAt time.Time
+		if err := rows.Scan(&food.ID, &namesJSON, &food.Name, &food.Category, &food.Price, &deletedAt); err != nil {
+			continue
+		}
+		if namesJSON != nil {
+			json.Unmarshal(namesJSON, &food.Names)
+		}
+		items = append(items, gin.H{
+			"id":            food.ID,
+			"name":          localizedName(food.Names, lang, food.Name),
+			"category":      food.Category,
+			"category_name": getCategoryName(food.Category, lang),
+			"price":         food.Price,
+			"deleted_at":    deletedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": items, "total": len(items)})
+}
+
+func restoreFoodHandler(c *gin.Context) {
+	foodID, err := strconv.ParseInt(c.Param("food_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE foods SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL`, foodID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food restore error"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Archived food not found"})
+		return
+	}
+	if err := recordFoodChange(tx, c, foodID, FoodChangeRestore,
+		map[string]interface{}{"archived": true}, map[string]interface{}{"archived": false}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food restore error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food restore error"})
+		return
+	}
+	recordAudit(c, "food.restore", "food", strconv.FormatInt(foodID, 10), nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Food restored successfully"})
+}
+
+// foodReferences counts what still points at a food from outside its own
+// rows: reviews, combos using it as a component and past orders
+func foodReferences(tx *sql.Tx, foodID int64) (gin.H, int, error) {
+	var reviews, combos, orders int
+	err := tx.QueryRow(`SELECT
+							(SELECT COUNT(*) FROM reviews WHERE food_id = $1),
+							(SELECT COUNT(*) FROM combo_slot_choices WHERE food_id = $1),
+							(SELECT COUNT(*) FROM orders WHERE jsonb_path_exists(foods,
+								'$[*] ? (@.id == $id || @.components[*].food_id == $id)', jsonb_build_object('id', $1::bigint)))`,
+		foodID).Scan(&reviews, &combos, &orders)
+	if err != nil {
+		return nil, 0, err
+	}
+	return gin.H{"reviews": reviews, "combos": combos, "orders": orders}, reviews + combos + orders, nil
+}
+
+// purgeFoodHandler permanently deletes an archived food, together with its
+// own modifiers, combo slots, gallery and schedules
+func purgeFoodHandler(c *gin.Context) {
+	foodID, err := strconv.ParseInt(c.Param("food_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var archived bool
+	err = tx.QueryRow(`SELECT deleted_at IS NOT NULL FROM foods WHERE id = $1 FOR UPDATE`, foodID).Scan(&archived)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if !archived {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only archived foods can be purged"})
+		return
+	}
+
+	references, total, err := foodReferences(tx, foodID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if total > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Food is still referenced", "references": references})
+		return
+	}
+
+	// Files are collected first; the gallery rows go with the food
+	fileIDs := foodFileIDs(foodID)
+
+	if _, err := tx.Exec(`DELETE FROM availability_schedules WHERE target_type = $1 AND target_id = $2`,
+		ScheduleTargetFood, strconv.FormatInt(foodID, 10)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food purge error"})
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM foods WHERE id = $1`, foodID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food purge error"})
+		return
+	}
+	if err := recordFoodChange(tx, c, foodID, FoodChangePurge,
+		map[string]interface{}{"archived": true}, map[string]interface{}{}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food purge error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food purge error"})
+		return
+	}
+	invalidateScheduleCache()
+	cleanupUnreferencedFiles(fileIDs)
+	recordAudit(c, "food.purge", "food", strconv.FormatInt(foodID, 10), nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Food purged successfully"})
+}
+
+// ========== FOOD MERGE-PATCH ==========
+
+// FoodDocument is the editable shape of a food for PATCH. Rating, review
+// count and timestamps are maintained by the server.
+type FoodDocument struct {
+	Names           map[string]string   `json:"names"`
+	Descriptions    map[string]string   `json:"descriptions"`
+	Category        string              `json:"category"`
+	Price           int                 `json:"price"`
+	IsThere         bool                `json:"isThere"`
+	ImageURL        string              `json:"imageUrl"`
+	Ingredients     map[string][]string `json:"ingredients"`
+	Allergens       map[string][]string `json:"allergens"`
+	PreparationTime int                 `json:"preparation_time"`
+	Stock           int                 `json:"stock"`
+	IsPopular       bool                `json:"is_popular"`
+	Discount        int                 `json:"discount"`
+	Comment         string              `json:"comment"`
+}
+
+var readOnlyFoodFields = map[string]bool{
+	"id": true, "name": true, "description": true, "category_name": true, "rating": true,
+	"review_count": true, "original_price": true, "created_at": true, "updated_at": true,
+	"modifiers": true, "components": true, "images": true, "promotion": true,
+}
+
+func foodDocumentOf(food *Food) FoodDocument {
+	return FoodDocument{
+		Names:           food.Names,
+		Descriptions:    food.Descriptions,
+		Category:        food.Category,
+		Price:           food.Price,
+		IsThere:         food.IsThere,
+		ImageURL:        food.ImageURL,
+		Ingredients:     food.Ingredients,
+		Allergens:       food.Allergens,
+		PreparationTime: food.PreparationTime,
+		Stock:           food.Stock,
+		IsPopular:       food.IsPopular,
+		Discount:        food.Discount,
+		Comment:         food.Comment,
+	}
+}
+
+// foodETag changes whenever the row does; updated_at is kept by a trigger
+func foodETag(food *Food) string {
+	return fmt.Sprintf(`"%d-%d"`, food.ID, food.UpdatedAt.UnixMicro())
+}
+
+// mergePatch applies an RFC 7396 JSON merge patch: objects merge
+// recursively, null removes a member and anything else replaces it
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// decodeFoodDocument turns the merged document back into its typed form
+// member by member, so a wrong type is reported against its own field
+func decodeFoodDocument(merged map[string]interface{}) (FoodDocument, map[string]string) {
+	var doc FoodDocument
+	fields := map[string]interface{}{
+		"names":            &doc.Names,
+		"descriptions":     &doc.Descriptions,
+		"category":         &doc.Category,
+		"price":            &doc.Price,
+		"isThere":          &doc.IsThere,
+		"imageUrl":         &doc.ImageURL,
+		"ingredients":      &doc.Ingredients,
+		"allergens":        &doc.Allergens,
+		"preparation_time": &doc.PreparationTime,
+		"stock":            &doc.Stock,
+		"is_popular":       &doc.IsPopular,
+		"discount":         &doc.Discount,
+		"comment":          &doc.Comment,
+	}
+
+	problems := make(map[string]string)
+	for key, value := range merged {
+		target, known := fields[key]
+		if !known {
+			problems[key] = "unknown field"
+			continue
+		}
+		raw, _ := json.Marshal(value)
+		if err := json.Unmarshal(raw, target); err != nil {
+			problems[key] = "wrong type"
+		}
+	}
+	return doc, problems
+}
+
+func validateLanguageKeys(field string, langs []string, problems map[string]string) {
+	for _, lang := range langs {
+		if !isSupportedLanguage(lang) {
+			problems[field+"."+lang] = "unsupported language"
+		}
+	}
+}
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func validateFoodDocument(doc *FoodDocument, problems map[string]string) {
+	if strings.TrimSpace(doc.Names["uz"]) == "" {
+		problems["names.uz"] = "required"
+	}
+	validateLanguageKeys("names", mapKeys(doc.Names), problems)
+	for lang, name := range doc.Names {
+		if len(name) > 255 {
+			problems["names."+lang] = "must be at most 255 characters"
+		}
+	}
+	validateLanguageKeys("descriptions", mapKeys(doc.Descriptions), problems)
+	validateLanguageKeys("ingredients", mapKeys(doc.Ingredients), problems)
+	validateLanguageKeys("allergens", mapKeys(doc.Allergens), problems)
+
+	if doc.Category == "" {
+		problems["category"] = "required"
+	} else if !categoryExists(doc.Category) {
+		problems["category"] = "unknown category"
+	}
+	if doc.Price <= 0 {
+		problems["price"] = "must be positive"
+	}
+	if doc.Discount < 0 || doc.Discount > 100 {
+		problems["discount"] = "must be between 0 and 100"
+	}
+	if doc.Stock < 0 {
+		problems["stock"] = "must not be negative"
+	}
+	if doc.PreparationTime < 0 || doc.PreparationTime > 600 {
+		problems["preparation_time"] = "must be between 0 and 600 minutes"
+	}
+	if len(doc.Comment) > 2000 {
+		problems["comment"] = "must be at most 2000 characters"
+	}
+}
+
+// patchFoodHandler edits a food with an RFC 7396 merge patch. The client
+// sends the ETag it read in If-Match; a food changed since then yields 412
+// with the current ETag instead of silently overwriting the other edit.
+func patchFoodHandler(c *gin.Context) {
+	foodID, err := strconv.ParseInt(c.Param("food_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
+		return
+	}
+
+	contentType := strings.TrimSpace(strings.Split(c.GetHeader("Content-Type"), ";")[0])
+	if contentType != "application/merge-patch+json" && contentType != "application/json" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Use Content-Type: application/merge-patch+json"})
+		return
+	}
+
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header required"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body read error"})
+		return
+	}
+	var patch interface{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON", "details": err.Error()})
+		return
+	}
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Patch must be a JSON object"})
+		return
+	}
+
+	food, err := getFoodByID(foodID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	if food.DeletedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Food is archived, restore it first"})
+		return
+	}
+	if ifMatch != "*" && ifMatch != foodETag(food) {
+		c.Header("ETag", foodETag(food))
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Food was modified by someone else", "etag": foodETag(food)})
+		return
+	}
+
+	problems := make(map[string]string)
+	for key := range patchObject {
+		if readOnlyFoodFields[key] {
+			problems[key] = "read-only"
+		}
+	}
+
+	// Merge over the current document through its JSON form
+	current, _ := json.Marshal(foodDocumentOf(food))
+	var target map[string]interface{}
+	json.Unmarshal(current, &target)
+	merged, _ := mergePatch(target, patchObject).(map[string]interface{})
+	for key := range readOnlyFoodFields {
+		delete(merged, key)
+	}
+
+	doc, decodeProblems := decodeFoodDocument(merged)
+	for field, problem := range decodeProblems {
+		problems[field] = problem
+	}
+	doc.ImageURL = relativeUploadURL(doc.ImageURL, c.Request.Host)
+	if len(problems) == 0 {
+		validateFoodDocument(&doc, problems)
+	}
+	if len(problems) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Validation failed", "fields": problems})
+		return
+	}
+
+	namesJSON, _ := json.Marshal(doc.Names)
+	descriptionsJSON, _ := json.Marshal(doc.Descriptions)
+	ingredientsJSON, _ := json.Marshal(doc.Ingredients)
+	allergensJSON, _ := json.Marshal(doc.Allergens)
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// The flat name/description columns mirror the Uzbek text
+	before := foodSnapshot(foodDocumentOf(food))
+	err = tx.QueryRow(`UPDATE foods SET names = $3, name = $4, descriptions = $5, description = $6,
+					   category = $7, price = $8, is_there = $9, image_url = $10, ingredients = $11,
+					   allergens = $12, preparation_time = $13, stock = $14, is_popular = $15,
+					   discount = $16, comment = $17, updated_at = CURRENT_TIMESTAMP
+					   WHERE id = $1 AND updated_at = $2 RETURNING updated_at`,
+		foodID, food.UpdatedAt, namesJSON, doc.Names["uz"], descriptionsJSON, doc.Descriptions["uz"],
+		doc.Category, doc.Price, doc.IsThere, doc.ImageURL, ingredientsJSON, allergensJSON,
+		doc.PreparationTime, doc.Stock, doc.IsPopular, doc.Discount, doc.Comment).Scan(&food.UpdatedAt)
+	if err == sql.ErrNoRows {
+		// Changed between our read and write
+		if latest, err := getFoodByID(foodID); err == nil {
+			c.Header("ETag", foodETag(latest))
+		}
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Food was modified by someone else"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food update error"})
+		return
+	}
+	if err := recordFoodChange(tx, c, foodID, FoodChangeUpdate, before, foodSnapshot(doc)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food update error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food update error"})
+		return
+	}
+	recordAudit(c, "food.patch", "food", strconv.FormatInt(foodID, 10), patchObject)
+
+	updated, err := getFoodByID(foodID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	c.Header("ETag", foodETag(updated))
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Food updated successfully",
+		"food":    updated,
+	})
+}
+
+// ========== MENU IMPORT / EXPORT ==========
+
+// The spreadsheet has one row per food and one column per language for
+// every translated field. Lists (ingredients, allergens) are separated
+// by ";". Empty cells keep the current value of an existing food and
+// take the usual defaults for a new one.
+
+var menuLanguages = []string{"uz", "ru", "en"}
+
+func menuColumns() []string {
+	columns := []string{"id"}
+	for _, field := range []string{"name", "description"} {
+		for _, lang := range menuLanguages {
+			columns = append(columns, field+"_"+lang)
+		}
+	}
+	columns = append(columns, "category", "price", "discount", "isThere", "stock",
+		"preparation_time", "is_popular", "imageUrl")
+	for _, field := range []string{"ingredients", "allergens"} {
+		for _, lang := range menuLanguages {
+			columns = append(columns, field+"_"+lang)
+		}
+	}
+	return append(columns, "comment")
+}
+
+type MenuImportError struct {
+	Row   int    `json:"row"`
+	Field string `json:"field,omitempty"`
+	Error string `json:"error"`
+}
+
+type menuImportRow struct {
+	Row      int
+	ID       *int64
+	Existing *Food
+	Before   map[string]interface{}
+	Doc      FoodDocument
+}
+
+func foodToMenuRow(food *Food) []string {
+	row := []string{strconv.FormatInt(food.ID, 10)}
+	for _, texts := range []map[string]string{food.Names, food.Descriptions} {
+		for _, lang := range menuLanguages {
+			row = append(row, texts[lang])
+		}
+	}
+	row = append(row, food.Category, strconv.Itoa(food.Price), strconv.Itoa(food.Discount),
+		strconv.FormatBool(food.IsThere), strconv.Itoa(food.Stock), strconv.Itoa(food.PreparationTime),
+		strconv.FormatBool(food.IsPopular), food.ImageURL)
+	for _, lists := range []map[string][]string{food.Ingredients, food.Allergens} {
+		for _, lang := range menuLanguages {
+			row = append(row, strings.Join(lists[lang], "; "))
+		}
+	}
+	return append(row, food.Comment)
+}
+
+func parseIntCell(value string) (int, error) {
+	if number, err := strconv.Atoi(value); err == nil {
+		return number, nil
+	}
+	// Spreadsheets sometimes store whole numbers as 23000.0
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number != math.Trunc(number) {
+		return 0, errors.New("must be a whole number")
+	}
+	return int(number), nil
+}
+
+func parseBoolCell(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "1", "yes", "ha":
+		return true, nil
+	case "false", "0", "no", "yo'q":
+		return false, nil
+	}
+	return false, errors.New("must be true or false")
+}
+
+func parseListCell(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// planMenuImport validates every row against the current menu without
+// writing anything. Header problems are returned as an error.
+func planMenuImport(rows [][]string, host string) ([]*menuImportRow, []MenuImportError, error) {
+	existing := make(map[int64]*Food)
+	foods, err := getAllFoodsForAdmin()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, food := range foods {
+		existing[food.ID] = food
+	}
+	archived := make(map[int64]bool)
+	archivedRows, err := db.Query(`SELECT id FROM foods WHERE deleted_at IS NOT NULL`)
+	if err != nil {
+		return nil, nil, err
+	}
+	for archivedRows.Next() {
+		var id int64
+		if archivedRows.Scan(&id) == nil {
+			archived[id] = true
+		}
+	}
+	archivedRows.Close()
+
+	return planMenuRows(rows, host, existing, archived)
+}
+
+// planMenuRows is planMenuImport with the stored foods, live and archived,
+// passed in
+func planMenuRows(rows [][]string, host string, existing map[int64]*Food, archived map[int64]bool) ([]*menuImportRow, []MenuImportError, error) {
+	if len(rows) == 0 {
+		return nil, nil, errors.New("file is empty")
+	}
+
+	known := make(map[string]bool)
+	for _, column := range append(menuColumns(), "custom_id") {
+		known[column] = true
+	}
+	index := make(map[string]int)
+	for i, name := range rows[0] {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, nil, fmt.Errorf("unknown column %q", name)
+		}
+		if _, dup := index[name]; dup {
+			return nil, nil, fmt.Errorf("duplicate column %q", name)
+		}
+		index[name] = i
+	}
+
+	var plan []*menuImportRow
+	var problems []MenuImportError
+	seenIDs := make(map[int64]int)
+
+	for i, cells := range rows[1:] {
+		line := i + 2 // spreadsheet row number, the header is row 1
+		cell := func(column string) (string, bool) {
+			position, ok := index[column]
+			if !ok || position >= len(cells) {
+				return "", false
+			}
+			value := strings.TrimSpace(cells[position])
+			return value, value != ""
+		}
+
+		blank := true
+		for _, value := range cells {
+			if strings.TrimSpace(value) != "" {
+				blank = false
+				break
+			}
+		}
+		if blank {
+			continue
+		}
+
+		rowProblems := make(map[string]string)
+		entry := &menuImportRow{Row: line}
+
+		idColumn := "id"
+		idValue, hasID := cell("id")
+		if customID, ok := cell("custom_id"); ok {
+			if hasID && customID != idValue {
+				rowProblems["custom_id"] = "conflicts with id"
+			}
+			idColumn, idValue, hasID = "custom_id", customID, true
+		}
+		if hasID {
+			id, err := strconv.ParseInt(idValue, 10, 64)
+			if err != nil || id <= 0 {
+				rowProblems[idColumn] = "must be a positive whole number"
+			} else if previous, dup := seenIDs[id]; dup {
+				rowProblems[idColumn] = fmt.Sprintf("same id as row %d", previous)
+			} else if archived[id] {
+				rowProblems[idColumn] = "food is archived, restore it first"
+			} else {
+				seenIDs[id] = line
+				entry.ID = &id
+				entry.Existing = existing[id]
+			}
+		}
+
+		// Start from the stored food or from the createFoodHandler defaults
+		if entry.Existing != nil {
+			entry.Before = foodSnapshot(foodDocumentOf(entry.Existing))
+			entry.Doc = foodDocumentOf(entry.Existing)
+			// The cells are written into these maps; the stored food keeps its own
+			entry.Doc.Names = maps.Clone(entry.Doc.Names)
+			entry.Doc.Descriptions = maps.Clone(entry.Doc.Descriptions)
+			entry.Doc.Ingredients = maps.Clone(entry.Doc.Ingredients)
+			entry.Doc.Allergens = maps.Clone(entry.Doc.Allergens)
+		} else {
+			entry.Doc = FoodDocument{IsThere: true, PreparationTime: 15, Stock: 100}
+		}
+		doc := &entry.Doc
+		if doc.Names == nil {
+			doc.Names = make(map[string]string)
+		}
+		if doc.Descriptions == nil {
+			doc.Descriptions = make(map[string]string)
+		}
+		if doc.Ingredients == nil {
+			doc.Ingredients = make(map[string][]string)
+		}
+		if doc.Allergens == nil {
+			doc.Allergens = make(map[string][]string)
+		}
 
-	// Create multilingual descriptions
-	descriptions := map[string]string{
-		"uz": req.DescriptionUz,
-		"ru": req.DescriptionRu,
-		"en": req.DescriptionEn,
-	}
+		for _, lang := range menuLanguages {
+			if value, ok := cell("name_" + lang); ok {
+				doc.Names[lang] = value
+			}
+			if value, ok := cell("description_" + lang); ok {
+				doc.Descriptions[lang] = value
+			}
+			if value, ok := cell("ingredients_" + lang); ok {
+				doc.Ingredients[lang] = parseListCell(value)
+			}
+			if value, ok := cell("allergens_" + lang); ok {
+				doc.Allergens[lang] = parseListCell(value)
+			}
+		}
+		if value, ok := cell("category"); ok {
+			doc.Category = value
+		}
+		if value, ok := cell("imageUrl"); ok {
+			doc.ImageURL = relativeUploadURL(value, host)
+		}
+		if value, ok := cell("comment"); ok {
+			doc.Comment = value
+		}
+		for column, target := range map[string]*int{
+			"price": &doc.Price, "discount": &doc.Discount, "stock": &doc.Stock,
+			"preparation_time": &doc.PreparationTime,
+		} {
+			if value, ok := cell(column); ok {
+				number, err := parseIntCell(value)
+				if err != nil {
+					rowProblems[column] = err.Error()
+					continue
+				}
+				*target = number
+			}
+		}
+		for column, target := range map[string]*bool{"isThere": &doc.IsThere, "is_popular": &doc.IsPopular} {
+			if value, ok := cell(column); ok {
+				flag, err := parseBoolCell(value)
+				if err != nil {
+					rowProblems[column] = err.Error()
+					continue
+				}
+				*target = flag
+			}
+		}
 
-	// Create multilingual ingredients
-	ingredients := map[string][]string{
-		"uz": req.IngredientsUz,
-		"ru": req.IngredientsRu,
-		"en": req.IngredientsEn,
+		// A cell that didn't parse keeps its own message
+		checks := make(map[string]string)
+		validateFoodDocument(doc, checks)
+		for field, problem := range checks {
+			if _, exists := rowProblems[field]; !exists {
+				rowProblems[field] = problem
+			}
+		}
+		if len(rowProblems) > 0 {
+			fields := mapKeys(rowProblems)
+			sort.Strings(fields)
+			for _, field := range fields {
+				problems = append(problems, MenuImportError{Row: line, Field: field, Error: rowProblems[field]})
+			}
+			continue
+		}
+		plan = append(plan, entry)
 	}
 
-	// Create multilingual allergens
-	allergens := map[string][]string{
-		"uz": req.AllergensUz,
-		"ru": req.AllergensRu,
-		"en": req.AllergensEn,
-	}
+	return plan, problems, nil
+}
 
-	food := &Food{
-		Names:           names,
-		Name:            req.NameUz, // Default Uzbek
-		Descriptions:    descriptions,
-		Description:     req.DescriptionUz, // Default Uzbek
-		Category:        req.Category,
-		Price:           req.Price,
-		IsThere:         req.IsThere,
-		ImageURL:        req.ImageURL,
-		Ingredients:     ingredients,
-		Allergens:       allergens,
-		Rating:          req.StarRating, // Use star_rating from request
-		ReviewCount:     0,
-		PreparationTime: req.PreparationTime,
-		Stock:           req.Stock,
-		IsPopular:       req.IsPopular,
-		Discount:        req.Discount,
-		Comment:         req.Comment,
-		CreatedAt:       time.Now(),
-		UpdatedAt:       time.Now(),
+func applyMenuImport(tx *sql.Tx, c *gin.Context, plan []*menuImportRow) error {
+	for _, entry := range plan {
+		doc := entry.Doc
+		namesJSON, _ := json.Marshal(doc.Names)
+		descriptionsJSON, _ := json.Marshal(doc.Descriptions)
+		ingredientsJSON, _ := json.Marshal(doc.Ingredients)
+		allergensJSON, _ := json.Marshal(doc.Allergens)
+		args := []interface{}{namesJSON, doc.Names["uz"], descriptionsJSON, doc.Descriptions["uz"],
+			doc.Category, doc.Price, doc.IsThere, doc.ImageURL, ingredientsJSON, allergensJSON,
+			doc.PreparationTime, doc.Stock, doc.IsPopular, doc.Discount, doc.Comment}
+
+		var foodID int64
+		var err error
+		switch {
+		case entry.Existing != nil:
+			_, err = tx.Exec(`UPDATE foods SET names = $2, name = $3, descriptions = $4, description = $5,
+							  category = $6, price = $7, is_there = $8, image_url = $9, ingredients = $10,
+							  allergens = $11, preparation_time = $12, stock = $13, is_popular = $14,
+							  discount = $15, comment = $16, updated_at = CURRENT_TIMESTAMP WHERE id = $1`,
+				append([]interface{}{*entry.ID}, args...)...)
+		case entry.ID != nil:
+			_, err = tx.Exec(`INSERT INTO foods (id, names, name, descriptions, description, category, price,
+							  is_there, image_url, ingredients, allergens, preparation_time, stock, is_popular,
+							  discount, comment) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13,
+							  $14, $15, $16)`, append([]interface{}{*entry.ID}, args...)...)
+		default:
+			err = tx.QueryRow(`INSERT INTO foods (names, name, descriptions, description, category, price,
+							  is_there, image_url, ingredients, allergens, preparation_time, stock, is_popular,
+							  discount, comment) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13,
+							  $14, $15) RETURNING id`, args...).Scan(&foodID)
+		}
+		if err != nil {
+			return fmt.Errorf("row %d: %w", entry.Row, err)
+		}
+		if entry.ID != nil {
+			foodID = *entry.ID
+		}
+		if err := recordFoodChange(tx, c, foodID, FoodChangeImport, entry.Before, foodSnapshot(doc)); err != nil {
+			return fmt.Errorf("row %d: %w", entry.Row, err)
+		}
 	}
+	return nil
+}
 
-	log.Printf("Food object created: %+v", food)
-
-	if err := createFoodWithCustomID(food, req.CustomID); err != nil {
-		log.Printf("Food creation error: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Food creation error",
-			"details": err.Error(),
-		})
+// exportFoodsHandler writes the whole menu, ?format=csv (default) or xlsx
+func exportFoodsHandler(c *gin.Context) {
+	foods, err := getAllFoodsForAdmin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
 		return
 	}
 
-	// Update sequence if custom ID was used
-	if req.CustomID != nil {
-		if err := updateSequenceAfterManualInsert(); err != nil {
-			log.Printf("Sequence update warning: %v", err)
+	rows := [][]string{menuColumns()}
+	for _, food := range foods {
+		rows = append(rows, foodToMenuRow(food))
+	}
+
+	fileName := "menu_" + time.Now().Format("2006-01-02")
+	switch c.DefaultQuery("format", "csv") {
+	case "csv":
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, fileName))
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Writer.WriteString("\uFEFF") // lets Excel detect UTF-8 for the Cyrillic columns
+		writer := csv.NewWriter(c.Writer)
+		writer.WriteAll(rows)
+	case "xlsx":
+		var buf bytes.Buffer
+		if err := writeXLSX(&buf, "Menu", rows); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Export error"})
+			return
 		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.xlsx"`, fileName))
+		c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", buf.Bytes())
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or xlsx"})
 	}
-
-	log.Printf("Food created successfully: ID=%d, Name=%s", food.ID, food.Name)
-
-	c.JSON(http.StatusCreated, gin.H{
-		"message": "Food created successfully",
-		"food":    food,
-		"id_type": map[bool]string{true: "custom", false: "auto"}[req.CustomID != nil],
-	})
 }
 
-func updateFoodHandler(c *gin.Context) {
-	foodIDStr := c.Param("food_id")
+// importFoodsHandler upserts foods from an uploaded .csv or .xlsx. Any row
+// error rejects the whole file; ?dry_run=true only reports what would happen.
+func importFoodsHandler(c *gin.Context) {
+	dryRun := c.Query("dry_run") == "true"
 
-	// Convert string ID to integer
-	foodID, err := strconv.ParseInt(foodIDStr, 10, 64)
+	file, fileHeader, err := c.Request.FormFile("file")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file selected"})
+		return
+	}
+	defer file.Close()
+	if fileHeader.Size > config.Upload.MaxFileSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File too large"})
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File read error"})
 		return
 	}
 
-	food, err := getFoodByID(foodID)
+	var rows [][]string
+	switch strings.ToLower(filepath.Ext(fileHeader.Filename)) {
+	case ".csv":
+		reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\uFEFF"))))
+		reader.FieldsPerRecord = -1
+		rows, err = reader.ReadAll()
+	case ".xlsx":
+		rows, err = readXLSX(data)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only .csv and .xlsx files are supported"})
+		return
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File parse error", "details": err.Error()})
 		return
 	}
 
-	var updates map[string]interface{}
-	if err := c.ShouldBindJSON(&updates); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	plan, problems, err := planMenuImport(rows, c.Request.Host)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file", "details": err.Error()})
 		return
 	}
 
-	// Update fields
-	if name, ok := updates["name"].(string); ok {
-		food.Name = name
+	created, updated := 0, 0
+	for _, entry := range plan {
+		if entry.Existing != nil {
+			updated++
+		} else {
+			created++
+		}
 	}
-	if category, ok := updates["category"].(string); ok {
-		food.Category = category
+	summary := gin.H{
+		"dry_run": dryRun,
+		"rows":    len(plan) + len(problems),
+		"created": created,
+		"updated": updated,
+		"errors":  problems,
 	}
-	if price, ok := updates["price"].(float64); ok {
-		food.Price = int(price)
+	if problems == nil {
+		summary["errors"] = []MenuImportError{}
 	}
-	if description, ok := updates["description"].(string); ok {
-		food.Description = description
+
+	if len(problems) > 0 {
+		summary["error"] = "Validation failed, nothing was imported"
+		c.JSON(http.StatusUnprocessableEntity, summary)
+		return
 	}
-	if isThere, ok := updates["isThere"].(bool); ok {
-		food.IsThere = isThere
+	if dryRun {
+		c.JSON(http.StatusOK, summary)
+		return
 	}
-	if imageURL, ok := updates["imageUrl"].(string); ok {
-		food.ImageURL = imageURL
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
 	}
-	if prepTime, ok := updates["preparation_time"].(float64); ok {
-		food.PreparationTime = int(prepTime)
+	defer tx.Rollback()
+
+	if err := applyMenuImport(tx, c, plan); err != nil {
+		log.Printf("Menu import error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Import error, nothing was imported", "details": err.Error()})
+		return
 	}
-	if stock, ok := updates["stock"].(float64); ok {
-		food.Stock = int(stock)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Import error, nothing was imported"})
+		return
 	}
-	if isPopular, ok := updates["is_popular"].(bool); ok {
-		food.IsPopular = isPopular
+
+	if err := updateSequenceAfterManualInsert(); err != nil {
+		log.Printf("Sequence update warning: %v", err)
 	}
-	if discount, ok := updates["discount"].(float64); ok {
-		food.Discount = int(discount)
+	recordAudit(c, "food.import", "food", "", gin.H{"file": fileHeader.Filename, "created": created, "updated": updated})
+
+	summary["message"] = "Menu imported successfully"
+	c.JSON(http.StatusOK, summary)
+}
+
+// ========== XLSX ==========
+
+// Just enough of SpreadsheetML to exchange one sheet of text and numbers
+// with Excel, LibreOffice and Google Sheets.
+
+const xlsxMainNS = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+
+func xlsxColumnName(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('A'+(index-1)%26)) + name
 	}
+	return name
+}
 
-	food.UpdatedAt = time.Now()
+// xlsxColumnIndex turns the letters of a cell reference ("BC12") into a
+// zero-based column
+func xlsxColumnIndex(ref string) int {
+	index := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		index = index*26 + int(r-'A') + 1
+	}
+	return index - 1
+}
 
-	if err := updateFood(food); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food update error"})
-		return
+func writeXLSX(w io.Writer, sheetName string, rows [][]string) error {
+	archive := zip.NewWriter(w)
+	files := []struct{ name, body string }{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+	}
+
+	var name bytes.Buffer
+	xml.EscapeText(&name, []byte(sheetName))
+	files = append(files, struct{ name, body string }{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="` + xlsxMainNS + `" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="` + name.String() + `" sheetId="1" r:id="rId1"/></sheets></workbook>`})
+
+	var sheet bytes.Buffer
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	sheet.WriteString(`<worksheet xmlns="` + xlsxMainNS + `"><sheetData>`)
+	for r, row := range rows {
+		fmt.Fprintf(&sheet, `<row r="%d">`, r+1)
+		for col, value := range row {
+			ref := fmt.Sprintf("%s%d", xlsxColumnName(col), r+1)
+			if _, err := strconv.Atoi(value); err == nil && r > 0 && (value == "0" || !strings.HasPrefix(value, "0")) {
+				fmt.Fprintf(&sheet, `<c r="%s"><v>%s</v></c>`, ref, value)
+				continue
+			}
+			fmt.Fprintf(&sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(&sheet, []byte(value))
+			sheet.WriteString(`</t></is></c>`)
+		}
+		sheet.WriteString(`</row>`)
 	}
+	sheet.WriteString(`</sheetData></worksheet>`)
+	files = append(files, struct{ name, body string }{"xl/worksheets/sheet1.xml", sheet.String()})
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Food updated successfully",
-		"food":    food,
-	})
+	for _, file := range files {
+		part, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(part, file.body); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
 }
 
-func deleteFoodHandler(c *gin.Context) {
-	foodIDStr := c.Param("food_id")
+type xlsxRelationships struct {
+	Items []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
 
-	// Convert string ID to integer
-	foodID, err := strconv.ParseInt(foodIDStr, 10, 64)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID format"})
-		return
+type xlsxWorkbook struct {
+	Sheets []struct {
+		RelID string `xml:"id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxText struct {
+	T string `xml:"t"`
+	R []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	text := t.T
+	for _, run := range t.R {
+		text += run.T
 	}
+	return text
+}
 
-	// Check if food exists
-	_, err = getFoodByID(foodID)
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string   `xml:"r,attr"`
+			Type   string   `xml:"t,attr"`
+			Value  string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSX returns the first sheet as text rows
+func readXLSX(data []byte) ([][]string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
-			return
+		return nil, fmt.Errorf("not an xlsx file: %v", err)
+	}
+	parts := make(map[string]*zip.File)
+	for _, file := range archive.File {
+		parts[file.Name] = file
+	}
+	decode := func(name string, target interface{}) error {
+		file, ok := parts[name]
+		if !ok {
+			return fmt.Errorf("missing %s", name)
+		}
+		if file.UncompressedSize64 > 50<<20 {
+			return fmt.Errorf("%s is too large", name)
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		return xml.NewDecoder(reader).Decode(target)
+	}
+
+	// The first sheet of the workbook, through its relationship
+	sheetPath := "xl/worksheets/sheet1.xml"
+	var workbook xlsxWorkbook
+	var rels xlsxRelationships
+	if decode("xl/workbook.xml", &workbook) == nil && decode("xl/_rels/workbook.xml.rels", &rels) == nil &&
+		len(workbook.Sheets) > 0 {
+		for _, rel := range rels.Items {
+			if rel.ID == workbook.Sheets[0].RelID {
+				if strings.HasPrefix(rel.Target, "/") {
+					sheetPath = strings.TrimPrefix(rel.Target, "/")
+				} else {
+					sheetPath = "xl/" + rel.Target
+				}
+			}
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
-		return
 	}
 
-	// Delete food
-	query := `DELETE FROM foods WHERE id = $1`
-	_, err = db.Exec(query, foodID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Food deletion error"})
-		return
+	var shared struct {
+		Items []xlsxText `xml:"si"`
+	}
+	if _, ok := parts["xl/sharedStrings.xml"]; ok {
+		if err := decode("xl/sharedStrings.xml", &shared); err != nil {
+			return nil, err
+		}
+	}
+
+	var sheet xlsxSheet
+	if err := decode(sheetPath, &sheet); err != nil {
+		return nil, err
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Food deleted successfully"})
+	rows := [][]string{}
+	for _, row := range sheet.Rows {
+		cells := []string{}
+		for position, cell := range row.Cells {
+			col := position
+			if cell.Ref != "" {
+				col = xlsxColumnIndex(cell.Ref)
+			}
+			for len(cells) <= col {
+				cells = append(cells, "")
+			}
+			switch cell.Type {
+			case "s":
+				index, err := strconv.Atoi(cell.Value)
+				if err != nil || index < 0 || index >= len(shared.Items) {
+					return nil, fmt.Errorf("cell %s: bad shared string", cell.Ref)
+				}
+				cells[col] = shared.Items[index].String()
+			case "inlineStr":
+				cells[col] = cell.Inline.String()
+			case "b":
+				cells[col] = map[string]string{"1": "true", "0": "false"}[cell.Value]
+			default:
+				cells[col] = cell.Value
+			}
+		}
+		rows = append(rows, cells)
+	}
+	return rows, nil
 }
 
 // ========== ORDER HANDLERS ==========
@@ -1953,12 +11393,48 @@ func createOrderHandler(c *gin.Context) {
 		return
 	}
 
+	// Contact numbers are stored in E.164 like account numbers
+	if phone, ok := req.DeliveryInfo["phone"].(string); ok && phone != "" {
+		normalized, err := normalizePhone(phone)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery phone number"})
+			return
+		}
+		req.DeliveryInfo["phone"] = normalized
+	}
+	if req.CustomerInfo != nil && req.CustomerInfo.Phone != "" && !bindPhone(c, &req.CustomerInfo.Phone) {
+		return
+	}
+
+	var savedAddress *SavedAddress
+	if req.AddressID != nil && req.DeliveryType == DeliveryHome {
+		address, err := getSavedAddress(user.UserID, *req.AddressID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Saved address not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Address fetch error"})
+			return
+		}
+		savedAddress = address
+	}
+
 	log.Printf("Creating order for user: %s, items count: %d", user.Number, len(req.Items))
 
 	// Check foods and stock
 	var orderedFoods []OrderFood
 	totalPrice := 0
 	totalPrepTime := 0
+	stockNeeded := make(map[int64]int) // food id -> portions, combo components included
+	pricedAt := restaurantNow()        // one moment for schedules and promotions
+
+	// Buy X get Y counts every line of the same food together; the free
+	// portions go to the first lines
+	foodQuantities := make(map[int64]int)
+	for _, item := range req.Items {
+		foodQuantities[item.FoodID] += item.Quantity
+	}
+	freeLeft := make(map[int64]int)
 
 	for _, item := range req.Items {
 		log.Printf("Processing food_id: %d, quantity: %d", item.FoodID, item.Quantity)
@@ -1974,7 +11450,7 @@ func createOrderHandler(c *gin.Context) {
 			return
 		}
 
-		if !food.IsThere || food.Stock <= 0 {
+		if food.DeletedAt != nil || !food.IsThere || food.Stock <= 0 || !categoryIsActive(food.Category) {
 			log.Printf("Food not available: isThere=%v, stock=%d", food.IsThere, food.Stock)
 			c.JSON(http.StatusBadRequest, gin.H{
 				"error":   "Food not available",
@@ -1982,22 +11458,72 @@ func createOrderHandler(c *gin.Context) {
 			})
 			return
 		}
-
-		// Check stock
-		if food.Stock < item.Quantity {
-			log.Printf("Insufficient stock: required=%d, available=%d", item.Quantity, food.Stock)
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error":     "Insufficient stock",
-				"food_id":   item.FoodID,
-				"required":  item.Quantity,
-				"available": food.Stock,
-			})
+
+		if !foodScheduledAt(food.ID, food.Category, pricedAt) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Food not available at this time",
+				"food_id": item.FoodID,
+			})
+			return
+		}
+
+		// Check stock
+		if food.Stock < item.Quantity {
+			log.Printf("Insufficient stock: required=%d, available=%d", item.Quantity, food.Stock)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":     "Insufficient stock",
+				"food_id":   item.FoodID,
+				"required":  item.Quantity,
+				"available": food.Stock,
+			})
+			return
+		}
+
+		localizedFood := getLocalizedFood(food, "uz")
+		options, problem, err := resolveModifierSelection(food.ID, item.OptionIDs, "uz")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Modifier fetch error"})
+			return
+		}
+		if problem != nil {
+			problem["food_id"] = item.FoodID
+			c.JSON(http.StatusBadRequest, problem)
+			return
+		}
+
+		combo, problem, err := resolveComboSelection(food.ID, item, "uz")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Combo fetch error"})
+			return
+		}
+		if problem != nil {
+			problem["food_id"] = item.FoodID
+			c.JSON(http.StatusBadRequest, problem)
 			return
 		}
 
-		localizedFood := getLocalizedFood(food, "uz")
-		foodTotalPrice := localizedFood.Price * item.Quantity
+		extras := 0
+		for _, option := range options {
+			extras += option.PriceDelta
+		}
+		if combo != nil {
+			extras += combo.PriceDelta
+		}
+		price := priceFood(food, foodQuantities[food.ID], pricedAt)
+		if _, seen := freeLeft[food.ID]; !seen {
+			freeLeft[food.ID] = price.FreeItems
+		}
+		price.FreeItems = min(freeLeft[food.ID], item.Quantity)
+		freeLeft[food.ID] -= price.FreeItems
+		unitPrice := price.UnitPrice + extras
+		if unitPrice < 0 {
+			unitPrice = 0
+		}
+		foodTotalPrice := price.Total(item.Quantity, extras)
 		prepTime := food.PreparationTime
+		if combo != nil && combo.PrepTime > prepTime {
+			prepTime = combo.PrepTime
+		}
 		if prepTime > totalPrepTime {
 			totalPrepTime = prepTime
 		}
@@ -2006,19 +11532,32 @@ func createOrderHandler(c *gin.Context) {
 			ID:          food.ID,
 			Name:        localizedFood.Name,
 			Category:    localizedFood.CategoryName,
-			Price:       localizedFood.Price,
+			Price:       unitPrice,
 			Description: localizedFood.Description,
 			ImageURL:    localizedFood.ImageURL,
 			Count:       item.Quantity,
 			TotalPrice:  foodTotalPrice,
+			Options:     options,
+		}
+		if combo != nil {
+			orderedFood.Components = combo.Components
+		}
+		if price.Promotion != nil {
+			orderedFood.Promotion = price.Promotion.summary("uz")
+			orderedFood.FreeCount = price.FreeItems
+			if originalPrice := price.BasePrice + extras; originalPrice > unitPrice {
+				orderedFood.OriginalPrice = originalPrice
+			}
 		}
 		orderedFoods = append(orderedFoods, orderedFood)
 		totalPrice += foodTotalPrice
 
-		// Reduce stock
-		food.Stock -= item.Quantity
-		if err := updateFood(food); err != nil {
-			log.Printf("Stock update error: %v", err)
+		// Stock is taken together with the order below
+		stockNeeded[food.ID] += item.Quantity
+		if combo != nil {
+			for componentID, quantity := range combo.Stock {
+				stockNeeded[componentID] += quantity
+			}
 		}
 	}
 
@@ -2028,26 +11567,36 @@ func createOrderHandler(c *gin.Context) {
 	deliveryInfo := make(map[string]interface{})
 	switch req.DeliveryType {
 	case DeliveryHome:
-		address, addressOk := req.DeliveryInfo["address"].(string)
-		if !addressOk || address == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Delivery address required"})
-			return
-		}
+		if savedAddress != nil {
+			// Copied so later edits to the address book don't change past orders
+			deliveryInfo = savedAddress.deliveryInfo()
+		} else {
+			address, addressOk := req.DeliveryInfo["address"].(string)
+			if !addressOk || address == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Delivery address required"})
+				return
+			}
 
-		deliveryInfo = map[string]interface{}{
-			"type":    "delivery",
-			"address": address,
-		}
+			deliveryInfo = map[string]interface{}{
+				"type":    "delivery",
+				"address": address,
+			}
 
-		if phone, ok := req.DeliveryInfo["phone"].(string); ok {
-			deliveryInfo["phone"] = phone
+			if lat, ok := req.DeliveryInfo["latitude"].(float64); ok {
+				deliveryInfo["latitude"] = lat
+			}
+			if lng, ok := req.DeliveryInfo["longitude"].(float64); ok {
+				deliveryInfo["longitude"] = lng
+			}
+			for _, key := range []string{"entrance", "floor", "apartment", "courier_notes"} {
+				if value, ok := req.DeliveryInfo[key].(string); ok && value != "" {
+					deliveryInfo[key] = value
+				}
+			}
 		}
 
-		if lat, ok := req.DeliveryInfo["latitude"].(float64); ok {
-			deliveryInfo["latitude"] = lat
-		}
-		if lng, ok := req.DeliveryInfo["longitude"].(float64); ok {
-			deliveryInfo["longitude"] = lng
+		if phone, ok := req.DeliveryInfo["phone"].(string); ok && phone != "" {
+			deliveryInfo["phone"] = phone
 		}
 
 		totalPrepTime += 20 // delivery time
@@ -2101,6 +11650,11 @@ func createOrderHandler(c *gin.Context) {
 		if req.CustomerInfo.Name != "" {
 			userName = req.CustomerInfo.Name
 		}
+		if req.CustomerInfo.Phone != "" {
+			if _, ok := deliveryInfo["phone"]; !ok {
+				deliveryInfo["phone"] = req.CustomerInfo.Phone
+			}
+		}
 	}
 
 	log.Printf("Order ID generated: %s", orderID)
@@ -2131,17 +11685,46 @@ func createOrderHandler(c *gin.Context) {
 
 	log.Printf("Order object created, attempting to save to database...")
 
-	if err := createOrder(order); err != nil {
-		log.Printf("Database error creating order: %v", err)
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
 
-		// Rollback stock
-		for _, item := range req.Items {
-			if food, err := getFoodByID(item.FoodID); err == nil {
-				food.Stock += item.Quantity
-				updateFood(food)
-			}
+	// Taken in id order so concurrent orders lock the rows the same way
+	stockIDs := make([]int64, 0, len(stockNeeded))
+	for foodID := range stockNeeded {
+		stockIDs = append(stockIDs, foodID)
+	}
+	sort.Slice(stockIDs, func(i, j int) bool { return stockIDs[i] < stockIDs[j] })
+	for _, foodID := range stockIDs {
+		taken, err := takeStock(tx, foodID, stockNeeded[foodID])
+		if err != nil {
+			log.Printf("Stock update error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Order creation error"})
+			return
+		}
+		if !taken {
+			var available int
+			tx.QueryRow(`SELECT stock FROM foods WHERE id = $1`, foodID).Scan(&available)
+			log.Printf("Insufficient stock: food=%d, required=%d, available=%d", foodID, stockNeeded[foodID], available)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":     "Insufficient stock",
+				"food_id":   foodID,
+				"required":  stockNeeded[foodID],
+				"available": available,
+			})
+			return
 		}
+	}
 
+	err = createOrder(tx, order)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Database error creating order: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Order creation error",
 			"details": err.Error(),
@@ -2185,7 +11768,8 @@ func getOrdersHandler(c *gin.Context) {
 	var args []interface{}
 	argIndex := 1
 
-	if user.Role == "admin" {
+	canReadAll := user.allows(PermOrdersReadAll)
+	if canReadAll {
 		query = `SELECT order_id, user_number, user_name, foods, total_price, order_time, 
 				 delivery_type, delivery_info, status, payment_info, special_instructions, 
 				 estimated_time, delivered_at, status_history, created_at, updated_at
@@ -2212,62 +11796,375 @@ func getOrdersHandler(c *gin.Context) {
 	query += fmt.Sprintf(" ORDER BY order_time DESC LIMIT $%d OFFSET $%d", argIndex, argIndex+1)
 	args = append(args, limit, offset)
 
-	rows, err := db.Query(query, args...)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	defer rows.Close()
+
+	orders := scanOrders(rows)
+
+	// Total count
+	var countQuery string
+	var countArgs []interface{}
+	if canReadAll {
+		countQuery = `SELECT COUNT(*) FROM orders`
+		if status != "" {
+			countQuery += " WHERE status = $1"
+			countArgs = append(countArgs, status)
+		}
+	} else {
+		countQuery = `SELECT COUNT(*) FROM orders WHERE user_number = $1`
+		countArgs = append(countArgs, user.Number)
+		if status != "" {
+			countQuery += " AND status = $2"
+			countArgs = append(countArgs, status)
+		}
+	}
+
+	var total int
+	db.QueryRow(countQuery, countArgs...).Scan(&total)
+
+	c.JSON(http.StatusOK, gin.H{
+		"orders": orders,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+func getOrderHandler(c *gin.Context) {
+	orderID := c.Param("order_id")
+	user := c.MustGet("user").(*Claims)
+
+	order, err := getOrderByID(orderID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	// User can only see their own orders
+	if !user.allows(PermOrdersReadAll) && order.UserNumber != user.Number {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+func updateOrderStatusHandler(c *gin.Context) {
+	orderID := c.Param("order_id")
+
+	var req struct {
+		Status OrderStatus `json:"status" binding:"required"`
+		Note   string      `json:"note,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	order, err := getOrderByID(orderID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	// Add to status history
+	statusUpdate := StatusUpdate{
+		Status:    req.Status,
+		Timestamp: time.Now(),
+		Note:      req.Note,
+	}
+	order.StatusHistory = append(order.StatusHistory, statusUpdate)
+	order.Status = req.Status
+
+	if req.Status == OrderDelivered {
+		now := time.Now()
+		order.DeliveredAt = &now
+		// Confirm payment
+		if order.PaymentInfo.Method == PaymentCash {
+			order.PaymentInfo.Status = PaymentPaid
+			order.PaymentInfo.PaymentTime = &now
+		}
+	}
+
+	if err := updateOrder(order); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Order update error"})
+		return
+	}
+
+	// Real-time update
+	sendOrderUpdate(orderID, req.Status, "Order status updated")
+
+	// Send Telegram message to user
+	go func() {
+		if userDB, err := getUserByNumber(order.UserNumber); err == nil && userDB.TgID != nil {
+			userMessage := fmt.Sprintf("📋 Order: %s\n📍 Status: %s", order.OrderID, string(req.Status))
+			if err := sendTelegramMessageToUser(*userDB.TgID, userMessage); err != nil {
+				log.Printf("Telegram user message error: %v", err)
+			} else {
+				log.Printf("Telegram user message sent: %s", order.OrderID)
+			}
+		}
+	}()
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Order status updated",
+		"order":   order,
+	})
+}
+
+// ========== AUDIT LOG ==========
+
+// recordAudit appends an entry for an administrative action. Failures are
+// logged but never fail the request that triggered them.
+func recordAudit(c *gin.Context, action, targetType, targetID string, details interface{}) {
+	var actorID, actorNumber string
+	if userInterface, exists := c.Get("user"); exists {
+		user := userInterface.(*Claims)
+		actorID = user.UserID
+		actorNumber = user.Number
+	}
+
+	var detailsJSON []byte
+	if details != nil {
+		detailsJSON, _ = json.Marshal(details)
+	}
+
+	query := `INSERT INTO audit_log (id, actor_id, actor_number, action, target_type, target_id, details, ip, created_at) 
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := db.Exec(query, generateID("audit"), actorID, actorNumber, action, targetType, targetID,
+		detailsJSON, c.ClientIP(), time.Now())
+	if err != nil {
+		log.Printf("Audit log error (%s): %v", action, err)
+	}
+}
+
+func getAuditLogHandler(c *gin.Context) {
+	page, _ := strconv.Atoi(c.Query("page"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if page <= 0 {
+		page = 1
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	where := " WHERE 1=1"
+	var args []interface{}
+	for _, filter := range []struct{ param, column string }{
+		{"action", "action"},
+		{"actor_id", "actor_id"},
+		{"target_type", "target_type"},
+		{"target_id", "target_id"},
+	} {
+		if value := c.Query(filter.param); value != "" {
+			args = append(args, value)
+			where += fmt.Sprintf(" AND %s = $%d", filter.column, len(args))
+		}
+	}
+
+	var total int
+	db.QueryRow("SELECT COUNT(*) FROM audit_log"+where, args...).Scan(&total)
+
+	query := `SELECT id, COALESCE(actor_id, ''), COALESCE(actor_number, ''), action, COALESCE(target_type, ''), 
+			  COALESCE(target_id, ''), details, COALESCE(ip, ''), created_at FROM audit_log` + where +
+		fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+	rows, err := db.Query(query, append(args, limit, (page-1)*limit)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []gin.H{}
+	for rows.Next() {
+		var id, actorID, actorNumber, action, targetType, targetID, ip string
+		var detailsJSON []byte
+		var createdAt time.Time
+		if err := rows.Scan(&id, &actorID, &actorNumber, &action, &targetType, &targetID, &detailsJSON, &ip, &createdAt); err != nil {
+			continue
+		}
+		var details interface{}
+		if detailsJSON != nil {
+			json.Unmarshal(detailsJSON, &details)
+		}
+		entries = append(entries, gin.H{
+			"id":           id,
+			"actor_id":     actorID,
+			"actor_number": actorNumber,
+			"action":       action,
+			"target_type":  targetType,
+			"target_id":    targetID,
+			"details":      details,
+			"ip":           ip,
+			"created_at":   createdAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+// ========== USER MANAGEMENT HANDLERS ==========
+
+// canAssignRole keeps owner-level roles in the hands of role managers
+func canAssignRole(actor *Claims, role string) bool {
+	// Full access is handed out by owners only
+	if rolePermissions(role)[PermAll] && !actor.allows(PermAll) {
+		return false
+	}
+	if actor.allows(PermRolesManage) {
+		return true
+	}
+	return !hasPermission(role, PermRolesManage) && !hasPermission(role, PermUsersManage)
+}
+
+func listUsersHandler(c *gin.Context) {
+	search := c.Query("search")
+	role := c.Query("role")
+	isActive := c.Query("is_active")
+	page, _ := strconv.Atoi(c.Query("page"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	if page <= 0 {
+		page = 1
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	where := " WHERE 1=1"
+	var args []interface{}
+	if search != "" {
+		args = append(args, "%"+search+"%")
+		where += fmt.Sprintf(" AND (number ILIKE $%d OR full_name ILIKE $%d OR email ILIKE $%d)", len(args), len(args), len(args))
+	}
+	if role != "" {
+		args = append(args, role)
+		where += fmt.Sprintf(" AND role = $%d", len(args))
+	}
+	if isActive == "true" || isActive == "false" {
+		args = append(args, isActive == "true")
+		where += fmt.Sprintf(" AND is_active = $%d", len(args))
+	}
+
+	var total int
+	db.QueryRow("SELECT COUNT(*) FROM users"+where, args...).Scan(&total)
+
+	query := `SELECT id, number, role, full_name, email, created_at, is_active, tg_id, language 
+			  FROM users` + where + fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+	rows, err := db.Query(query, append(args, limit, (page-1)*limit)...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
 		return
 	}
 	defer rows.Close()
 
-	var orders []*Order
+	users := []User{}
 	for rows.Next() {
-		var order Order
-		var foodsJSON, deliveryInfoJSON, paymentInfoJSON, statusHistoryJSON []byte
-
-		err := rows.Scan(
-			&order.OrderID, &order.UserNumber, &order.UserName, &foodsJSON,
-			&order.TotalPrice, &order.OrderTime, &order.DeliveryType, &deliveryInfoJSON,
-			&order.Status, &paymentInfoJSON, &order.SpecialInstructions,
-			&order.EstimatedTime, &order.DeliveredAt, &statusHistoryJSON,
-			&order.CreatedAt, &order.UpdatedAt,
-		)
-
+		var user User
+		err := rows.Scan(&user.ID, &user.Number, &user.Role, &user.FullName, &user.Email,
+			&user.CreatedAt, &user.IsActive, &user.TgID, &user.Language)
 		if err != nil {
 			continue
 		}
+		users = append(users, user)
+	}
 
-		// JSON unmarshal
-		json.Unmarshal(foodsJSON, &order.Foods)
-		json.Unmarshal(deliveryInfoJSON, &order.DeliveryInfo)
-		json.Unmarshal(paymentInfoJSON, &order.PaymentInfo)
-		json.Unmarshal(statusHistoryJSON, &order.StatusHistory)
+	c.JSON(http.StatusOK, gin.H{
+		"users": users,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + limit - 1) / limit,
+		},
+	})
+}
 
-		orders = append(orders, &order)
+func getUserHandler(c *gin.Context) {
+	user, err := getUserByID(c.Param("user_id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
 	}
+	user.Password = ""
 
-	// Total count
-	var countQuery string
-	var countArgs []interface{}
-	if user.Role == "admin" {
-		countQuery = `SELECT COUNT(*) FROM orders`
-		if status != "" {
-			countQuery += " WHERE status = $1"
-			countArgs = append(countArgs, status)
-		}
-	} else {
-		countQuery = `SELECT COUNT(*) FROM orders WHERE user_number = $1`
-		countArgs = append(countArgs, user.Number)
-		if status != "" {
-			countQuery += " AND status = $2"
-			countArgs = append(countArgs, status)
+	var orderCount, totalSpent int
+	db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(total_price), 0) FROM orders 
+				 WHERE user_number = $1 AND status = 'delivered'`, user.Number).Scan(&orderCount, &totalSpent)
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":             user,
+		"delivered_orders": orderCount,
+		"total_spent":      totalSpent,
+	})
+}
+
+func getUserOrdersHandler(c *gin.Context) {
+	user, err := getUserByID(c.Param("user_id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
 		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.Query("page"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if page <= 0 {
+		page = 1
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 10
+	}
+
+	query := `SELECT order_id, user_number, user_name, foods, total_price, order_time, 
+			  delivery_type, delivery_info, status, payment_info, special_instructions, 
+			  estimated_time, delivered_at, status_history, created_at, updated_at
+			  FROM orders WHERE user_number = $1 ORDER BY order_time DESC LIMIT $2 OFFSET $3`
+	rows, err := db.Query(query, user.Number, limit, (page-1)*limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
 	}
+	defer rows.Close()
+
+	orders := scanOrders(rows)
 
 	var total int
-	db.QueryRow(countQuery, countArgs...).Scan(&total)
+	db.QueryRow(`SELECT COUNT(*) FROM orders WHERE user_number = $1`, user.Number).Scan(&total)
 
 	c.JSON(http.StatusOK, gin.H{
-		"orders": orders,
+		"user_id": user.ID,
+		"orders":  orders,
 		"pagination": gin.H{
 			"page":        page,
 			"limit":       limit,
@@ -2277,96 +12174,235 @@ func getOrdersHandler(c *gin.Context) {
 	})
 }
 
-func getOrderHandler(c *gin.Context) {
-	orderID := c.Param("order_id")
-	user := c.MustGet("user").(*Claims)
+func setUserActive(c *gin.Context, active bool) {
+	actor := c.MustGet("user").(*Claims)
+	userID := c.Param("user_id")
 
-	order, err := getOrderByID(orderID)
+	var req UserBlockRequest
+	c.ShouldBindJSON(&req)
+
+	if userID == actor.UserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't block yourself"})
+		return
+	}
+
+	user, err := getUserByID(userID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 			return
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
 		return
 	}
+	if !canAssignRole(actor, user.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
 
-	// User can only see their own orders
-	if user.Role != "admin" && order.UserNumber != user.Number {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	if _, err := db.Exec(`UPDATE users SET is_active = $2 WHERE id = $1`, userID, active); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User update error"})
 		return
 	}
 
-	c.JSON(http.StatusOK, order)
+	action := "user.unblock"
+	if !active {
+		action = "user.block"
+		// authMiddleware checks is_active, refresh tokens are revoked too
+		if err := revokeAllUserTokens(db, userID); err != nil {
+			log.Printf("Token revocation error: %v", err)
+		}
+	}
+	recordAudit(c, action, "user", userID, gin.H{"reason": req.Reason})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "User updated successfully",
+		"user_id":   userID,
+		"is_active": active,
+	})
 }
 
-func updateOrderStatusHandler(c *gin.Context) {
-	orderID := c.Param("order_id")
+func blockUserHandler(c *gin.Context) {
+	setUserActive(c, false)
+}
 
-	var req struct {
-		Status OrderStatus `json:"status" binding:"required"`
-		Note   string      `json:"note,omitempty"`
-	}
+func unblockUserHandler(c *gin.Context) {
+	setUserActive(c, true)
+}
+
+func updateUserRoleHandler(c *gin.Context) {
+	actor := c.MustGet("user").(*Claims)
+	userID := c.Param("user_id")
+
+	var req UserRoleUpdate
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	order, err := getOrderByID(orderID)
+	if userID == actor.UserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't change your own role"})
+		return
+	}
+	if !roleExists(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role not found"})
+		return
+	}
+
+	user, err := getUserByID(userID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 			return
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
 		return
 	}
+	if !canAssignRole(actor, user.Role) || !canAssignRole(actor, req.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
 
-	// Add to status history
-	statusUpdate := StatusUpdate{
-		Status:    req.Status,
-		Timestamp: time.Now(),
-		Note:      req.Note,
+	// Takes effect on the next request, authMiddleware reads the role from the database
+	if _, err := db.Exec(`UPDATE users SET role = $2 WHERE id = $1`, userID, req.Role); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User update error"})
+		return
 	}
-	order.StatusHistory = append(order.StatusHistory, statusUpdate)
-	order.Status = req.Status
+	recordAudit(c, "user.role_change", "user", userID, gin.H{"from": user.Role, "to": req.Role})
 
-	if req.Status == OrderDelivered {
-		now := time.Now()
-		order.DeliveredAt = &now
-		// Confirm payment
-		if order.PaymentInfo.Method == PaymentCash {
-			order.PaymentInfo.Status = PaymentPaid
-			order.PaymentInfo.PaymentTime = &now
-		}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "User role updated successfully",
+		"user_id": userID,
+		"role":    req.Role,
+	})
+}
+
+func createStaffHandler(c *gin.Context) {
+	actor := c.MustGet("user").(*Claims)
+
+	var req StaffCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	if err := updateOrder(order); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Order update error"})
+	if !roleExists(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role not found"})
+		return
+	}
+	if !canAssignRole(actor, req.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	if !bindPhone(c, &req.Number) {
+		return
+	}
+	if _, err := getUserByNumber(req.Number); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Phone number already registered"})
 		return
 	}
 
-	// Real-time update
-	sendOrderUpdate(orderID, req.Status, "Order status updated")
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid password"})
+		return
+	}
 
-	// Send Telegram message to user
-	go func() {
-		if userDB, err := getUserByNumber(order.UserNumber); err == nil && userDB.TgID != nil {
-			userMessage := fmt.Sprintf("📋 Order: %s\n📍 Status: %s", order.OrderID, string(req.Status))
-			if err := sendTelegramMessageToUser(*userDB.TgID, userMessage); err != nil {
-				log.Printf("Telegram user message error: %v", err)
-			} else {
-				log.Printf("Telegram user message sent: %s", order.OrderID)
-			}
-		}
-	}()
+	lang := req.Language
+	if lang == "" {
+		lang = "uz"
+	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Order status updated",
-		"order":   order,
+	user := &User{
+		ID:        generateID("user"),
+		Number:    req.Number,
+		Password:  passwordHash,
+		Role:      req.Role,
+		FullName:  req.FullName,
+		Email:     req.Email,
+		CreatedAt: time.Now(),
+		IsActive:  true,
+		Language:  lang,
+	}
+
+	if err := createUser(db, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User creation error"})
+		return
+	}
+	recordAudit(c, "user.create_staff", "user", user.ID, gin.H{"number": user.Number, "role": user.Role})
+
+	user.Password = ""
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Staff account created successfully",
+		"user":    user,
 	})
 }
 
+// listPhoneReviewsHandler shows accounts the phone number migration couldn't
+// fix on its own (?all=true includes the automatic changes)
+func listPhoneReviewsHandler(c *gin.Context) {
+	query := `SELECT id, user_id, original_number, COALESCE(canonical_number, ''), action,
+			  COALESCE(merged_into, ''), created_at, resolved_at
+			  FROM phone_reviews`
+	if c.Query("all") != "true" {
+		query += ` WHERE resolved_at IS NULL`
+	}
+	query += ` ORDER BY created_at DESC LIMIT 500`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+	defer rows.Close()
+
+	reviews := []gin.H{}
+	for rows.Next() {
+		var id, userID, original, canonical, action, mergedInto string
+		var createdAt time.Time
+		var resolvedAt sql.NullTime
+		if err := rows.Scan(&id, &userID, &original, &canonical, &action, &mergedInto, &createdAt, &resolvedAt); err != nil {
+			continue
+		}
+		review := gin.H{
+			"id":               id,
+			"user_id":          userID,
+			"original_number":  original,
+			"canonical_number": canonical,
+			"action":           action,
+			"created_at":       createdAt,
+		}
+		if mergedInto != "" {
+			review["merged_into"] = mergedInto
+		}
+		if resolvedAt.Valid {
+			review["resolved_at"] = resolvedAt.Time
+		}
+		reviews = append(reviews, review)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reviews": reviews, "total": len(reviews)})
+}
+
+func resolvePhoneReviewHandler(c *gin.Context) {
+	actor := c.MustGet("user").(*Claims)
+	reviewID := c.Param("review_id")
+
+	result, err := db.Exec(`UPDATE phone_reviews SET resolved_at = CURRENT_TIMESTAMP, resolved_by = $2
+							WHERE id = $1 AND resolved_at IS NULL`, reviewID, actor.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Update error"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+		return
+	}
+	recordAudit(c, "user.phone_review_resolve", "phone_review", reviewID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Review resolved"})
+}
+
 // ========== SEARCH HANDLER ==========
 
 func searchHandler(c *gin.Context) {
@@ -2386,7 +12422,7 @@ func searchHandler(c *gin.Context) {
 	isAdmin := false
 	if userInterface, exists := c.Get("user"); exists {
 		user := userInterface.(*Claims)
-		isAdmin = (user.Role == "admin")
+		isAdmin = user.allows(PermFoodsReadAll)
 	}
 
 	foods, err := getAllLocalizedFoods(lang, isAdmin)
@@ -2459,12 +12495,10 @@ func searchHandler(c *gin.Context) {
 		results = filtered
 	}
 
-	// Make ImageURL full URL
+	// Make image URLs full URLs
 	hostURL := getHostURL(c)
 	for _, food := range results {
-		if food.ImageURL != "" && !strings.HasPrefix(food.ImageURL, "http") {
-			food.ImageURL = hostURL + food.ImageURL
-		}
+		absolutizeFoodURLs(food, hostURL)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -2502,8 +12536,8 @@ func getStatisticsHandler(c *gin.Context) {
 
 	// Food statistics
 	var totalFoods, popularFoods int
-	db.QueryRow("SELECT COUNT(*) FROM foods").Scan(&totalFoods)
-	db.QueryRow("SELECT COUNT(*) FROM foods WHERE is_popular = true OR rating >= 4.0").Scan(&popularFoods)
+	db.QueryRow("SELECT COUNT(*) FROM foods WHERE deleted_at IS NULL").Scan(&totalFoods)
+	db.QueryRow("SELECT COUNT(*) FROM foods WHERE deleted_at IS NULL AND (is_popular = true OR rating >= 4.0)").Scan(&popularFoods)
 
 	// User statistics
 	var totalUsers int
@@ -2523,15 +12557,40 @@ func getStatisticsHandler(c *gin.Context) {
 	})
 }
 
+func getPasswordHashStatsHandler(c *gin.Context) {
+	var totalUsers, legacyUsers int
+	db.QueryRow("SELECT COUNT(*) FROM users").Scan(&totalUsers)
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE password NOT LIKE '$2%'").Scan(&legacyUsers); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Data fetch error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total_users":    totalUsers,
+		"legacy_md5":     legacyUsers,
+		"bcrypt":         totalUsers - legacyUsers,
+		"current_scheme": fmt.Sprintf("bcrypt (cost %d)", PASSWORD_HASH_COST),
+	})
+}
+
 // ========== INITIALIZATION ==========
 
 func initializeTestData() error {
+	adminPassword, err := hashPassword("samandar")
+	if err != nil {
+		return err
+	}
+	userPassword, err := hashPassword("user123")
+	if err != nil {
+		return err
+	}
+
 	// Admin user
 	adminUser := &User{
 		ID:        generateID("user"),
-		Number:    "770451117",
-		Password:  hashPassword("samandar"),
-		Role:      "admin",
+		Number:    "+998770451117",
+		Password:  adminPassword,
+		Role:      RoleOwner,
 		FullName:  "Samandar Admin",
 		Email:     stringPtr("admin@restaurant.uz"),
 		CreatedAt: time.Now(),
@@ -2543,7 +12602,7 @@ func initializeTestData() error {
 	// Check if user exists
 	existingUser, err := getUserByNumber(adminUser.Number)
 	if err == sql.ErrNoRows {
-		if err := createUser(adminUser); err != nil {
+		if err := createUser(db, adminUser); err != nil {
 			log.Printf("Admin user creation error: %v", err)
 		} else {
 			log.Println("✅ Admin user created")
@@ -2557,8 +12616,8 @@ func initializeTestData() error {
 	// Test user
 	testUser := &User{
 		ID:        generateID("user"),
-		Number:    "998901234567",
-		Password:  hashPassword("user123"),
+		Number:    "+998901234567",
+		Password:  userPassword,
 		Role:      "user",
 		FullName:  "Test User",
 		Email:     stringPtr("user@test.uz"),
@@ -2570,7 +12629,7 @@ func initializeTestData() error {
 
 	existingTestUser, err := getUserByNumber(testUser.Number)
 	if err == sql.ErrNoRows {
-		if err := createUser(testUser); err != nil {
+		if err := createUser(db, testUser); err != nil {
 			log.Printf("Test user creation error: %v", err)
 		} else {
 			log.Println("✅ Test user created")
@@ -2636,15 +12695,20 @@ func setupRoutes() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 
+	// Client IPs are used for rate limiting, only trust the configured proxies
+	if err := r.SetTrustedProxies(config.TrustedProxies); err != nil {
+		log.Printf("⚠️ Trusted proxies error: %v", err)
+	}
+
 	// Middleware
 	r.Use(corsMiddleware())
 
 	// Static files
-	if _, err := os.Stat(UPLOAD_DIR); os.IsNotExist(err) {
-		os.MkdirAll(UPLOAD_DIR, 0755)
+	if _, err := os.Stat(config.Upload.Dir); os.IsNotExist(err) {
+		os.MkdirAll(config.Upload.Dir, 0755)
 	}
 
-	r.Static("/uploads", "./"+UPLOAD_DIR)
+	r.Static("/uploads", config.Upload.Dir)
 	r.StaticFile("/favicon.ico", "./favicon.ico")
 
 	// WebSocket endpoint
@@ -2655,6 +12719,7 @@ func setupRoutes() *gin.Engine {
 
 	// API group
 	api := r.Group("/api")
+	api.Use(rateLimitMiddleware("api", &RateLimitAPI, rateLimitKeyByIP))
 
 	// PUBLIC ENDPOINTS
 	public := api.Group("/")
@@ -2669,47 +12734,175 @@ func setupRoutes() *gin.Engine {
 		// Search
 		public.GET("/search", optionalAuthMiddleware(), searchHandler)
 
+		// Promotions running now
+		public.GET("/promotions", getActivePromotionsHandler)
+
 		// File uploads (public but can be authenticated)
-		public.POST("/upload", optionalAuthMiddleware(), uploadFile)
+		public.POST("/upload", rateLimitMiddleware("upload_ip", &RateLimitUploadIP, rateLimitKeyByIP),
+			optionalAuthMiddleware(), uploadFile)
 	}
 
 	// Authentication endpoints
 	auth := api.Group("/")
 	{
-		auth.POST("/register", register)
-		auth.POST("/login", login)
+		auth.POST("/register", rateLimitMiddleware("register_ip", &RateLimitRegisterIP, rateLimitKeyByIP), register)
+		auth.POST("/login",
+			rateLimitMiddleware("login_ip", &RateLimitLoginIP, rateLimitKeyByIP),
+			rateLimitMiddleware("login_phone", &RateLimitLoginPhone, rateLimitKeyByPhone),
+			login)
+		auth.POST("/token/refresh", refreshTokenHandler)
+
+		// Phone verification
+		auth.POST("/otp/request", requestOTPHandler)
+		auth.POST("/otp/verify", verifyOTPHandler)
+		auth.POST("/login/otp", loginWithOTP)
+
+		// Second factor for accounts with 2FA
+		auth.POST("/login/2fa", rateLimitMiddleware("login_ip", &RateLimitLoginIP, rateLimitKeyByIP), loginTwoFactor)
+		auth.POST("/login/2fa/setup", rateLimitMiddleware("login_ip", &RateLimitLoginIP, rateLimitKeyByIP), loginTwoFactorSetup)
+
+		// Password recovery
+		auth.POST("/password/forgot", forgotPasswordHandler)
+		auth.POST("/password/reset", resetPasswordHandler)
 	}
 
-	// Protected endpoints
+	// Protected endpoints, open to users and API keys
 	protected := api.Group("/")
 	protected.Use(authMiddleware())
+
+	// Endpoints about the signed-in person's own account
+	account := protected.Group("/")
+	account.Use(accountMiddleware())
 	{
 		// Profile
-		protected.GET("/profile", getProfile)
+		account.GET("/profile", getProfile)
+		account.PUT("/profile", updateProfile)
+		account.PUT("/profile/password", changePassword)
+		account.POST("/profile/phone/request", requestPhoneChange)
+		account.PUT("/profile/phone", confirmPhoneChange)
+		account.GET("/profile/export", exportProfileData)
+		account.DELETE("/profile", deleteAccount)
+
+		// Two-factor authentication
+		account.GET("/profile/2fa", getTwoFactorStatus)
+		account.POST("/profile/2fa/setup", setupTwoFactor)
+		account.POST("/profile/2fa/enable", enableTwoFactor)
+		account.POST("/profile/2fa/disable", disableTwoFactor)
+		account.POST("/profile/2fa/recovery-codes", regenerateRecoveryCodes)
+
+		// Address book
+		account.GET("/addresses", getAddressesHandler)
+		account.POST("/addresses", createAddressHandler)
+		account.PUT("/addresses/:address_id", updateAddressHandler)
+		account.DELETE("/addresses/:address_id", deleteAddressHandler)
+
+		// Sessions
+		account.POST("/logout", logout)
+		account.POST("/logout-all", logoutAll)
+		account.GET("/sessions", getSessionsHandler)
+		account.DELETE("/sessions/:session_id", revokeSessionHandler)
+	}
 
+	{
 		// Orders
-		protected.POST("/orders", createOrderHandler)
+		protected.POST("/orders", requireAPIKeyScope(PermOrdersCreate), createOrderHandler)
 		protected.GET("/orders", getOrdersHandler)
 		protected.GET("/orders/:order_id", getOrderHandler)
 	}
 
 	// Admin endpoints
 	admin := protected.Group("/admin")
-	admin.Use(adminMiddleware())
+	admin.Use(staffMiddleware())
 	{
 		// Food management
-		admin.POST("/foods", createFoodHandler) // Supports custom_id
-		admin.PUT("/foods/:food_id", updateFoodHandler)
-		admin.DELETE("/foods/:food_id", deleteFoodHandler)
+		admin.POST("/foods", requirePermission(PermFoodsWrite), createFoodHandler) // Supports custom_id
+		admin.PUT("/foods/:food_id", requirePermission(PermFoodsWrite), updateFoodHandler)
+		admin.PATCH("/foods/:food_id", requirePermission(PermFoodsWrite), patchFoodHandler)
+		admin.GET("/foods/export", requirePermission(PermFoodsReadAll), exportFoodsHandler)
+		admin.POST("/foods/import", requirePermission(PermFoodsWrite), importFoodsHandler)
+		admin.DELETE("/foods/:food_id", requirePermission(PermFoodsWrite), deleteFoodHandler)
+		admin.GET("/foods/archived", requirePermission(PermFoodsWrite), getArchivedFoodsHandler)
+		admin.POST("/foods/:food_id/restore", requirePermission(PermFoodsWrite), restoreFoodHandler)
+		admin.DELETE("/foods/:food_id/purge", requirePermission(PermFoodsWrite), purgeFoodHandler)
+		admin.GET("/foods/:food_id/changes", requirePermission(PermAuditRead), getFoodChangesHandler)
+		admin.GET("/foods/:food_id/price-history", requirePermission(PermFoodsReadAll), getFoodPriceHistoryHandler)
+		admin.GET("/reports/prices", requirePermission(PermStatsRead), getPricesOnDateHandler)
+
+		// Category management
+		admin.GET("/categories", requirePermission(PermFoodsWrite), getAdminCategoriesHandler)
+		admin.POST("/categories", requirePermission(PermFoodsWrite), createCategoryHandler)
+		admin.PUT("/categories/:key", requirePermission(PermFoodsWrite), updateCategoryHandler)
+		admin.DELETE("/categories/:key", requirePermission(PermFoodsWrite), deleteCategoryHandler)
+
+		// Food modifiers
+		admin.GET("/foods/:food_id/modifiers", requirePermission(PermFoodsWrite), getFoodModifiersHandler)
+		admin.POST("/foods/:food_id/modifiers", requirePermission(PermFoodsWrite), createModifierGroupHandler)
+		admin.PUT("/modifier-groups/:group_id", requirePermission(PermFoodsWrite), updateModifierGroupHandler)
+		admin.DELETE("/modifier-groups/:group_id", requirePermission(PermFoodsWrite), deleteModifierGroupHandler)
+		admin.POST("/modifier-groups/:group_id/options", requirePermission(PermFoodsWrite), createModifierOptionHandler)
+		admin.PUT("/modifier-options/:option_id", requirePermission(PermFoodsWrite), updateModifierOptionHandler)
+		admin.DELETE("/modifier-options/:option_id", requirePermission(PermFoodsWrite), deleteModifierOptionHandler)
+
+		// Combo meals
+		admin.GET("/foods/:food_id/combo", requirePermission(PermFoodsWrite), getComboHandler)
+		admin.PUT("/foods/:food_id/combo", requirePermission(PermFoodsWrite), setComboHandler)
+		admin.DELETE("/foods/:food_id/combo", requirePermission(PermFoodsWrite), deleteComboHandler)
+
+		// Food image galleries
+		admin.GET("/foods/:food_id/images", requirePermission(PermFoodsWrite), getFoodImagesHandler)
+		admin.POST("/foods/:food_id/images", requirePermission(PermFoodsWrite), addFoodImageHandler)
+		admin.PUT("/foods/:food_id/images", requirePermission(PermFoodsWrite), reorderFoodImagesHandler)
+		admin.PUT("/foods/:food_id/images/:image_id", requirePermission(PermFoodsWrite), updateFoodImageHandler)
+		admin.DELETE("/foods/:food_id/images/:image_id", requirePermission(PermFoodsWrite), deleteFoodImageHandler)
+
+		// Menu availability schedules
+		admin.GET("/schedules", requirePermission(PermFoodsWrite), getSchedulesHandler)
+		admin.POST("/schedules", requirePermission(PermFoodsWrite), createScheduleHandler)
+		admin.PUT("/schedules/:schedule_id", requirePermission(PermFoodsWrite), updateScheduleHandler)
+		admin.DELETE("/schedules/:schedule_id", requirePermission(PermFoodsWrite), deleteScheduleHandler)
+		admin.GET("/promotions", requirePermission(PermFoodsWrite), getPromotionsHandler)
+		admin.POST("/promotions", requirePermission(PermFoodsWrite), createPromotionHandler)
+		admin.PUT("/promotions/:promotion_id", requirePermission(PermFoodsWrite), updatePromotionHandler)
+		admin.DELETE("/promotions/:promotion_id", requirePermission(PermFoodsWrite), deletePromotionHandler)
 
 		// Order management
-		admin.PUT("/orders/:order_id/status", updateOrderStatusHandler)
+		admin.PUT("/orders/:order_id/status", requirePermission(PermOrdersUpdateStatus), updateOrderStatusHandler)
 
 		// Statistics
-		admin.GET("/statistics", getStatisticsHandler)
+		admin.GET("/statistics", requirePermission(PermStatsRead), getStatisticsHandler)
+		admin.GET("/statistics/password-hashes", requirePermission(PermStatsRead), getPasswordHashStatsHandler)
+
+		// Roles
+		admin.GET("/permissions", requirePermission(PermRolesManage), listPermissionsHandler)
+		admin.GET("/roles", requirePermission(PermRolesManage), listRolesHandler)
+		admin.POST("/roles", requirePermission(PermRolesManage), createRoleHandler)
+		admin.PUT("/roles/:role", requirePermission(PermRolesManage), updateRoleHandler)
+		admin.DELETE("/roles/:role", requirePermission(PermRolesManage), deleteRoleHandler)
+
+		// User management
+		admin.GET("/users", requirePermission(PermUsersRead), listUsersHandler)
+		admin.POST("/users", requirePermission(PermUsersManage), createStaffHandler)
+		admin.GET("/users/:user_id", requirePermission(PermUsersRead), getUserHandler)
+		admin.GET("/users/:user_id/orders", requirePermission(PermUsersRead), getUserOrdersHandler)
+		admin.PUT("/users/:user_id/block", requirePermission(PermUsersManage), blockUserHandler)
+		admin.PUT("/users/:user_id/unblock", requirePermission(PermUsersManage), unblockUserHandler)
+		admin.PUT("/users/:user_id/role", requirePermission(PermUsersManage), updateUserRoleHandler)
+		admin.DELETE("/users/:user_id/2fa", requirePermission(PermUsersManage), resetUserTwoFactorHandler)
+		admin.GET("/users/:user_id/sessions", requirePermission(PermUsersRead), getUserSessionsHandler)
+		admin.POST("/users/:user_id/logout", requirePermission(PermUsersManage), forceLogoutUserHandler)
+		admin.GET("/phone-reviews", requirePermission(PermUsersRead), listPhoneReviewsHandler)
+		admin.PUT("/phone-reviews/:review_id/resolve", requirePermission(PermUsersManage), resolvePhoneReviewHandler)
+
+		// API keys
+		admin.GET("/api-keys", requirePermission(PermAPIKeysManage), listAPIKeysHandler)
+		admin.POST("/api-keys", requirePermission(PermAPIKeysManage), createAPIKeyHandler)
+		admin.DELETE("/api-keys/:key_id", requirePermission(PermAPIKeysManage), revokeAPIKeyHandler)
+
+		// Audit trail
+		admin.GET("/audit-log", requirePermission(PermAuditRead), getAuditLogHandler)
 
 		// Manual ID support
-		admin.POST("/update-sequence", func(c *gin.Context) {
+		admin.POST("/update-sequence", requirePermission(PermSystemMaintenance), func(c *gin.Context) {
 			if err := updateSequenceAfterManualInsert(); err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
@@ -2724,21 +12917,50 @@ func setupRoutes() *gin.Engine {
 // ========== MAIN FUNCTION ==========
 
 func main() {
+	// Configuration
+	var err error
+	if config, err = loadConfig(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if !config.telegramEnabled() {
+		log.Printf("⚠️ Telegram notifications disabled (TELEGRAM_BOT_TOKEN not set)")
+	}
+
 	// Database initialization
 	if err := initDatabase(); err != nil {
 		log.Fatalf("❌ Database error: %v", err)
 	}
 
+	// SMS provider
+	initSMSProvider()
+
+	// Rate limiting
+	if err := initRateLimiter(); err != nil {
+		log.Fatalf("❌ Rate limiter error: %v", err)
+	}
+
 	// Test data initialization
 	if err := initializeTestData(); err != nil {
 		log.Printf("⚠️ Test data creation error: %v", err)
 	}
 
+	// Cross-instance events
+	startEventListener(dbConnStr)
+
+	// Expired token cleanup
+	go func() {
+		for {
+			cleanupExpiredTokens()
+			time.Sleep(time.Hour)
+		}
+	}()
+
 	// WebSocket handler
 	go func() {
 		for {
 			select {
 			case msg := <-broadcast:
+				clientsMu.Lock()
 				for client := range clients {
 					if err := client.WriteMessage(websocket.TextMessage, msg); err != nil {
 						log.Printf("WebSocket error: %v", err)
@@ -2746,6 +12968,7 @@ func main() {
 						delete(clients, client)
 					}
 				}
+				clientsMu.Unlock()
 			}
 		}
 	}()
@@ -2754,10 +12977,7 @@ func main() {
 	r := setupRoutes()
 
 	// Server port
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
+	port := config.Port
 
 	log.Printf("🚀 Restaurant API - Complete Version with Integer IDs:")
 	log.Printf("📍 Server: http://localhost:%s", port)
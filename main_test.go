@@ -0,0 +1,552 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAvailabilityScheduleMatches(t *testing.T) {
+	// 2026-01-05 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	monday := []int{int(time.Monday)}
+
+	tests := []struct {
+		name     string
+		schedule AvailabilitySchedule
+		at       time.Time
+		want     bool
+	}{
+		{"no limits", AvailabilitySchedule{}, at(5, 3, 0), true},
+		{"listed day", AvailabilitySchedule{Days: monday}, at(5, 12, 0), true},
+		{"other day", AvailabilitySchedule{Days: monday}, at(6, 12, 0), false},
+		{"before window", AvailabilitySchedule{StartTime: "10:00", EndTime: "14:00"}, at(5, 9, 59), false},
+		{"window start", AvailabilitySchedule{StartTime: "10:00", EndTime: "14:00"}, at(5, 10, 0), true},
+		{"inside window", AvailabilitySchedule{StartTime: "10:00", EndTime: "14:00"}, at(5, 13, 59), true},
+		{"window end is exclusive", AvailabilitySchedule{StartTime: "10:00", EndTime: "14:00"}, at(5, 14, 0), false},
+		{"window on other day", AvailabilitySchedule{Days: monday, StartTime: "10:00", EndTime: "14:00"}, at(6, 11, 0), false},
+		{"overnight evening", AvailabilitySchedule{Days: monday, StartTime: "22:00", EndTime: "02:00"}, at(5, 23, 0), true},
+		{"overnight early hours of next day", AvailabilitySchedule{Days: monday, StartTime: "22:00", EndTime: "02:00"}, at(6, 1, 0), true},
+		{"overnight after end", AvailabilitySchedule{Days: monday, StartTime: "22:00", EndTime: "02:00"}, at(6, 3, 0), false},
+		{"overnight early hours belong to the day before", AvailabilitySchedule{Days: monday, StartTime: "22:00", EndTime: "02:00"}, at(5, 1, 0), false},
+		{"overnight evening of other day", AvailabilitySchedule{Days: monday, StartTime: "22:00", EndTime: "02:00"}, at(6, 23, 0), false},
+		{"before start date", AvailabilitySchedule{StartDate: "2026-01-06"}, at(5, 12, 0), false},
+		{"on start date", AvailabilitySchedule{StartDate: "2026-01-06"}, at(6, 0, 0), true},
+		{"after end date", AvailabilitySchedule{EndDate: "2026-01-05"}, at(6, 12, 0), false},
+		{"overnight past end date", AvailabilitySchedule{EndDate: "2026-01-05", StartTime: "22:00", EndTime: "02:00"}, at(6, 1, 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.matches(tt.at); got != tt.want {
+				t.Errorf("matches(%s) = %v, want %v", tt.at.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// The examples of RFC 7396 appendix A
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		// A food edit: one translation removed, another changed
+		{`{"names":{"uz":"Osh","ru":"Плов","en":"Pilaf"},"price":30000}`, `{"names":{"ru":"Плов!","en":null}}`,
+			`{"names":{"uz":"Osh","ru":"Плов!"},"price":30000}`},
+	}
+	for _, tt := range tests {
+		var target, patch, want interface{}
+		for _, doc := range []struct {
+			raw  string
+			into *interface{}
+		}{{tt.target, &target}, {tt.patch, &patch}, {tt.want, &want}} {
+			if err := json.Unmarshal([]byte(doc.raw), doc.into); err != nil {
+				t.Fatalf("bad test JSON %s: %v", doc.raw, err)
+			}
+		}
+		if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+			gotJSON, _ := json.Marshal(got)
+			t.Errorf("mergePatch(%s, %s) = %s, want %s", tt.target, tt.patch, gotJSON, tt.want)
+		}
+	}
+}
+
+// useCategories serves the given categories from the cache instead of the
+// database for the rest of the test
+func useCategories(t *testing.T, categories ...*Category) {
+	t.Helper()
+	byKey := make(map[string]*Category)
+	for _, category := range categories {
+		byKey[category.Key] = category
+	}
+	categoryCache.Lock()
+	categoryCache.categories = byKey
+	categoryCache.loadedAt = time.Now()
+	categoryCache.Unlock()
+	t.Cleanup(clearCategoryCache)
+}
+
+func zipParts(t *testing.T, parts map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, body := range parts {
+		part, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(body))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadXLSX(t *testing.T) {
+	const ns = `xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"`
+	const relNS = `xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"`
+	workbook := func(target string) map[string]string {
+		return map[string]string{
+			"xl/workbook.xml": `<workbook ` + ns + ` ` + relNS + `><sheets><sheet name="Menu" sheetId="1" r:id="rId3"/></sheets></workbook>`,
+			"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+				`<Relationship Id="rId1" Target="worksheets/other.xml"/><Relationship Id="rId3" Target="` + target + `"/></Relationships>`,
+		}
+	}
+	with := func(parts map[string]string, extra map[string]string) map[string]string {
+		for name, body := range extra {
+			parts[name] = body
+		}
+		return parts
+	}
+
+	tests := []struct {
+		name    string
+		parts   map[string]string
+		want    [][]string
+		wantErr bool
+	}{
+		{
+			name: "shared, rich, inline, boolean and number cells with gaps",
+			parts: with(workbook("worksheets/menu.xml"), map[string]string{
+				"xl/sharedStrings.xml": `<sst ` + ns + `><si><t>name_uz</t></si><si><r><t>O</t></r><r><t>sh</t></r></si></sst>`,
+				"xl/worksheets/menu.xml": `<worksheet ` + ns + `><sheetData>` +
+					`<row r="1"><c r="A1" t="s"><v>0</v></c><c r="C1" t="inlineStr"><is><t>price</t></is></c></row>` +
+					`<row r="2"><c r="A2" t="s"><v>1</v></c><c r="B2" t="b"><v>1</v></c><c r="C2"><v>30000</v></c></row>` +
+					`</sheetData></worksheet>`,
+			}),
+			want: [][]string{{"name_uz", "", "price"}, {"Osh", "true", "30000"}},
+		},
+		{
+			name: "absolute relationship target",
+			parts: with(workbook("/xl/worksheets/menu.xml"), map[string]string{
+				"xl/worksheets/menu.xml": `<worksheet ` + ns + `><sheetData><row r="1"><c r="B1" t="inlineStr"><is><t>id</t></is></c></row></sheetData></worksheet>`,
+			}),
+			want: [][]string{{"", "id"}},
+		},
+		{
+			name: "first sheet by default",
+			parts: map[string]string{
+				"xl/worksheets/sheet1.xml": `<worksheet ` + ns + `><sheetData><row><c t="inlineStr"><is><t>a</t></is></c><c><v>2</v></c></row></sheetData></worksheet>`,
+			},
+			want: [][]string{{"a", "2"}},
+		},
+		{
+			name: "shared string out of range",
+			parts: map[string]string{
+				"xl/sharedStrings.xml":     `<sst ` + ns + `><si><t>only</t></si></sst>`,
+				"xl/worksheets/sheet1.xml": `<worksheet ` + ns + `><sheetData><row r="1"><c r="A1" t="s"><v>5</v></c></row></sheetData></worksheet>`,
+			},
+			wantErr: true,
+		},
+		{
+			name:    "missing sheet",
+			parts:   map[string]string{"xl/workbook.xml": `<workbook ` + ns + `/>`},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readXLSX(zipParts(t, tt.parts))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readXLSX() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readXLSX() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readXLSX() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readXLSX([]byte("id,name_uz\n")); err == nil {
+		t.Error("readXLSX(csv) succeeded, want an error")
+	}
+}
+
+func TestReadXLSXReadsWriteXLSX(t *testing.T) {
+	rows := [][]string{
+		{"id", "name_uz", "price", "comment"},
+		{"1", "Osh & <non>", "30000", "007"},
+		{"2", "Manti", "", "  spaced  "},
+	}
+	var buf bytes.Buffer
+	if err := writeXLSX(&buf, "Menu", rows); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readXLSX(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rows) {
+		t.Errorf("readXLSX(writeXLSX(rows)) = %q, want %q", got, rows)
+	}
+}
+
+func TestPlanMenuRows(t *testing.T) {
+	useCategories(t, &Category{Key: "food", IsActive: true}, &Category{Key: "drinks", IsActive: true})
+
+	stored := &Food{
+		ID:              7,
+		Names:           map[string]string{"uz": "Osh", "ru": "Плов"},
+		Name:            "Osh",
+		Category:        "food",
+		Price:           30000,
+		IsThere:         true,
+		ImageURL:        "/uploads/osh.jpg",
+		PreparationTime: 20,
+		Stock:           40,
+	}
+	existing := map[int64]*Food{7: stored}
+	archived := map[int64]bool{9: true}
+	const host = "api.example.uz"
+
+	type wantRow struct {
+		row      int
+		id       int64 // 0 for a new food without an id
+		existing bool
+		check    func(t *testing.T, doc FoodDocument)
+	}
+	tests := []struct {
+		name     string
+		rows     [][]string
+		wantErr  string
+		want     []wantRow
+		problems []string          // row:field
+		messages map[string]string // row:field -> error, where it matters
+	}{
+		{name: "empty file", rows: nil, wantErr: "file is empty"},
+		{name: "unknown column", rows: [][]string{{"id", "colour"}}, wantErr: `unknown column "colour"`},
+		{name: "duplicate column", rows: [][]string{{"price", " price "}}, wantErr: `duplicate column "price"`},
+		{
+			name: "new food starts from the create defaults",
+			rows: [][]string{{"name_uz", "category", "price"}, {"Manti", "food", "25000.0"}},
+			want: []wantRow{{row: 2, check: func(t *testing.T, doc FoodDocument) {
+				if doc.Names["uz"] != "Manti" || doc.Price != 25000 || !doc.IsThere || doc.PreparationTime != 15 || doc.Stock != 100 {
+					t.Errorf("doc = %+v", doc)
+				}
+			}}},
+		},
+		{
+			name: "blank cells keep the stored values",
+			rows: [][]string{{"id", "name_uz", "name_ru", "price", "isThere"}, {"7", "", "Плов!", "32000", "yo'q"}},
+			want: []wantRow{{row: 2, id: 7, existing: true, check: func(t *testing.T, doc FoodDocument) {
+				if doc.Names["uz"] != "Osh" || doc.Names["ru"] != "Плов!" || doc.Price != 32000 || doc.IsThere ||
+					doc.Stock != 40 || doc.ImageURL != "/uploads/osh.jpg" {
+					t.Errorf("doc = %+v", doc)
+				}
+			}}},
+		},
+		{
+			name: "custom id of a new food",
+			rows: [][]string{{"custom_id", "name_uz", "category", "price"}, {"500", "Choy", "drinks", "3000"}},
+			want: []wantRow{{row: 2, id: 500}},
+		},
+		{
+			name: "image URLs of our uploads are stored as paths",
+			rows: [][]string{
+				{"name_uz", "category", "price", "imageUrl"},
+				{"Choy", "drinks", "3000", "https://" + host + "/uploads/tea.jpg"},
+				{"Kofe", "drinks", "9000", "https://cdn.example.com/uploads/coffee.jpg"},
+			},
+			want: []wantRow{
+				{row: 2, check: func(t *testing.T, doc FoodDocument) {
+					if doc.ImageURL != "/uploads/tea.jpg" {
+						t.Errorf("imageUrl = %q", doc.ImageURL)
+					}
+				}},
+				{row: 3, check: func(t *testing.T, doc FoodDocument) {
+					if doc.ImageURL != "https://cdn.example.com/uploads/coffee.jpg" {
+						t.Errorf("imageUrl = %q", doc.ImageURL)
+					}
+				}},
+			},
+		},
+		{
+			name: "row problems are reported per field and skip the row",
+			rows: [][]string{
+				{"id", "custom_id", "name_uz", "category", "price", "is_popular"},
+				{"", "", "Osh", "soup", "abc", "maybe"},
+				{"9", "", "Manti", "food", "25000", ""},
+				{"7", "8", "Osh", "food", "30000", ""},
+				{"", "", "", "", "", ""},
+				{"7", "", "", "", "31000", ""},
+				{"7", "", "Osh", "food", "30000", ""},
+			},
+			want: []wantRow{{row: 6, id: 7, existing: true}},
+			problems: []string{
+				"2:category", "2:is_popular", "2:price",
+				"3:id",
+				"4:custom_id",
+				"7:id",
+			},
+			messages: map[string]string{
+				"2:price": "must be a whole number",
+				"3:id":    "food is archived, restore it first",
+				"7:id":    "same id as row 6",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, problems, err := planMenuRows(tt.rows, host, existing, archived)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := []string{}
+			for _, problem := range problems {
+				key := fmt.Sprintf("%d:%s", problem.Row, problem.Field)
+				got = append(got, key)
+				if message, ok := tt.messages[key]; ok && problem.Error != message {
+					t.Errorf("%s: error = %q, want %q", key, problem.Error, message)
+				}
+			}
+			sort.Strings(got)
+			want := append([]string{}, tt.problems...)
+			sort.Strings(want)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("problems = %v, want %v (%+v)", got, want, problems)
+			}
+
+			if len(plan) != len(tt.want) {
+				t.Fatalf("planned %d rows, want %d", len(plan), len(tt.want))
+			}
+			for i, entry := range plan {
+				w := tt.want[i]
+				if entry.Row != w.row {
+					t.Errorf("row = %d, want %d", entry.Row, w.row)
+				}
+				if (entry.ID == nil) != (w.id == 0) || (entry.ID != nil && *entry.ID != w.id) {
+					t.Errorf("row %d: id = %v, want %d", entry.Row, entry.ID, w.id)
+				}
+				if (entry.Existing != nil) != w.existing || (entry.Before != nil) != w.existing {
+					t.Errorf("row %d: existing = %v, before = %v", entry.Row, entry.Existing != nil, entry.Before != nil)
+				}
+				if w.check != nil {
+					w.check(t, entry.Doc)
+				}
+			}
+			if stored.Names["ru"] != "Плов" || stored.Price != 30000 {
+				t.Errorf("planning changed the stored food: %+v", stored)
+			}
+		})
+	}
+}
+
+// usePromotions serves the given promotions, oldest first, from the cache
+// instead of the database for the rest of the test
+func usePromotions(t *testing.T, promotions ...*Promotion) {
+	t.Helper()
+	promotionCache.Lock()
+	promotionCache.promotions = append([]*Promotion{}, promotions...)
+	promotionCache.loadedAt = time.Now()
+	promotionCache.Unlock()
+	t.Cleanup(clearPromotionCache)
+}
+
+func TestPriceFood(t *testing.T) {
+	parent := "food"
+	useCategories(t,
+		&Category{Key: "food", IsActive: true},
+		&Category{Key: "plov", IsActive: true, ParentKey: &parent},
+	)
+	at := time.Date(2026, time.January, 5, 12, 0, 0, 0, time.UTC) // a Monday
+	yesterday := at.AddDate(0, 0, -1)
+
+	promo := func(id, kind string, value int, scope, scopeID string, priority int) *Promotion {
+		return &Promotion{ID: id, Type: kind, Value: value, Scope: scope, ScopeID: scopeID, Priority: priority, IsActive: true}
+	}
+	ended := promo("ended", PromotionPercent, 90, PromotionScopeMenu, "", 5)
+	ended.EndsAt = &yesterday
+	inactive := promo("inactive", PromotionPercent, 90, PromotionScopeMenu, "", 5)
+	inactive.IsActive = false
+	tuesdays := promo("tuesdays", PromotionPercent, 90, PromotionScopeMenu, "", 5)
+	tuesdays.Days = []int{int(time.Tuesday)}
+	lunch := promo("lunch", PromotionPercent, 50, PromotionScopeMenu, "", 5)
+	lunch.StartTime, lunch.EndTime = "11:00", "15:00"
+	buy2get1 := &Promotion{ID: "b2g1", Type: PromotionBuyXGetY, BuyQuantity: 2, GetQuantity: 1,
+		Scope: PromotionScopeFood, ScopeID: "1", IsActive: true}
+
+	tests := []struct {
+		name       string
+		promotions []*Promotion
+		discount   int // the legacy foods.discount
+		quantity   int
+		wantUnit   int
+		wantFree   int
+		wantPromo  string
+	}{
+		{"no promotions", nil, 0, 1, 30000, 0, ""},
+		{"whole menu", []*Promotion{promo("menu", PromotionPercent, 10, PromotionScopeMenu, "", 0)}, 0, 1, 27000, 0, "menu"},
+		{"other food", []*Promotion{promo("other", PromotionPercent, 10, PromotionScopeFood, "2", 0)}, 0, 1, 30000, 0, ""},
+		{"other category", []*Promotion{promo("drinks", PromotionPercent, 10, PromotionScopeCategory, "drinks", 0)}, 0, 1, 30000, 0, ""},
+		{"parent category", []*Promotion{promo("food", PromotionPercent, 10, PromotionScopeCategory, "food", 0)}, 0, 1, 27000, 0, "food"},
+		{
+			"own category beats its parent",
+			[]*Promotion{
+				promo("plov", PromotionPercent, 20, PromotionScopeCategory, "plov", 0),
+				promo("food", PromotionPercent, 10, PromotionScopeCategory, "food", 0),
+			}, 0, 1, 24000, 0, "plov",
+		},
+		{
+			"food beats category and menu",
+			[]*Promotion{
+				promo("menu", PromotionPercent, 50, PromotionScopeMenu, "", 0),
+				promo("plov", PromotionPercent, 50, PromotionScopeCategory, "plov", 0),
+				promo("osh", PromotionFixed, 5000, PromotionScopeFood, "1", 0),
+			}, 0, 1, 25000, 0, "osh",
+		},
+		{
+			"priority beats scope",
+			[]*Promotion{
+				promo("osh", PromotionPercent, 50, PromotionScopeFood, "1", 0),
+				promo("menu", PromotionPercent, 5, PromotionScopeMenu, "", 1),
+			}, 0, 1, 28500, 0, "menu",
+		},
+		{
+			"oldest wins a full tie",
+			[]*Promotion{
+				promo("old", PromotionPercent, 10, PromotionScopeMenu, "", 0),
+				promo("new", PromotionPercent, 20, PromotionScopeMenu, "", 0),
+			}, 0, 1, 27000, 0, "old",
+		},
+		{"legacy discount alone", nil, 15, 1, 25500, 0, "discount"},
+		{"legacy discount beats the menu", []*Promotion{promo("menu", PromotionPercent, 50, PromotionScopeMenu, "", 0)}, 15, 1, 25500, 0, "discount"},
+		{"food promotion beats the legacy discount", []*Promotion{promo("osh", PromotionPercent, 10, PromotionScopeFood, "1", 0)}, 15, 1, 27000, 0, "osh"},
+		{"fixed never goes below zero", []*Promotion{promo("free", PromotionFixed, 50000, PromotionScopeFood, "1", 0)}, 0, 1, 0, 0, "free"},
+		{"ended, inactive and other days are skipped", []*Promotion{ended, inactive, tuesdays}, 0, 1, 30000, 0, ""},
+		{"inside its daily window", []*Promotion{lunch}, 0, 1, 15000, 0, "lunch"},
+		{"buy 2 get 1, short of a set", []*Promotion{buy2get1}, 0, 2, 30000, 0, "b2g1"},
+		{"buy 2 get 1, two full sets", []*Promotion{buy2get1}, 0, 7, 30000, 2, "b2g1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usePromotions(t, tt.promotions...)
+			food := &Food{ID: 1, Category: "plov", Price: 30000, Discount: tt.discount}
+
+			price := priceFood(food, tt.quantity, at)
+			if price.BasePrice != 30000 || price.UnitPrice != tt.wantUnit || price.FreeItems != tt.wantFree {
+				t.Errorf("priceFood() = base %d, unit %d, free %d; want unit %d, free %d",
+					price.BasePrice, price.UnitPrice, price.FreeItems, tt.wantUnit, tt.wantFree)
+			}
+			got := ""
+			if price.Promotion != nil {
+				got = price.Promotion.ID
+			}
+			if got != tt.wantPromo {
+				t.Errorf("promotion = %q, want %q", got, tt.wantPromo)
+			}
+		})
+	}
+}
+
+func TestFoodPriceTotal(t *testing.T) {
+	tests := []struct {
+		name     string
+		price    FoodPrice
+		quantity int
+		extras   int
+		want     int
+	}{
+		{"plain", FoodPrice{BasePrice: 30000, UnitPrice: 30000}, 2, 0, 60000},
+		{"discounted with extras", FoodPrice{BasePrice: 30000, UnitPrice: 27000}, 2, 2000, 58000},
+		{"free portions still pay their extras", FoodPrice{BasePrice: 30000, UnitPrice: 30000, FreeItems: 1}, 3, 2000, 66000},
+		{"free unit with extras", FoodPrice{BasePrice: 5000, UnitPrice: 0}, 2, 3000, 6000},
+		{"negative extras stop at zero", FoodPrice{BasePrice: 1000, UnitPrice: 1000}, 2, -2000, 0},
+		{"total never negative", FoodPrice{BasePrice: 1000, UnitPrice: 1000, FreeItems: 1}, 1, -2000, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.price.Total(tt.quantity, tt.extras); got != tt.want {
+			t.Errorf("%s: Total(%d, %d) = %d, want %d", tt.name, tt.quantity, tt.extras, got, tt.want)
+		}
+	}
+}
+
+func TestInitRateLimiterSharedValues(t *testing.T) {
+	saved := config
+	limits := []*RateLimit{&RateLimitAPI, &RateLimitLoginIP, &RateLimitLoginPhone, &RateLimitRegisterIP, &RateLimitUploadIP}
+	defaults := make([]RateLimit, len(limits))
+	for i, limit := range limits {
+		defaults[i] = *limit
+		*limit = RateLimit{}
+	}
+	t.Cleanup(func() {
+		config = saved
+		for i, limit := range limits {
+			*limit = defaults[i]
+		}
+	})
+
+	// Login by phone and registration share one spelling
+	config = &Config{RateLimit: RateLimitConfig{
+		Store:      "memory",
+		API:        "300/1m",
+		LoginIP:    "10/1m",
+		LoginPhone: "5/1m",
+		RegisterIP: "5/1m",
+		UploadIP:   "30/1m",
+	}}
+	if err := initRateLimiter(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []RateLimit{{300, time.Minute}, {10, time.Minute}, {5, time.Minute}, {5, time.Minute}, {30, time.Minute}}
+	for i, limit := range limits {
+		if *limit != want[i] {
+			t.Errorf("limit %d = %+v, want %+v", i, *limit, want[i])
+		}
+	}
+}